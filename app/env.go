@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // CheckEnvironment ensures the required environment variables are defined and not empty.
@@ -25,8 +27,8 @@ func CheckEnvironment() error {
 		"SMTP_USER",
 		"SMTP_PASS",
 		"BUCKET_URL",
-		"ACCESS_TOKEN_SECRET",
-		"RESET_TOKEN_SECRET",
+		// Token secrets and keys are checked as they're loaded, see jwk.KeysetFromEnv
+		// and token.FingerprintSecretsFromEnv.
 	}
 
 	for _, key := range RequiredKeys {
@@ -41,3 +43,33 @@ func CheckEnvironment() error {
 
 	return nil
 }
+
+// Duration reads an optional duration (e.g. "720h") from the environment, falling back when it's undefined.
+func Duration(key string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid [%s] environment variable: %w", key, err)
+	}
+
+	return d, nil
+}
+
+// Int reads an optional integer from the environment, falling back when it's undefined.
+func Int(key string, fallback int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid [%s] environment variable: %w", key, err)
+	}
+
+	return i, nil
+}
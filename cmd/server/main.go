@@ -3,20 +3,39 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 
 	"atraf-server/app"
 
 	"atraf-server/services/account"
+	"atraf-server/services/audit"
 	"atraf-server/services/bucket"
 	"atraf-server/services/comments"
+	"atraf-server/services/events"
+	"atraf-server/services/invites"
+	"atraf-server/services/notifications"
 	"atraf-server/services/posts"
+	"atraf-server/services/purge"
+	"atraf-server/services/sessions"
+	"atraf-server/services/tokens"
 	"atraf-server/services/users"
+	"atraf-server/services/webhooks"
 
 	"atraf-server/pkg/authentication"
+	"atraf-server/pkg/authorization"
+	"atraf-server/pkg/database"
+	"atraf-server/pkg/jwk"
+	"atraf-server/pkg/limiter"
 	"atraf-server/pkg/middleware"
+	"atraf-server/pkg/oidc"
+	"atraf-server/pkg/password"
+	"atraf-server/pkg/rest"
+	"atraf-server/pkg/token"
 	"atraf-server/pkg/validate"
+	"atraf-server/pkg/webauthn"
 )
 
 func main() {
@@ -24,6 +43,12 @@ func main() {
 		log.Fatal(err)
 	}
 
+	trustedProxies, err := rest.ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	rest.TrustedProxies = trustedProxies
+
 	sql, err := app.DBConnection()
 	if err != nil {
 		log.Fatal(err)
@@ -34,66 +59,280 @@ func main() {
 	bucketStorage := bucket.NewFSBucket()
 	bucketService := bucket.NewService(bucketStorage)
 
-	usersStorage := users.NewStorage(sql)
-	usersService := users.NewService(usersStorage)
+	transactor := database.NewTransactor(sql)
+
+	eventsStorage := events.NewStorage(sql)
+	eventsService := events.NewService(eventsStorage)
+
+	usersStorage := users.NewStorage(sql, bucketService)
+	usersService := users.NewService(usersStorage, transactor)
 	usersHandler := users.NewHandler(usersService, validator)
 
+	sessionsStorage := sessions.NewStorage(sql)
+	sessionsService := sessions.NewService(sessionsStorage)
+
+	// Failure records are kept in Postgres unless configured otherwise,
+	// an in-memory store is only suitable for a single server instance.
+	var limiterStore limiter.Store = limiter.NewPostgresStore(sql)
+	if os.Getenv("LIMITER_STORE") == "memory" {
+		limiterStore = limiter.NewMemoryStore()
+	}
+	loginLimiter := limiter.New(limiterStore, limiter.DefaultPolicy)
+
+	deletionGracePeriod, err := app.Duration("ACCOUNT_DELETION_GRACE_PERIOD", time.Hour*24*30)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	passwordPolicy := password.DefaultPolicy
+	if passwordPolicy.MinLength, err = app.Int("PASSWORD_MIN_LENGTH", passwordPolicy.MinLength); err != nil {
+		log.Fatal(err)
+	}
+	if passwordPolicy.MinScore, err = app.Int("PASSWORD_MIN_SCORE", passwordPolicy.MinScore); err != nil {
+		log.Fatal(err)
+	}
+	if dir := os.Getenv("BREACHED_PASSWORDS_DIR"); dir != "" {
+		if passwordPolicy.Breached, err = password.NewRangeDirectory(dir); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	passwordHasher, err := passwordHasherFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if authentication.AccessTokenKeys, err = jwk.KeysetFromEnv("ACCESS_TOKEN"); err != nil {
+		log.Fatal(err)
+	}
+	if token.Keys, err = jwk.KeysetFromEnv("RESET_TOKEN"); err != nil {
+		log.Fatal(err)
+	}
+	if token.FingerprintSecrets, err = token.FingerprintSecretsFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Only access tokens are meant to be verified by other services.
+	jwks := authentication.AccessTokenKeys.Set()
+
+	webauthnConfig, err := webauthn.ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	oidcConfigs, err := oidc.ConfigsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	oidcProviders := make([]*oidc.Provider, 0)
+	for _, config := range oidcConfigs {
+		oidcProviders = append(oidcProviders, oidc.NewProvider(config))
+	}
+
+	auditStorage := audit.NewStorage(sql)
+	auditService := audit.NewService(auditStorage)
+	auditHandler := audit.NewHandler(auditService)
+
+	registrationMode := os.Getenv("REGISTRATION_MODE")
+	switch registrationMode {
+	case "":
+		registrationMode = account.RegistrationOpen
+	case account.RegistrationOpen, account.RegistrationInvite, account.RegistrationClosed:
+	default:
+		log.Fatalf("unknown registration mode [%s]", registrationMode)
+	}
+
+	invitesStorage := invites.NewStorage(sql)
+	invitesService := invites.NewService(invitesStorage)
+	invitesHandler := invites.NewHandler(invitesService, validator)
+
 	accountStorage := account.NewStorage(sql)
-	accountService := account.NewService(accountStorage)
-	accountHandler := account.NewHandler(accountService, usersService, validator)
+	accountService := account.NewService(accountStorage, usersService, invitesService, transactor, eventsService, loginLimiter, auditService, account.Config{
+		DeletionGracePeriod: deletionGracePeriod,
+		PasswordPolicy:      passwordPolicy,
+		PasswordHasher:      passwordHasher,
+		WebAuthn:            webauthnConfig,
+		RegistrationMode:    registrationMode,
+	})
+	accountHandler := account.NewHandler(accountService, sessionsService, oidcProviders, validator)
+
+	tokensStorage := tokens.NewStorage(sql)
+	tokensService := tokens.NewService(tokensStorage)
+	tokensHandler := tokens.NewHandler(tokensService, validator)
+
+	authenticator := authentication.NewAuthenticator(sessionsService, tokensService)
 
 	postsStorage := posts.NewStorage(sql, bucketService)
-	postsService := posts.NewService(postsStorage)
+	postsService := posts.NewService(postsStorage, transactor, eventsService)
 	postsHandler := posts.NewHandler(postsService, usersService, validator)
 
 	commentsStorage := comments.NewStorage(sql)
-	commentsService := comments.NewService(commentsStorage)
+	commentsService := comments.NewService(commentsStorage, transactor, eventsService)
 	commentsHandler := comments.NewHandler(commentsService, usersService, validator)
 
+	notificationsService := notifications.NewService(usersService, postsService)
+
+	webhooksStorage := webhooks.NewStorage(sql)
+	webhooksService := webhooks.NewService(webhooksStorage, postsService, commentsService)
+	webhooksHandler := webhooks.NewHandler(webhooksService, validator)
+	go webhooksService.Start(time.Second * 5)
+
+	// Subscribers must be registered before the dispatcher starts.
+	accountService.Subscribe(eventsService)
+	notificationsService.Subscribe(eventsService)
+	webhooksService.Subscribe(eventsService)
+	go eventsService.Start(time.Second * 2)
+
+	purgeService := purge.NewService(accountService, sessionsService, usersService, postsService, commentsService, auditService)
+	go purgeService.Start(time.Hour)
+
 	router := chi.NewRouter()
 	router.Use(middleware.Cors)
 	router.Use(middleware.Options)
+	router.Use(middleware.MaxBodySize(middleware.DefaultMaxBodySize))
 
 	// health check
 	router.Get("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
 
+	// public token verification keys
+	router.Get("/.well-known/jwks.json", jwks.Handler())
+
 	// Public Routes
 	router.Group(func(router chi.Router) {
 		router.Post("/account/register", accountHandler.Register())
 		router.Post("/account/login", accountHandler.Login())
+		router.Post("/account/2fa/verify", accountHandler.TwoFactorVerify())
+		router.Post("/account/magic-link", accountHandler.MagicLink())
+		router.Post("/account/magic-link/verify", accountHandler.MagicLinkVerify())
 		router.Post("/account/forgot", accountHandler.Forgot())
 		router.Patch("/account/reset", accountHandler.Reset())
+		router.Post("/account/refresh", accountHandler.Refresh())
+		router.Post("/account/logout", accountHandler.Logout())
+		router.Patch("/account/email/confirm", accountHandler.ConfirmEmail())
+		router.Post("/account/delete/confirm", accountHandler.ConfirmDelete())
+		router.Get("/account/oauth/{provider}/start", accountHandler.OAuthStart())
+		router.Get("/account/oauth/{provider}/callback", accountHandler.OAuthCallback())
+		router.Post("/account/webauthn/login/start", accountHandler.PasskeyLoginStart())
+		router.Post("/account/webauthn/login/finish", accountHandler.PasskeyLoginFinish())
 	})
 
 	// Private Routes (unverified users)
 	router.Group(func(router chi.Router) {
-		router.Use(authentication.Middleware(false))
+		router.Use(authenticator.Middleware(false))
 
 		router.Patch("/account/activate", accountHandler.Activate())
+		router.Post("/account/activate/resend", accountHandler.ResendActivation())
 	})
 
 	// Private Routes (verified users)
 	router.Group(func(router chi.Router) {
-		router.Use(authentication.Middleware(true))
+		router.Use(authenticator.Middleware(true))
 
 		// FS Bucket specific file server
 		router.Get("/uploads/*", bucketStorage.ServeFiles())
 
-		router.Get("/users/{user_id}", usersHandler.ReadOne())
+		// Account management is not available to personal access tokens
+		router.Group(func(router chi.Router) {
+			router.Use(authentication.SessionOnly)
+
+			router.Delete("/account", accountHandler.Delete())
+			router.Post("/account/email", accountHandler.ChangeEmail())
+			router.Patch("/account/password", accountHandler.ChangePassword())
+
+			router.Post("/account/2fa/setup", accountHandler.TwoFactorSetup())
+			router.Post("/account/2fa/confirm", accountHandler.TwoFactorConfirm())
+
+			router.Post("/account/webauthn/register/start", accountHandler.PasskeyRegisterStart())
+			router.Post("/account/webauthn/register/finish", accountHandler.PasskeyRegisterFinish())
+			router.Get("/account/webauthn/credentials", accountHandler.Passkeys())
+			router.Delete("/account/webauthn/credentials/{passkey_id}", accountHandler.RemovePasskey())
+
+			router.Get("/account/sessions", accountHandler.Sessions())
+			router.Delete("/account/sessions", accountHandler.RevokeSessions())
+			router.Delete("/account/sessions/{session_id}", accountHandler.RevokeSession())
+
+			router.Post("/account/tokens", tokensHandler.Create())
+			router.Get("/account/tokens", tokensHandler.ReadMany())
+			router.Delete("/account/tokens/{token_id}", tokensHandler.Revoke())
+
+			router.Post("/account/invites", invitesHandler.Create())
+			router.Get("/account/invites", invitesHandler.ReadMany())
+			router.Get("/account/invites/invitees", invitesHandler.Invitees())
+			router.Delete("/account/invites/{invite_id}", invitesHandler.Revoke())
+
+			router.With(middleware.Pagination).Get("/account/activity", auditHandler.Activity())
+
+			router.Group(func(router chi.Router) {
+				router.Use(authorization.RequireRole(authorization.RoleAdmin))
+
+				router.Patch("/admin/accounts/{account_id}/role", accountHandler.ChangeRole())
+				router.With(middleware.Pagination).Get("/admin/events", auditHandler.Query())
+
+				router.Post("/admin/webhooks", webhooksHandler.Create())
+				router.Get("/admin/webhooks", webhooksHandler.ReadMany())
+				router.Put("/admin/webhooks/{webhook_id}", webhooksHandler.Update())
+				router.Delete("/admin/webhooks/{webhook_id}", webhooksHandler.Delete())
+				router.With(middleware.Pagination).Get("/admin/webhooks/{webhook_id}/deliveries", webhooksHandler.Deliveries())
+			})
+		})
 
-		router.Post("/posts", postsHandler.Create())
-		router.Put("/posts/{post_id}", postsHandler.Update())
-		router.Get("/posts/{post_id}", postsHandler.ReadOne())
-		router.With(middleware.Pagination).Get("/posts", postsHandler.ReadMany())
+		router.With(authentication.RequireScope(authentication.ScopeUsersWrite)).Patch("/users/me", usersHandler.Update())
+		router.With(authentication.RequireScope(authentication.ScopeUsersWrite)).Put("/users/me/picture", usersHandler.UpdatePicture())
+		router.With(authentication.RequireScope(authentication.ScopeUsersRead)).Get("/users/{user_id}", usersHandler.ReadOne())
 
-		router.Post("/comments", commentsHandler.Create())
-		router.Get("/comments/{source_id}", commentsHandler.ReadMany())
-		router.Put("/comments/{comment_id}", commentsHandler.Update())
+		router.With(authentication.RequireScope(authentication.ScopePostsWrite)).Post("/posts", postsHandler.Create())
+		router.With(authentication.RequireScope(authentication.ScopePostsWrite)).Put("/posts/{post_id}", postsHandler.Update())
+		router.With(authentication.RequireScope(authentication.ScopePostsRead)).Get("/posts/{post_id}", postsHandler.ReadOne())
+		router.With(authentication.RequireScope(authentication.ScopePostsRead), middleware.Pagination).Get("/posts", postsHandler.ReadMany())
+
+		router.With(authentication.RequireScope(authentication.ScopeCommentsWrite)).Post("/comments", commentsHandler.Create())
+		router.With(authentication.RequireScope(authentication.ScopeCommentsRead)).Get("/comments/{source_id}", commentsHandler.ReadMany())
+		router.With(authentication.RequireScope(authentication.ScopeCommentsWrite)).Put("/comments/{comment_id}", commentsHandler.Update())
 	})
 
 	if err = app.ServeHTTP(router); err != nil {
 		log.Fatal()
 	}
 }
+
+// passwordHasherFromEnv overrides the default password hashing algorithm and cost parameters.
+func passwordHasherFromEnv() (password.Hasher, error) {
+	hasher := password.DefaultHasher
+
+	if algorithm := os.Getenv("PASSWORD_HASH_ALGORITHM"); algorithm != "" {
+		hasher.Algorithm = algorithm
+	}
+
+	memory, err := app.Int("PASSWORD_ARGON2_MEMORY", int(hasher.Argon2.Memory))
+	if err != nil {
+		return hasher, err
+	}
+
+	iterations, err := app.Int("PASSWORD_ARGON2_ITERATIONS", int(hasher.Argon2.Iterations))
+	if err != nil {
+		return hasher, err
+	}
+
+	parallelism, err := app.Int("PASSWORD_ARGON2_PARALLELISM", int(hasher.Argon2.Parallelism))
+	if err != nil {
+		return hasher, err
+	}
+
+	if hasher.BcryptCost, err = app.Int("PASSWORD_BCRYPT_COST", hasher.BcryptCost); err != nil {
+		return hasher, err
+	}
+
+	hasher.Argon2.Memory = uint32(memory)
+	hasher.Argon2.Iterations = uint32(iterations)
+	hasher.Argon2.Parallelism = uint8(parallelism)
+
+	// Fail at startup rather than on the first registration.
+	if _, err = hasher.Hash(""); err != nil {
+		return hasher, err
+	}
+
+	return hasher, nil
+}
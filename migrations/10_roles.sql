@@ -0,0 +1,5 @@
+/*ACCOUNTS*/
+-- The first admin has to be promoted manually, e.g. UPDATE accounts SET role = 'admin' WHERE email = '...';
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS role text NOT NULL default 'user';
+ALTER TABLE accounts DROP CONSTRAINT IF EXISTS accounts_role_check;
+ALTER TABLE accounts ADD CONSTRAINT accounts_role_check CHECK (role IN ('user', 'moderator', 'admin'));
@@ -0,0 +1,30 @@
+/*ACCOUNT EVENTS*/
+-- Append-only security audit log, rows are never deleted nor updated,
+-- except for being anonymized once their account is purged.
+DROP TABLE IF EXISTS account_events;
+CREATE TABLE IF NOT EXISTS account_events
+(
+    uuid         uuid      NOT NULL PRIMARY KEY default gen_random_uuid(),
+    account_uuid uuid,
+    type         text      NOT NULL,
+    ip           text      NOT NULL             default '',
+    user_agent   text      NOT NULL             default '',
+    metadata     jsonb     NOT NULL             default '{}',
+    created_at   timestamp NOT NULL             default current_timestamp
+);
+DROP INDEX IF EXISTS account_events_account_uuid_idx;
+CREATE INDEX account_events_account_uuid_idx ON account_events (account_uuid, created_at DESC);
+DROP INDEX IF EXISTS account_events_ip_idx;
+CREATE INDEX account_events_ip_idx ON account_events (ip, created_at DESC);
+
+-- An update may only clear the account, client and metadata of an event.
+CREATE OR REPLACE RULE account_events_no_update AS ON UPDATE TO account_events
+    WHERE NOT (NEW.account_uuid IS NULL
+        AND NEW.ip = ''
+        AND NEW.user_agent = ''
+        AND NEW.metadata = '{}'
+        AND NEW.uuid = OLD.uuid
+        AND NEW.type = OLD.type
+        AND NEW.created_at = OLD.created_at)
+    DO INSTEAD NOTHING;
+CREATE OR REPLACE RULE account_events_no_delete AS ON DELETE TO account_events DO INSTEAD NOTHING;
@@ -0,0 +1,29 @@
+/*OUTBOX*/
+-- Domain events, written in the same transaction as the change they describe.
+DROP TABLE IF EXISTS outbox;
+CREATE TABLE IF NOT EXISTS outbox
+(
+    uuid         uuid      NOT NULL PRIMARY KEY default gen_random_uuid(),
+    type         text      NOT NULL,
+    payload      jsonb     NOT NULL,
+    attempts     int       NOT NULL             default 0,
+    last_error   text,
+    available_at timestamp NOT NULL             default current_timestamp,
+    locked_until timestamp,
+    processed_at timestamp,
+    failed_at    timestamp,
+    created_at   timestamp NOT NULL             default current_timestamp
+);
+DROP INDEX IF EXISTS outbox_pending_idx;
+CREATE INDEX outbox_pending_idx ON outbox (available_at) WHERE processed_at IS NULL AND failed_at IS NULL;
+
+/*OUTBOX DELIVERIES*/
+-- Subscribers which already handled an event, so a retry only reaches the ones which failed.
+DROP TABLE IF EXISTS outbox_deliveries;
+CREATE TABLE IF NOT EXISTS outbox_deliveries
+(
+    event_uuid   uuid      NOT NULL,
+    subscriber   text      NOT NULL,
+    delivered_at timestamp NOT NULL default current_timestamp,
+    PRIMARY KEY (event_uuid, subscriber)
+);
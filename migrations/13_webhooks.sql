@@ -0,0 +1,38 @@
+/*WEBHOOKS*/
+DROP TABLE IF EXISTS webhooks;
+CREATE TABLE IF NOT EXISTS webhooks
+(
+    uuid         uuid      NOT NULL PRIMARY KEY default gen_random_uuid(),
+    account_uuid uuid      NOT NULL,
+    url          text      NOT NULL,
+    events       text[]    NOT NULL             default '{}',
+    secret       text      NOT NULL,
+    active       boolean   NOT NULL             default true,
+    -- Consecutive failed delivery attempts, reset by any successful one.
+    failures     int       NOT NULL             default 0,
+    disabled_at  timestamp,
+    created_at   timestamp NOT NULL             default current_timestamp,
+    updated_at   timestamp NOT NULL             default current_timestamp
+);
+
+/*WEBHOOK DELIVERIES*/
+DROP TABLE IF EXISTS webhook_deliveries;
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+    uuid            uuid      NOT NULL PRIMARY KEY default gen_random_uuid(),
+    webhook_uuid    uuid      NOT NULL,
+    event_uuid      uuid      NOT NULL,
+    event_type      text      NOT NULL,
+    payload         jsonb     NOT NULL,
+    attempts        int       NOT NULL             default 0,
+    status_code     int,
+    last_error      text,
+    next_attempt_at timestamp NOT NULL             default current_timestamp,
+    locked_until    timestamp,
+    delivered_at    timestamp,
+    failed_at       timestamp,
+    created_at      timestamp NOT NULL             default current_timestamp,
+    UNIQUE (webhook_uuid, event_uuid)
+);
+DROP INDEX IF EXISTS webhook_deliveries_pending_idx;
+CREATE INDEX webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE delivered_at IS NULL AND failed_at IS NULL;
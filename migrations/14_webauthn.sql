@@ -0,0 +1,33 @@
+/*WEBAUTHN CREDENTIALS*/
+DROP TABLE IF EXISTS webauthn_credentials;
+CREATE TABLE IF NOT EXISTS webauthn_credentials
+(
+    uuid            uuid      NOT NULL PRIMARY KEY default gen_random_uuid(),
+    account_uuid    uuid      NOT NULL,
+    credential_id   bytea     NOT NULL UNIQUE,
+    name            text      NOT NULL,
+    -- COSE encoded public key.
+    public_key      bytea     NOT NULL,
+    algorithm       int       NOT NULL,
+    sign_count      bigint    NOT NULL             default 0,
+    aaguid          bytea     NOT NULL,
+    transports      text[]    NOT NULL             default '{}',
+    backup_eligible bool      NOT NULL             default false,
+    last_used_at    timestamp,
+    created_at      timestamp NOT NULL             default current_timestamp
+);
+DROP INDEX IF EXISTS webauthn_credentials_account_uuid_idx;
+CREATE INDEX webauthn_credentials_account_uuid_idx ON webauthn_credentials (account_uuid);
+
+/*WEBAUTHN CHALLENGES*/
+-- Challenges of passwordless logins aren't bound to an account until the credential is known.
+DROP TABLE IF EXISTS webauthn_challenges;
+CREATE TABLE IF NOT EXISTS webauthn_challenges
+(
+    uuid         uuid      NOT NULL PRIMARY KEY default gen_random_uuid(),
+    account_uuid uuid,
+    purpose      text      NOT NULL,
+    challenge    bytea     NOT NULL,
+    expires_at   timestamp NOT NULL,
+    created_at   timestamp NOT NULL             default current_timestamp
+);
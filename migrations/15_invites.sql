@@ -0,0 +1,29 @@
+/*INVITES*/
+DROP TABLE IF EXISTS invites;
+CREATE TABLE IF NOT EXISTS invites
+(
+    uuid         uuid      NOT NULL PRIMARY KEY default gen_random_uuid(),
+    account_uuid uuid      NOT NULL,
+    code         text      NOT NULL UNIQUE,
+    max_uses     int       NOT NULL             default 1,
+    uses         int       NOT NULL             default 0,
+    expires_at   timestamp,
+    revoked_at   timestamp,
+    created_at   timestamp NOT NULL             default current_timestamp
+);
+DROP INDEX IF EXISTS invites_account_uuid_idx;
+CREATE INDEX invites_account_uuid_idx ON invites (account_uuid);
+
+/*INVITE REDEMPTIONS*/
+-- Which account invited whom, account_uuid is the invited account.
+-- invited_by is NULL once the inviting account is purged.
+DROP TABLE IF EXISTS invite_redemptions;
+CREATE TABLE IF NOT EXISTS invite_redemptions
+(
+    invite_uuid  uuid      NOT NULL,
+    account_uuid uuid      NOT NULL PRIMARY KEY,
+    invited_by   uuid,
+    created_at   timestamp NOT NULL default current_timestamp
+);
+DROP INDEX IF EXISTS invite_redemptions_invited_by_idx;
+CREATE INDEX invite_redemptions_invited_by_idx ON invite_redemptions (invited_by);
@@ -0,0 +1,25 @@
+/*ACCOUNTS*/
+-- The nickname is owned by the user profile, a copy on the account would go stale once it changes.
+ALTER TABLE accounts DROP COLUMN IF EXISTS nickname;
+
+/*USERS*/
+ALTER TABLE users ADD COLUMN IF NOT EXISTS bio text;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS location text;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS website text;
+DROP INDEX IF EXISTS users_nickname_idx;
+CREATE INDEX users_nickname_idx ON users (lower(nickname));
+
+/*NICKNAME HISTORY*/
+-- Nicknames given up by users, a nickname stays reserved for a while after it was changed.
+DROP TABLE IF EXISTS nickname_history;
+CREATE TABLE IF NOT EXISTS nickname_history
+(
+    uuid       uuid      NOT NULL PRIMARY KEY default gen_random_uuid(),
+    user_uuid  uuid      NOT NULL,
+    nickname   text      NOT NULL,
+    changed_at timestamp NOT NULL             default current_timestamp
+);
+DROP INDEX IF EXISTS nickname_history_user_uuid_idx;
+CREATE INDEX nickname_history_user_uuid_idx ON nickname_history (user_uuid, changed_at);
+DROP INDEX IF EXISTS nickname_history_nickname_idx;
+CREATE INDEX nickname_history_nickname_idx ON nickname_history (lower(nickname), changed_at);
@@ -0,0 +1,28 @@
+/*SESSIONS*/
+DROP TABLE IF EXISTS sessions;
+CREATE TABLE IF NOT EXISTS sessions
+(
+    uuid         uuid      NOT NULL PRIMARY KEY default gen_random_uuid(),
+    account_uuid uuid      NOT NULL,
+    user_agent   text      NOT NULL             default '',
+    ip           text      NOT NULL             default '',
+    created_at   timestamp NOT NULL             default current_timestamp,
+    last_seen_at timestamp NOT NULL             default current_timestamp,
+    expires_at   timestamp NOT NULL,
+    revoked_at   timestamp
+);
+DROP INDEX IF EXISTS sessions_account_uuid_idx;
+CREATE INDEX sessions_account_uuid_idx ON sessions (account_uuid);
+
+/*REFRESH TOKENS*/
+DROP TABLE IF EXISTS refresh_tokens;
+CREATE TABLE IF NOT EXISTS refresh_tokens
+(
+    uuid         uuid      NOT NULL PRIMARY KEY default gen_random_uuid(),
+    session_uuid uuid      NOT NULL,
+    token_hash   text      NOT NULL UNIQUE,
+    created_at   timestamp NOT NULL             default current_timestamp,
+    used_at      timestamp
+);
+DROP INDEX IF EXISTS refresh_tokens_session_uuid_idx;
+CREATE INDEX refresh_tokens_session_uuid_idx ON refresh_tokens (session_uuid);
@@ -0,0 +1,3 @@
+/*ACCOUNTS*/
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS activation_sent_at timestamp NOT NULL default current_timestamp;
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS activation_resends int NOT NULL default 0;
@@ -0,0 +1,4 @@
+/*ACCOUNTS*/
+-- the default must match account.ActivationCodeValidFor
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS activation_expires_at timestamp NOT NULL default current_timestamp + interval '1 hour';
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS activation_attempts int NOT NULL default 0;
@@ -0,0 +1,8 @@
+/*RATE LIMITS*/
+DROP TABLE IF EXISTS rate_limits;
+CREATE TABLE IF NOT EXISTS rate_limits
+(
+    key          text      NOT NULL PRIMARY KEY,
+    failures     int       NOT NULL default 0,
+    last_failure timestamp NOT NULL default current_timestamp
+);
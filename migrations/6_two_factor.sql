@@ -0,0 +1,18 @@
+/*ACCOUNTS*/
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS totp_secret text;
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS totp_enabled bool NOT NULL default false;
+-- The time step of the last accepted code, a code is only accepted once.
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS totp_last_step bigint;
+
+/*RECOVERY CODES*/
+DROP TABLE IF EXISTS recovery_codes;
+CREATE TABLE IF NOT EXISTS recovery_codes
+(
+    uuid         uuid      NOT NULL PRIMARY KEY default gen_random_uuid(),
+    account_uuid uuid      NOT NULL,
+    code_hash    text      NOT NULL,
+    created_at   timestamp NOT NULL             default current_timestamp,
+    used_at      timestamp
+);
+DROP INDEX IF EXISTS recovery_codes_account_uuid_idx;
+CREATE INDEX recovery_codes_account_uuid_idx ON recovery_codes (account_uuid);
@@ -0,0 +1,10 @@
+/*SINGLE USE TOKENS*/
+DROP TABLE IF EXISTS single_use_tokens;
+CREATE TABLE IF NOT EXISTS single_use_tokens
+(
+    uuid         uuid      NOT NULL PRIMARY KEY default gen_random_uuid(),
+    account_uuid uuid      NOT NULL,
+    purpose      text      NOT NULL,
+    created_at   timestamp NOT NULL             default current_timestamp,
+    used_at      timestamp
+);
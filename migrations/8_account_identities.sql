@@ -0,0 +1,14 @@
+/*ACCOUNT IDENTITIES*/
+DROP TABLE IF EXISTS account_identities;
+CREATE TABLE IF NOT EXISTS account_identities
+(
+    uuid         uuid      NOT NULL PRIMARY KEY default gen_random_uuid(),
+    account_uuid uuid      NOT NULL,
+    provider     text      NOT NULL,
+    subject      text      NOT NULL,
+    email        text,
+    created_at   timestamp NOT NULL             default current_timestamp,
+    UNIQUE (provider, subject)
+);
+DROP INDEX IF EXISTS account_identities_account_uuid_idx;
+CREATE INDEX account_identities_account_uuid_idx ON account_identities (account_uuid);
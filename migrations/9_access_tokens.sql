@@ -0,0 +1,16 @@
+/*ACCESS TOKENS*/
+DROP TABLE IF EXISTS access_tokens;
+CREATE TABLE IF NOT EXISTS access_tokens
+(
+    uuid         uuid      NOT NULL PRIMARY KEY default gen_random_uuid(),
+    account_uuid uuid      NOT NULL,
+    name         text      NOT NULL,
+    scopes       text[]    NOT NULL             default '{}',
+    token_hash   text      NOT NULL UNIQUE,
+    last_used_at timestamp,
+    expires_at   timestamp,
+    revoked_at   timestamp,
+    created_at   timestamp NOT NULL             default current_timestamp
+);
+DROP INDEX IF EXISTS access_tokens_account_uuid_idx;
+CREATE INDEX access_tokens_account_uuid_idx ON access_tokens (account_uuid);
@@ -2,12 +2,15 @@ package authentication
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 
+	"atraf-server/pkg/jwk"
 	"atraf-server/pkg/rest"
 	"atraf-server/pkg/uid"
 )
@@ -17,6 +20,27 @@ type contextKey string
 const (
 	AccessTokenCookie = "atcId"
 	AccessTokenExpiry = time.Minute * 20
+
+	RefreshTokenCookie = "rtcId"
+	RefreshTokenPath   = "/account"
+
+	BearerPrefix = "Bearer "
+
+	// Access tokens carry their issuer, audience and type (RFC 9068), so services verifying them
+	// using the published keys can tell them apart from any other token.
+	AccessTokenIssuer   = "atraf-server"
+	AccessTokenAudience = "atraf-api"
+	AccessTokenType     = "at+jwt"
+)
+
+var ErrNotAccessToken = errors.New("token is not an access token")
+
+// Reasons sent along with 403 responses, see rest.Forbidden.
+const (
+	ReasonAccountInactive = "account_inactive"
+	ReasonAccountActive   = "account_active"
+	ReasonMissingScope    = "missing_scope"
+	ReasonSessionRequired = "session_required"
 )
 
 const ContextKey contextKey = "AuthCtx"
@@ -24,6 +48,11 @@ const ContextKey contextKey = "AuthCtx"
 type CustomClaims struct {
 	AccountId     uid.UID `json:"account_id"`
 	AccountActive bool    `json:"account_active"`
+	SessionId     uid.UID `json:"session_id"`
+	Role          string  `json:"role"`
+	// TokenId and Scopes are only set when authenticated by a personal access token.
+	TokenId uid.UID  `json:"-"`
+	Scopes  []string `json:"-"`
 }
 
 type AccessTokenClaims struct {
@@ -31,21 +60,20 @@ type AccessTokenClaims struct {
 	CustomClaims
 }
 
-var AccessTokenSecret = os.Getenv("ACCESS_TOKEN_SECRET")
+// AccessTokenKeys signs and verifies access tokens, see jwk.KeysetFromEnv.
+// It defaults to signing using ACCESS_TOKEN_SECRET alone.
+var AccessTokenKeys = jwk.NewHMACKeyset(os.Getenv("ACCESS_TOKEN_SECRET"))
 
-func SetCookie(w http.ResponseWriter, accountId uid.UID, accountActive bool) error {
-	unsignedToken := jwt.NewWithClaims(jwt.SigningMethodHS512, AccessTokenClaims{
+func SetCookie(w http.ResponseWriter, claims CustomClaims) error {
+	token, err := AccessTokenKeys.SignType(AccessTokenType, AccessTokenClaims{
 		StandardClaims: jwt.StandardClaims{
+			Issuer:    AccessTokenIssuer,
+			Audience:  AccessTokenAudience,
 			IssuedAt:  time.Now().Unix(),
 			ExpiresAt: time.Now().Add(AccessTokenExpiry).Unix(),
 		},
-		CustomClaims: CustomClaims{
-			AccountId:     accountId,
-			AccountActive: accountActive,
-		},
+		CustomClaims: claims,
 	})
-
-	token, err := unsignedToken.SignedString([]byte(AccessTokenSecret))
 	if err != nil {
 		return err
 	}
@@ -70,36 +98,101 @@ func ReadCookie(r *http.Request) (*AccessTokenClaims, error) {
 		return nil, err
 	}
 
-	token, err := jwt.ParseWithClaims(cookie.Value, &AccessTokenClaims{}, signingSecret(AccessTokenSecret))
+	token, err := jwt.ParseWithClaims(cookie.Value, &AccessTokenClaims{}, AccessTokenKeys.Keyfunc)
 	if err != nil {
 		return nil, err
 	}
 
 	claims, ok := token.Claims.(*AccessTokenClaims)
 	if !ok || !token.Valid {
-		return nil, err
+		return nil, ErrNotAccessToken
+	}
+
+	if typ, _ := token.Header["typ"].(string); typ != AccessTokenType {
+		return nil, ErrNotAccessToken
+	}
+
+	if !claims.VerifyIssuer(AccessTokenIssuer, true) || !claims.VerifyAudience(AccessTokenAudience, true) {
+		return nil, ErrNotAccessToken
 	}
 
 	return claims, nil
 }
 
-func signingSecret(secret string) jwt.Keyfunc {
-	return func(token *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
+// SetRefreshCookie stores the session refresh token.
+// The cookie is scoped to the account routes, it is never sent along with regular API requests.
+func SetRefreshCookie(w http.ResponseWriter, refreshToken string, expiresAt time.Time) {
+	cookie := &http.Cookie{
+		Name:     RefreshTokenCookie,
+		Value:    refreshToken,
+		Path:     RefreshTokenPath,
+		Expires:  expiresAt,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteDefaultMode,
+	}
+
+	http.SetCookie(w, cookie)
+}
+
+func ReadRefreshCookie(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(RefreshTokenCookie)
+	if err != nil {
+		return "", err
 	}
+
+	return cookie.Value, nil
 }
 
-func Middleware(activated bool) func(http.Handler) http.Handler {
+// ClearCookies expires both the access and refresh token cookies.
+func ClearCookies(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     AccessTokenCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+	})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     RefreshTokenCookie,
+		Path:     RefreshTokenPath,
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+	})
+}
+
+// SessionStore reports whether the session an access token was issued for is still active.
+type SessionStore interface {
+	IsActive(sessionId uid.UID) (bool, error)
+}
+
+// TokenStore verifies personal access tokens sent in the Authorization header.
+type TokenStore interface {
+	VerifyToken(token string) (CustomClaims, error)
+}
+
+type Authenticator struct {
+	sessions SessionStore
+	tokens   TokenStore
+}
+
+func (a Authenticator) Middleware(activated bool) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			claims, err := ReadCookie(r)
+			claims, err := a.authenticate(r)
 			if err != nil {
 				rest.Error(w, err, http.StatusUnauthorized)
 				return
 			}
 
 			if activated != claims.AccountActive {
-				rest.Error(w, err, http.StatusForbidden)
+				reason := ReasonAccountInactive
+				if claims.AccountActive {
+					reason = ReasonAccountActive
+				}
+				rest.Forbidden(w, errors.New("account activation state mismatch"), reason)
 				return
 			}
 
@@ -109,6 +202,40 @@ func Middleware(activated bool) func(http.Handler) http.Handler {
 	}
 }
 
+// authenticate reads the claims from a personal access token when an Authorization header
+// is present, and from the access token cookie otherwise.
+func (a Authenticator) authenticate(r *http.Request) (*AccessTokenClaims, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if !strings.HasPrefix(header, BearerPrefix) {
+			return nil, errors.New("unsupported authorization scheme")
+		}
+
+		claims, err := a.tokens.VerifyToken(strings.TrimPrefix(header, BearerPrefix))
+		if err != nil {
+			return nil, err
+		}
+
+		return &AccessTokenClaims{CustomClaims: claims}, nil
+	}
+
+	claims, err := ReadCookie(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Access tokens are stateless, a revoked session is only detected by looking it up.
+	active, err := a.sessions.IsActive(claims.SessionId)
+	if err != nil || !active {
+		return nil, errors.New("session is no longer active")
+	}
+
+	return claims, nil
+}
+
 func Context(request *http.Request) *AccessTokenClaims {
 	return request.Context().Value(ContextKey).(*AccessTokenClaims)
 }
+
+func NewAuthenticator(s SessionStore, t TokenStore) *Authenticator {
+	return &Authenticator{s, t}
+}
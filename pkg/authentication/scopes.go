@@ -0,0 +1,62 @@
+package authentication
+
+import (
+	"errors"
+	"net/http"
+
+	"atraf-server/pkg/rest"
+	"atraf-server/pkg/uid"
+)
+
+// Scopes limit what a personal access token can be used for.
+// Requests authenticated by the access token cookie are never limited.
+const (
+	ScopeUsersRead     = "users:read"
+	ScopeUsersWrite    = "users:write"
+	ScopePostsRead     = "posts:read"
+	ScopePostsWrite    = "posts:write"
+	ScopeCommentsRead  = "comments:read"
+	ScopeCommentsWrite = "comments:write"
+)
+
+// HasScope reports whether the request may access resources guarded by scope.
+func (c AccessTokenClaims) HasScope(scope string) bool {
+	if c.Scopes == nil {
+		return true
+	}
+
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RequireScope rejects requests authenticated by an access token lacking the scope.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !Context(r).HasScope(scope) {
+				rest.Forbidden(w, errors.New("access token is missing the "+scope+" scope"), ReasonMissingScope)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// SessionOnly rejects requests authenticated by a personal access token,
+// guarding routes which manage the account itself.
+func SessionOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if Context(r).SessionId == uid.Nil {
+			rest.Forbidden(w, errors.New("route is not available to access tokens"), ReasonSessionRequired)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
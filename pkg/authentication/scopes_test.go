@@ -0,0 +1,114 @@
+package authentication
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"atraf-server/pkg/jwk"
+	"atraf-server/pkg/uid"
+)
+
+const testToken = "atraf_pat_test"
+
+type testSessions map[uid.UID]bool
+
+func (s testSessions) IsActive(sessionId uid.UID) (bool, error) {
+	return s[sessionId], nil
+}
+
+type testTokens map[string]CustomClaims
+
+func (t testTokens) VerifyToken(token string) (CustomClaims, error) {
+	claims, ok := t[token]
+	if !ok {
+		return CustomClaims{}, errors.New("unknown token")
+	}
+
+	return claims, nil
+}
+
+// testRouter guards a route the way the server does, the response is 200 once every guard passed.
+func testRouter(a *Authenticator, guard func(http.Handler) http.Handler) http.Handler {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return a.Middleware(true)(guard(ok))
+}
+
+func TestScopes(t *testing.T) {
+	keys := AccessTokenKeys
+	t.Cleanup(func() { AccessTokenKeys = keys })
+	AccessTokenKeys = jwk.NewHMACKeyset("test-secret")
+
+	activeSession, revokedSession := uid.New(), uid.New()
+	a := NewAuthenticator(
+		testSessions{activeSession: true, revokedSession: false},
+		testTokens{
+			testToken:   {AccountId: uid.New(), AccountActive: true, TokenId: uid.New(), Scopes: []string{ScopePostsRead}},
+			"no-scopes": {AccountId: uid.New(), AccountActive: true, TokenId: uid.New(), Scopes: []string{}},
+		},
+	)
+
+	cookie := func(sessionId uid.UID) func(r *http.Request) {
+		return func(r *http.Request) {
+			w := httptest.NewRecorder()
+			if err := SetCookie(w, CustomClaims{AccountId: uid.New(), AccountActive: true, SessionId: sessionId}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, c := range w.Result().Cookies() {
+				r.AddCookie(c)
+			}
+		}
+	}
+
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.Header.Set("Authorization", BearerPrefix+token)
+		}
+	}
+
+	cases := []struct {
+		name         string
+		authenticate func(r *http.Request)
+		guard        func(http.Handler) http.Handler
+		expected     int
+	}{
+		{"token with the scope", bearer(testToken), RequireScope(ScopePostsRead), http.StatusOK},
+		{"token without the scope", bearer(testToken), RequireScope(ScopePostsWrite), http.StatusForbidden},
+		{"token without any scope", bearer("no-scopes"), RequireScope(ScopePostsRead), http.StatusForbidden},
+		{"token on a session only route", bearer(testToken), SessionOnly, http.StatusForbidden},
+		{"unknown token", bearer("unknown"), RequireScope(ScopePostsRead), http.StatusUnauthorized},
+		{"unsupported scheme", func(r *http.Request) { r.Header.Set("Authorization", "Basic abc") }, RequireScope(ScopePostsRead), http.StatusUnauthorized},
+		{"session", cookie(activeSession), RequireScope(ScopePostsWrite), http.StatusOK},
+		{"session on a session only route", cookie(activeSession), SessionOnly, http.StatusOK},
+		{"revoked session", cookie(revokedSession), RequireScope(ScopePostsRead), http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		c.authenticate(r)
+
+		w := httptest.NewRecorder()
+		testRouter(a, c.guard).ServeHTTP(w, r)
+
+		if w.Code != c.expected {
+			t.Errorf("%s: expected [%d] got [%d]", c.name, c.expected, w.Code)
+		}
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	session := AccessTokenClaims{}
+	if !session.HasScope(ScopeUsersWrite) {
+		t.Error("requests authenticated by a session must not be limited by scopes")
+	}
+
+	token := AccessTokenClaims{CustomClaims: CustomClaims{Scopes: []string{ScopeUsersRead}}}
+	if !token.HasScope(ScopeUsersRead) || token.HasScope(ScopeUsersWrite) {
+		t.Errorf("expected only [%s] to be granted", ScopeUsersRead)
+	}
+}
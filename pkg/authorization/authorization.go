@@ -0,0 +1,89 @@
+package authorization
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"atraf-server/pkg/authentication"
+	"atraf-server/pkg/rest"
+	"atraf-server/pkg/uid"
+)
+
+// Roles in ascending order of privilege, every role is granted whatever the lower ones are.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Reasons are sent along with 403 responses so clients can tell why the request was denied.
+const (
+	ReasonNotOwner         = "not_owner"
+	ReasonInsufficientRole = "insufficient_role"
+)
+
+var ranks = map[string]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+// ForbiddenError is returned when the request is authenticated but not allowed.
+type ForbiddenError struct {
+	Reason string
+}
+
+func (e *ForbiddenError) Error() string {
+	return fmt.Sprintf("forbidden: %s", e.Reason)
+}
+
+// ValidRole reports whether role is a known role.
+func ValidRole(role string) bool {
+	_, ok := ranks[role]
+	return ok
+}
+
+// HasRole reports whether role is at least as privileged as minimum.
+func HasRole(role string, minimum string) bool {
+	return ValidRole(role) && ranks[role] >= ranks[minimum]
+}
+
+// CanModify enforces ownership-or-role on mutations: users may only modify resources
+// they own (ownerId), whereas moderators and admins may modify any resource.
+func CanModify(role string, userId uid.UID, ownerId uid.UID) error {
+	if userId == ownerId || HasRole(role, RoleModerator) {
+		return nil
+	}
+
+	if !ValidRole(role) {
+		return &ForbiddenError{ReasonInsufficientRole}
+	}
+
+	return &ForbiddenError{ReasonNotOwner}
+}
+
+// RequireRole rejects requests of accounts less privileged than minimum.
+func RequireRole(minimum string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !HasRole(authentication.Context(r).Role, minimum) {
+				rest.Forbidden(w, errors.New("route requires the "+minimum+" role"), ReasonInsufficientRole)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Forbidden responds to a denied request, or with 500 when err is not a ForbiddenError.
+func Forbidden(w http.ResponseWriter, err error) {
+	var forbidden *ForbiddenError
+	if !errors.As(err, &forbidden) {
+		rest.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	rest.Forbidden(w, err, forbidden.Reason)
+}
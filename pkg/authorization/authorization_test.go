@@ -0,0 +1,80 @@
+package authorization
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"atraf-server/pkg/uid"
+)
+
+func TestCanModify(t *testing.T) {
+	owner, other := uid.New(), uid.New()
+
+	cases := []struct {
+		name   string
+		role   string
+		userId uid.UID
+		reason string
+	}{
+		{"owner", RoleUser, owner, ""},
+		{"another user", RoleUser, other, ReasonNotOwner},
+		{"moderator", RoleModerator, other, ""},
+		{"admin", RoleAdmin, other, ""},
+		{"unknown role", "superuser", other, ReasonInsufficientRole},
+		{"no role", "", other, ReasonInsufficientRole},
+	}
+
+	for _, c := range cases {
+		err := CanModify(c.role, c.userId, owner)
+
+		if c.reason == "" {
+			if err != nil {
+				t.Errorf("%s: expected to be allowed, got [%v]", c.name, err)
+			}
+			continue
+		}
+
+		var forbidden *ForbiddenError
+		if !errors.As(err, &forbidden) || forbidden.Reason != c.reason {
+			t.Errorf("%s: expected [%s] got [%v]", c.name, c.reason, err)
+		}
+	}
+}
+
+func TestHasRole(t *testing.T) {
+	cases := []struct {
+		role     string
+		minimum  string
+		expected bool
+	}{
+		{RoleUser, RoleUser, true},
+		{RoleUser, RoleModerator, false},
+		{RoleModerator, RoleUser, true},
+		{RoleModerator, RoleAdmin, false},
+		{RoleAdmin, RoleModerator, true},
+		{"superuser", RoleUser, false},
+		{"", RoleUser, false},
+	}
+
+	for _, c := range cases {
+		if got := HasRole(c.role, c.minimum); got != c.expected {
+			t.Errorf("[%s] has [%s]: expected %t got %t", c.role, c.minimum, c.expected, got)
+		}
+	}
+}
+
+func TestForbidden(t *testing.T) {
+	w := httptest.NewRecorder()
+	Forbidden(w, &ForbiddenError{ReasonNotOwner})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected [%d] got [%d]", http.StatusForbidden, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	Forbidden(w, errors.New("storage failure"))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected [%d] got [%d]", http.StatusInternalServerError, w.Code)
+	}
+}
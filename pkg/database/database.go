@@ -0,0 +1,30 @@
+package database
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+// Transactor runs work spanning several storages within a single database transaction.
+type Transactor struct {
+	db *sqlx.DB
+}
+
+// Transaction commits when fn returns nil and rolls back otherwise.
+// Side effects which can't be rolled back (e.g. sending mail) belong after it returns.
+func (t Transactor) Transaction(fn func(tx *sqlx.Tx) error) error {
+	tx, err := t.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func NewTransactor(db *sqlx.DB) *Transactor {
+	return &Transactor{db}
+}
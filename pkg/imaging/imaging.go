@@ -0,0 +1,99 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+)
+
+// CenterSquare returns the largest square at the center of bounds.
+func CenterSquare(bounds image.Rectangle) image.Rectangle {
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+
+	origin := image.Pt(bounds.Min.X+(bounds.Dx()-side)/2, bounds.Min.Y+(bounds.Dy()-side)/2)
+
+	return image.Rectangle{Min: origin, Max: origin.Add(image.Pt(side, side))}
+}
+
+// Resize scales the square area of src to size x size pixels, reading src in place rather than copying
+// the area first. Downscaling averages every source pixel covered by a destination pixel (box filter),
+// upscaling repeats the nearest source pixel.
+func Resize(src image.Image, area image.Rectangle, size int) *image.RGBA {
+	side := area.Dx()
+	at := pixelReader(src)
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+
+	for dy := 0; dy < size; dy++ {
+		sy0, sy1 := span(dy, side, size)
+
+		for dx := 0; dx < size; dx++ {
+			sx0, sx1 := span(dx, side, size)
+
+			var sum [4]uint64
+			for sy := area.Min.Y + sy0; sy < area.Min.Y+sy1; sy++ {
+				for sx := area.Min.X + sx0; sx < area.Min.X+sx1; sx++ {
+					r, g, b, a := at(sx, sy)
+					sum[0] += uint64(r)
+					sum[1] += uint64(g)
+					sum[2] += uint64(b)
+					sum[3] += uint64(a)
+				}
+			}
+
+			n := uint64((sy1 - sy0) * (sx1 - sx0))
+			p := dst.Pix[dy*dst.Stride+dx*4 : dy*dst.Stride+dx*4+4]
+			for i := range p {
+				p[i] = uint8((sum[i] + n/2) / n)
+			}
+		}
+	}
+
+	return dst
+}
+
+// pixelReader returns a function reading the 8-bit alpha-premultiplied components of a pixel of img.
+// The image types decoded from JPEG and PNG files are read directly, without going through color.Color.
+func pixelReader(img image.Image) func(x, y int) (r, g, b, a uint32) {
+	switch src := img.(type) {
+	case *image.YCbCr:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			yi, ci := src.YOffset(x, y), src.COffset(x, y)
+			r, g, b := color.YCbCrToRGB(src.Y[yi], src.Cb[ci], src.Cr[ci])
+			return uint32(r), uint32(g), uint32(b), 0xff
+		}
+	case *image.RGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			p := src.Pix[src.PixOffset(x, y):]
+			return uint32(p[0]), uint32(p[1]), uint32(p[2]), uint32(p[3])
+		}
+	case *image.NRGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			p := src.Pix[src.PixOffset(x, y):]
+			a := uint32(p[3])
+			return (uint32(p[0])*a + 127) / 255, (uint32(p[1])*a + 127) / 255, (uint32(p[2])*a + 127) / 255, a
+		}
+	case *image.Gray:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			v := uint32(src.Pix[src.PixOffset(x, y)])
+			return v, v, v, 0xff
+		}
+	default:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			r, g, b, a := img.At(x, y).RGBA()
+			return r >> 8, g >> 8, b >> 8, a >> 8
+		}
+	}
+}
+
+// span returns the source pixels [from, to) covered by destination pixel i.
+func span(i, side, size int) (int, int) {
+	from := i * side / size
+	to := (i + 1) * side / size
+	if to <= from {
+		to = from + 1
+	}
+
+	return from, to
+}
@@ -0,0 +1,160 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestCenterSquare(t *testing.T) {
+	cases := []struct {
+		name     string
+		bounds   image.Rectangle
+		expected image.Rectangle
+	}{
+		{"square", image.Rect(0, 0, 10, 10), image.Rect(0, 0, 10, 10)},
+		{"landscape", image.Rect(0, 0, 30, 10), image.Rect(10, 0, 20, 10)},
+		{"portrait", image.Rect(0, 0, 10, 30), image.Rect(0, 10, 10, 20)},
+		{"odd difference", image.Rect(0, 0, 11, 10), image.Rect(0, 0, 10, 10)},
+		{"offset origin", image.Rect(5, 5, 25, 15), image.Rect(10, 5, 20, 15)},
+		{"single pixel", image.Rect(0, 0, 1, 1), image.Rect(0, 0, 1, 1)},
+		{"single row", image.Rect(0, 0, 9, 1), image.Rect(4, 0, 5, 1)},
+	}
+
+	for _, c := range cases {
+		if got := CenterSquare(c.bounds); got != c.expected {
+			t.Errorf("%s: expected [%v] got [%v]", c.name, c.expected, got)
+		}
+	}
+}
+
+// quadrants returns a w x h image whose left half is red and right half is blue.
+func quadrants(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < w/2 {
+				img.Set(x, y, color.RGBA{R: 0xff, A: 0xff})
+			} else {
+				img.Set(x, y, color.RGBA{B: 0xff, A: 0xff})
+			}
+		}
+	}
+
+	return img
+}
+
+func TestResize(t *testing.T) {
+	red := color.RGBA{R: 0xff, A: 0xff}
+	blue := color.RGBA{B: 0xff, A: 0xff}
+	gray := color.RGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff}
+
+	onePixel := image.NewGray(image.Rect(0, 0, 1, 1))
+	onePixel.Pix[0] = 0x80
+
+	// The centered square of the 40x20 image covers its middle, half red and half blue.
+	wide := quadrants(40, 20)
+
+	cases := []struct {
+		name string
+		src  image.Image
+		area image.Rectangle
+		size int
+		// expected colors at the given destination pixels.
+		expected map[image.Point]color.RGBA
+	}{
+		{
+			name:     "downscale",
+			src:      quadrants(100, 100),
+			area:     image.Rect(0, 0, 100, 100),
+			size:     10,
+			expected: map[image.Point]color.RGBA{{0, 0}: red, {4, 9}: red, {5, 0}: blue, {9, 9}: blue},
+		},
+		{
+			name:     "non-square source",
+			src:      wide,
+			area:     CenterSquare(wide.Bounds()),
+			size:     2,
+			expected: map[image.Point]color.RGBA{{0, 0}: red, {0, 1}: red, {1, 0}: blue, {1, 1}: blue},
+		},
+		{
+			name:     "upscale",
+			src:      quadrants(2, 2),
+			area:     image.Rect(0, 0, 2, 2),
+			size:     8,
+			expected: map[image.Point]color.RGBA{{0, 0}: red, {3, 7}: red, {4, 0}: blue, {7, 7}: blue},
+		},
+		{
+			name:     "single pixel upscale",
+			src:      onePixel,
+			area:     onePixel.Bounds(),
+			size:     4,
+			expected: map[image.Point]color.RGBA{{0, 0}: gray, {3, 3}: gray},
+		},
+		{
+			name:     "single pixel",
+			src:      onePixel,
+			area:     onePixel.Bounds(),
+			size:     1,
+			expected: map[image.Point]color.RGBA{{0, 0}: gray},
+		},
+		{
+			name:     "averages to a single pixel",
+			src:      quadrants(2, 2),
+			area:     image.Rect(0, 0, 2, 2),
+			size:     1,
+			expected: map[image.Point]color.RGBA{{0, 0}: {R: 0x80, B: 0x80, A: 0xff}},
+		},
+	}
+
+	for _, c := range cases {
+		dst := Resize(c.src, c.area, c.size)
+
+		if dst.Bounds() != image.Rect(0, 0, c.size, c.size) {
+			t.Errorf("%s: expected %dx%d got %v", c.name, c.size, c.size, dst.Bounds())
+			continue
+		}
+
+		for p, expected := range c.expected {
+			if got := dst.RGBAAt(p.X, p.Y); got != expected {
+				t.Errorf("%s: pixel %v expected [%v] got [%v]", c.name, p, expected, got)
+			}
+		}
+	}
+}
+
+func TestResizeReadsEveryImageType(t *testing.T) {
+	rgba := quadrants(4, 4)
+
+	nrgba := image.NewNRGBA(rgba.Bounds())
+	ycbcr := image.NewYCbCr(rgba.Bounds(), image.YCbCrSubsampleRatio444)
+	paletted := image.NewPaletted(rgba.Bounds(), color.Palette{color.RGBA{R: 0xff, A: 0xff}, color.RGBA{B: 0xff, A: 0xff}})
+
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			c := rgba.RGBAAt(x, y)
+			nrgba.Set(x, y, c)
+			paletted.Set(x, y, c)
+
+			yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+			ycbcr.Y[ycbcr.YOffset(x, y)] = yy
+			ycbcr.Cb[ycbcr.COffset(x, y)] = cb
+			ycbcr.Cr[ycbcr.COffset(x, y)] = cr
+		}
+	}
+
+	expected := Resize(rgba, rgba.Bounds(), 2)
+
+	images := map[string]image.Image{"nrgba": nrgba, "ycbcr": ycbcr, "paletted": paletted}
+	for name, img := range images {
+		dst := Resize(img, img.Bounds(), 2)
+
+		for i := range dst.Pix {
+			// YCbCr conversion is lossy by a few levels.
+			if diff := int(dst.Pix[i]) - int(expected.Pix[i]); diff < -2 || diff > 2 {
+				t.Errorf("%s: expected [%v] got [%v]", name, expected.Pix, dst.Pix)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package jwk
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// MinRSABits is the smallest RSA modulus accepted for RS256 keys.
+const MinRSABits = 2048
+
+var (
+	ErrUnknownKid    = errors.New("token key id is unknown")
+	ErrAlgMismatch   = errors.New("token algorithm does not match its key")
+	ErrNoSigningKey  = errors.New("keyset has no signing key")
+	ErrUnsupportedPK = errors.New("unsupported private key type, expected Ed25519 or RSA")
+)
+
+type signingKey struct {
+	kid    string
+	method jwt.SigningMethod
+	key    crypto.PrivateKey
+}
+
+type verificationKey struct {
+	method jwt.SigningMethod
+	key    crypto.PublicKey
+}
+
+// Keyset signs tokens with its current key, and verifies tokens signed by any of its keys,
+// identified by the kid header. Rotating keys without invalidating issued tokens goes:
+// add the new key, make it the signing key once every instance knows it, and remove
+// the old key once the tokens it signed have expired.
+//
+// A keyset may also hold a legacy HMAC secret, which verifies (and, without a signing key,
+// signs) tokens without a kid header, so tokens issued before moving to asymmetric keys remain valid.
+type Keyset struct {
+	signing      *signingKey
+	verification map[string]verificationKey
+	secret       []byte
+}
+
+// NewHMACKeyset returns a keyset which signs and verifies tokens using an HS512 secret.
+func NewHMACKeyset(secret string) *Keyset {
+	return &Keyset{
+		verification: make(map[string]verificationKey),
+		secret:       []byte(secret),
+	}
+}
+
+// LoadKeyset reads the PEM encoded keys of dir, each file holds a single key and its name
+// (without the .pem extension) is the key id. Private keys are PKCS#8 Ed25519 (EdDSA) or
+// RSA (RS256) keys, public keys (PKIX) of retired keys only verify tokens.
+// signingKid selects the key new tokens are signed with, secret is the optional legacy HMAC secret.
+func LoadKeyset(dir string, signingKid string, secret string) (*Keyset, error) {
+	keyset := NewHMACKeyset(secret)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		kid := strings.TrimSuffix(filepath.Base(file), ".pem")
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = keyset.add(kid, data, kid == signingKid); err != nil {
+			return nil, fmt.Errorf("key [%s]: %w", kid, err)
+		}
+	}
+
+	if keyset.signing == nil {
+		return nil, fmt.Errorf("signing key [%s] was not found in [%s]", signingKid, dir)
+	}
+
+	return keyset, nil
+}
+
+// KeysetFromEnv loads the keyset configured by <prefix>_KEYS_DIR and <prefix>_SIGNING_KEY,
+// along with the legacy <prefix>_SECRET. Without a keys directory, tokens keep being signed
+// using the secret alone.
+func KeysetFromEnv(prefix string) (*Keyset, error) {
+	dir := os.Getenv(prefix + "_KEYS_DIR")
+	secret := os.Getenv(prefix + "_SECRET")
+
+	if dir == "" {
+		if secret == "" {
+			return nil, fmt.Errorf("neither %s_KEYS_DIR nor %s_SECRET are defined", prefix, prefix)
+		}
+
+		return NewHMACKeyset(secret), nil
+	}
+
+	return LoadKeyset(dir, os.Getenv(prefix+"_SIGNING_KEY"), secret)
+}
+
+func (k *Keyset) add(kid string, data []byte, signing bool) error {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New("no PEM block found")
+	}
+
+	var parsed interface{}
+	var err error
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		if signing {
+			return errors.New("a public key can't sign")
+		}
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return fmt.Errorf("unsupported PEM block [%s]", block.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	var method jwt.SigningMethod
+	var public crypto.PublicKey
+
+	switch key := parsed.(type) {
+	case ed25519.PrivateKey:
+		method, public = jwt.SigningMethodEdDSA, key.Public()
+	case ed25519.PublicKey:
+		method, public = jwt.SigningMethodEdDSA, key
+	case *rsa.PrivateKey:
+		method, public = jwt.SigningMethodRS256, key.Public()
+	case *rsa.PublicKey:
+		method, public = jwt.SigningMethodRS256, key
+	default:
+		return ErrUnsupportedPK
+	}
+
+	if rsaKey, ok := public.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < MinRSABits {
+		return fmt.Errorf("RSA keys must be at least %d bits", MinRSABits)
+	}
+
+	k.verification[kid] = verificationKey{method, public}
+
+	if signing {
+		k.signing = &signingKey{kid, method, parsed}
+	}
+
+	return nil
+}
+
+// Sign signs the claims with the signing key, setting the kid header,
+// or with the HMAC secret when the keyset has no signing key.
+func (k *Keyset) Sign(claims jwt.Claims) (string, error) {
+	return k.SignType("JWT", claims)
+}
+
+// SignType is Sign setting the typ header to typ.
+func (k *Keyset) SignType(typ string, claims jwt.Claims) (string, error) {
+	var token *jwt.Token
+	var key interface{}
+
+	switch {
+	case k.signing != nil:
+		token = jwt.NewWithClaims(k.signing.method, claims)
+		token.Header["kid"] = k.signing.kid
+		key = k.signing.key
+	case len(k.secret) != 0:
+		token = jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
+		key = k.secret
+	default:
+		return "", ErrNoSigningKey
+	}
+
+	token.Header["typ"] = typ
+
+	return token.SignedString(key)
+}
+
+// Keyfunc returns the key verifying the token. The algorithm is dictated by the key rather
+// than trusted from the token header, so a token can't pick a weaker algorithm.
+func (k *Keyset) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	if kid == "" {
+		if len(k.secret) == 0 || token.Method != jwt.SigningMethodHS512 {
+			return nil, ErrUnknownKid
+		}
+
+		return k.secret, nil
+	}
+
+	key, ok := k.verification[kid]
+	if !ok {
+		return nil, ErrUnknownKid
+	}
+
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, ErrAlgMismatch
+	}
+
+	return key.key, nil
+}
+
+// Set returns the public verification keys, the legacy secret is never published.
+func (k *Keyset) Set() Set {
+	kids := make([]string, 0, len(k.verification))
+	for kid := range k.verification {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	set := Set{Keys: make([]Key, 0)}
+	for _, kid := range kids {
+		key := k.verification[kid]
+
+		jwk, err := NewKey(kid, key.method.Alg(), key.key)
+		if err != nil {
+			continue
+		}
+
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return set
+}
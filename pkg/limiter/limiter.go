@@ -0,0 +1,99 @@
+package limiter
+
+import (
+	"math"
+	"time"
+)
+
+// Record holds the consecutive failures registered for a single key.
+type Record struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+// Store persists failure records.
+// Reserve atomically returns how long the key has to wait given delay, or registers an attempt when it
+// doesn't have to, starting to count from scratch when the previous failure is older than window.
+type Store interface {
+	Reserve(key string, window time.Duration, delay func(failures int) time.Duration) (Record, time.Duration, error)
+	Release(key string) error
+	Reset(key string) error
+}
+
+type Policy struct {
+	// FreeAttempts is the number of failures allowed before any delay is applied.
+	FreeAttempts int
+	// BaseDelay doubles with each failure past FreeAttempts, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockAfter failures the key is locked for LockFor.
+	LockAfter int
+	LockFor   time.Duration
+	// Window after which failures are forgotten.
+	Window time.Duration
+}
+
+var DefaultPolicy = Policy{
+	FreeAttempts: 3,
+	BaseDelay:    time.Second,
+	MaxDelay:     time.Minute * 5,
+	LockAfter:    10,
+	LockFor:      time.Minute * 30,
+	Window:       time.Hour * 24,
+}
+
+// Delay returns how long a key has to wait after its last failure.
+func (p Policy) Delay(failures int) time.Duration {
+	if failures >= p.LockAfter {
+		return p.LockFor
+	}
+
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+
+	delay := time.Duration(float64(p.BaseDelay) * math.Pow(2, float64(failures-p.FreeAttempts-1)))
+	if delay > p.MaxDelay || delay <= 0 {
+		return p.MaxDelay
+	}
+
+	return delay
+}
+
+// Limiter applies exponential backoff to keys (e.g. an email address or a client IP)
+// based on their consecutive failures.
+type Limiter struct {
+	store  Store
+	policy Policy
+}
+
+// Reserve registers an attempt up front, counting it as a failure until it is released or the key reset,
+// so concurrent attempts can't all slip through before any failure is recorded. When the key has to wait,
+// nothing is registered and the wait is returned instead, a zero duration means the attempt is allowed.
+func (l Limiter) Reserve(key string) (Record, time.Duration, error) {
+	return l.store.Reserve(key, l.policy.Window, l.policy.Delay)
+}
+
+// Release forgets a reserved attempt which succeeded, keeping any other failure of the key.
+func (l Limiter) Release(key string) error {
+	return l.store.Release(key)
+}
+
+// Reset forgets all failures of the key, usually after a successful attempt.
+func (l Limiter) Reset(key string) error {
+	return l.store.Reset(key)
+}
+
+// Locked reports whether the record has just reached the lock threshold.
+// The record is the one returned by Reserve for an attempt which then failed.
+func (l Limiter) Locked(record Record) bool {
+	return record.Failures == l.policy.LockAfter
+}
+
+func (l Limiter) Policy() Policy {
+	return l.policy
+}
+
+func New(store Store, policy Policy) *Limiter {
+	return &Limiter{store, policy}
+}
@@ -0,0 +1,167 @@
+package limiter
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{
+	FreeAttempts: 2,
+	BaseDelay:    time.Minute,
+	MaxDelay:     time.Hour,
+	LockAfter:    5,
+	LockFor:      time.Hour * 2,
+	Window:       time.Hour * 24,
+}
+
+func TestDelay(t *testing.T) {
+	cases := map[int]time.Duration{
+		0: 0,
+		1: 0,
+		2: 0,
+		3: time.Minute,
+		4: time.Minute * 2,
+		5: time.Hour * 2,
+		9: time.Hour * 2,
+	}
+
+	for failures, expected := range cases {
+		if got := testPolicy.Delay(failures); got != expected {
+			t.Errorf("%d failures: expected [%s] got [%s]", failures, expected, got)
+		}
+	}
+
+	capped := testPolicy
+	capped.LockAfter = 100
+	if got := capped.Delay(60); got != capped.MaxDelay {
+		t.Errorf("expected the delay to be capped at [%s] got [%s]", capped.MaxDelay, got)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	l := New(NewMemoryStore(), testPolicy)
+
+	// The free attempts are reserved right away, the next one has to wait.
+	for i := 1; i <= testPolicy.FreeAttempts+1; i++ {
+		record, wait, err := l.Reserve("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if wait != 0 || record.Failures != i {
+			t.Fatalf("attempt %d: expected no wait and %d failures, got [%s] and %d", i, i, wait, record.Failures)
+		}
+	}
+
+	record, wait, err := l.Reserve("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wait <= 0 || wait > testPolicy.BaseDelay {
+		t.Errorf("expected a wait of up to [%s] got [%s]", testPolicy.BaseDelay, wait)
+	}
+
+	if record.Failures != testPolicy.FreeAttempts+1 {
+		t.Errorf("a refused attempt must not be registered, got %d failures", record.Failures)
+	}
+
+	if _, wait, _ = l.Reserve("another-key"); wait != 0 {
+		t.Errorf("keys must be throttled independently, got [%s]", wait)
+	}
+}
+
+func TestReleaseAndReset(t *testing.T) {
+	l := New(NewMemoryStore(), testPolicy)
+
+	for i := 0; i < testPolicy.FreeAttempts; i++ {
+		if _, _, err := l.Reserve("key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Releasing a successful attempt keeps the other failures.
+	if err := l.Release("key"); err != nil {
+		t.Fatal(err)
+	}
+
+	record, _, _ := l.Reserve("key")
+	if record.Failures != testPolicy.FreeAttempts {
+		t.Errorf("expected %d failures after a release, got %d", testPolicy.FreeAttempts, record.Failures)
+	}
+
+	if err := l.Reset("key"); err != nil {
+		t.Fatal(err)
+	}
+
+	record, _, _ = l.Reserve("key")
+	if record.Failures != 1 {
+		t.Errorf("expected the failures to start over after a reset, got %d", record.Failures)
+	}
+}
+
+func TestReserveForgetsFailuresOutsideWindow(t *testing.T) {
+	store := NewMemoryStore()
+	store.records["key"] = Record{Failures: testPolicy.LockAfter, LastFailure: time.Now().Add(-testPolicy.Window - time.Minute)}
+
+	record, wait, err := New(store, testPolicy).Reserve("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wait != 0 || record.Failures != 1 {
+		t.Errorf("expected the old failures to be forgotten, got [%s] and %d failures", wait, record.Failures)
+	}
+}
+
+func TestLocked(t *testing.T) {
+	l := New(NewMemoryStore(), testPolicy)
+
+	for i := 1; i <= testPolicy.LockAfter; i++ {
+		l.store.(*MemoryStore).records["key"] = Record{Failures: i - 1, LastFailure: time.Now().Add(-time.Hour * 3)}
+
+		record, _, err := l.Reserve("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if locked := l.Locked(record); locked != (i == testPolicy.LockAfter) {
+			t.Errorf("attempt %d: expected locked to be %t", i, i == testPolicy.LockAfter)
+		}
+	}
+}
+
+// Concurrent attempts are reserved one at a time, so no more than the free attempts get through.
+func TestReserveConcurrently(t *testing.T) {
+	l := New(NewMemoryStore(), testPolicy)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, wait, err := l.Reserve("key")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if wait == 0 {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if allowed != testPolicy.FreeAttempts+1 {
+		t.Errorf("expected %d attempts to be allowed, got %d", testPolicy.FreeAttempts+1, allowed)
+	}
+}
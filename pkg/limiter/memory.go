@@ -0,0 +1,76 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryMaxRecords is the number of records after which stale records are swept.
+const MemoryMaxRecords = 10000
+
+// MemoryStore keeps failure records in process memory.
+// Records are lost on restart and aren't shared between server instances.
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+func (m *MemoryStore) Reserve(key string, window time.Duration, delay func(failures int) time.Duration) (Record, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.records) >= MemoryMaxRecords {
+		m.sweep(window)
+	}
+
+	record := m.records[key]
+	if time.Since(record.LastFailure) > window {
+		record.Failures = 0
+	}
+
+	if record.Failures > 0 {
+		if wait := delay(record.Failures) - time.Since(record.LastFailure); wait > 0 {
+			return record, wait, nil
+		}
+	}
+
+	record.Failures++
+	record.LastFailure = time.Now()
+	m.records[key] = record
+
+	return record, 0, nil
+}
+
+func (m *MemoryStore) Release(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if record, ok := m.records[key]; ok && record.Failures > 0 {
+		record.Failures--
+		m.records[key] = record
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) Reset(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.records, key)
+
+	return nil
+}
+
+// sweep removes records whose last failure is older than window.
+func (m *MemoryStore) sweep(window time.Duration) {
+	for key, record := range m.records {
+		if time.Since(record.LastFailure) > window {
+			delete(m.records, key)
+		}
+	}
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]Record)}
+}
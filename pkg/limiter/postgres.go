@@ -0,0 +1,90 @@
+package limiter
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type PostgresRecord struct {
+	Key         string    `db:"key"`
+	Failures    int       `db:"failures"`
+	LastFailure time.Time `db:"last_failure"`
+}
+
+// PostgresStore keeps failure records in the rate_limits table,
+// which makes them survive restarts and shared by all server instances.
+type PostgresStore struct {
+	db *sqlx.DB
+}
+
+// Reserve locks the record of the key for the duration of a transaction, so concurrent attempts
+// are checked one after the other. Elapsed times are computed by the database, whose clock is shared
+// by all server instances.
+func (p PostgresStore) Reserve(key string, window time.Duration, delay func(failures int) time.Duration) (Record, time.Duration, error) {
+	var record PostgresRecord
+	var elapsed float64
+
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return Record{}, 0, err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO rate_limits (key, failures, last_failure) VALUES ($1, 0, current_timestamp) ON CONFLICT (key) DO NOTHING`
+	if _, err = tx.Exec(query, key); err != nil {
+		return Record{}, 0, err
+	}
+
+	query = `
+	SELECT *, extract(epoch FROM current_timestamp - last_failure) AS elapsed
+	FROM rate_limits
+	WHERE key = $1
+	FOR UPDATE`
+
+	row := tx.QueryRowx(query, key)
+	if err = row.Scan(&record.Key, &record.Failures, &record.LastFailure, &elapsed); err != nil {
+		return Record{}, 0, err
+	}
+
+	since := time.Duration(elapsed * float64(time.Second))
+	failures := record.Failures
+	if since > window {
+		failures = 0
+	}
+
+	if failures > 0 {
+		if wait := delay(failures) - since; wait > 0 {
+			return Record{record.Failures, record.LastFailure}, wait, tx.Commit()
+		}
+	}
+
+	query = `UPDATE rate_limits SET failures = $2, last_failure = current_timestamp WHERE key = $1 RETURNING *`
+	if err = tx.Get(&record, query, key, failures+1); err != nil {
+		return Record{}, 0, err
+	}
+
+	return Record{record.Failures, record.LastFailure}, 0, tx.Commit()
+}
+
+func (p PostgresStore) Release(key string) error {
+	query := `UPDATE rate_limits SET failures = greatest(failures - 1, 0) WHERE key = $1`
+	if _, err := p.db.Exec(query, key); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p PostgresStore) Reset(key string) error {
+	query := `DELETE FROM rate_limits WHERE key = $1`
+	if _, err := p.db.Exec(query, key); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func NewPostgresStore(db *sqlx.DB) *PostgresStore {
+	return &PostgresStore{db}
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+)
+
+// DefaultMaxBodySize is plenty for any JSON request body.
+const DefaultMaxBodySize = 1024 * 1024 // 1MB
+
+type limitedBody struct {
+	io.ReadCloser
+	original io.ReadCloser
+}
+
+// MaxBodySize limits the size of request bodies, reading past n bytes fails.
+func MaxBodySize(n int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = &limitedBody{http.MaxBytesReader(w, r.Body, n), r.Body}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// SetMaxBodySize replaces the limit set by MaxBodySize, for handlers accepting larger bodies such as uploads.
+func SetMaxBodySize(w http.ResponseWriter, r *http.Request, n int64) {
+	body := r.Body
+	if limited, ok := body.(*limitedBody); ok {
+		body = limited.original
+	}
+
+	r.Body = http.MaxBytesReader(w, body, n)
+}
@@ -0,0 +1,51 @@
+package oidc
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+var DefaultScopes = []string{"openid", "email", "profile"}
+
+type Config struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// ConfigsFromEnv reads the providers listed (comma separated) in OIDC_PROVIDERS.
+// Each provider is configured by OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID,
+// OIDC_<NAME>_CLIENT_SECRET and OIDC_<NAME>_REDIRECT_URL. The issuer may point at any
+// OpenID Connect compliant server, including a local stand-in identity provider.
+func ConfigsFromEnv() ([]Config, error) {
+	configs := make([]Config, 0)
+
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		config := Config{
+			Name:         name,
+			Issuer:       strings.TrimSuffix(os.Getenv(prefix+"ISSUER"), "/"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			Scopes:       DefaultScopes,
+		}
+
+		if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+			return nil, fmt.Errorf("incomplete configuration for oidc provider [%s]", name)
+		}
+
+		configs = append(configs, config)
+	}
+
+	return configs, nil
+}
@@ -0,0 +1,256 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"atraf-server/pkg/jwk"
+)
+
+const (
+	// KeysRefreshInterval limits how often the provider keys are fetched again
+	// when an ID token is signed by an unknown key.
+	KeysRefreshInterval = time.Minute
+	HTTPTimeout         = time.Second * 10
+)
+
+var (
+	ErrInvalidIDToken = errors.New("id token is invalid")
+	ErrNonceMismatch  = errors.New("id token nonce mismatch")
+	ErrStateMismatch  = errors.New("oauth state mismatch")
+)
+
+// Metadata is the subset of the provider discovery document in use.
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Bool accepts both JSON booleans and the "true"/"false" strings some providers send.
+type Bool bool
+
+func (b *Bool) UnmarshalJSON(data []byte) error {
+	*b = Bool(strings.Trim(string(data), `"`) == "true")
+	return nil
+}
+
+type IDTokenClaims struct {
+	jwt.RegisteredClaims
+	Email         string `json:"email"`
+	EmailVerified Bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	Nonce         string `json:"nonce"`
+}
+
+// Provider is an OpenID Connect provider using the authorization code flow with PKCE.
+// The discovery document is fetched lazily, so an unreachable provider doesn't prevent startup.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu            sync.Mutex
+	metadata      *Metadata
+	keys          jwk.Set
+	keysFetchedAt time.Time
+}
+
+func (p *Provider) Name() string {
+	return p.config.Name
+}
+
+// AuthCodeURL returns the provider URL the user agent is redirected to in order to authenticate.
+func (p *Provider) AuthCodeURL(state string, nonce string, codeVerifier string) (string, error) {
+	metadata, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientID)
+	query.Set("redirect_uri", p.config.RedirectURL)
+	query.Set("scope", strings.Join(p.config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", CodeChallenge(codeVerifier))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return metadata.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange redeems the authorization code and returns the verified ID token claims.
+func (p *Provider) Exchange(code string, codeVerifier string, nonce string) (IDTokenClaims, error) {
+	metadata, err := p.discover()
+	if err != nil {
+		return IDTokenClaims{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("client_id", p.config.ClientID)
+	form.Set("code_verifier", codeVerifier)
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+
+	response, err := p.client.PostForm(metadata.TokenEndpoint, form)
+	if err != nil {
+		return IDTokenClaims{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return IDTokenClaims{}, fmt.Errorf("token endpoint responded with [%d]", response.StatusCode)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&tokens); err != nil {
+		return IDTokenClaims{}, err
+	}
+
+	claims, err := p.verify(tokens.IDToken, metadata)
+	if err != nil {
+		return IDTokenClaims{}, err
+	}
+
+	if claims.Nonce != nonce {
+		return IDTokenClaims{}, ErrNonceMismatch
+	}
+
+	return claims, nil
+}
+
+func (p *Provider) verify(idToken string, metadata *Metadata) (IDTokenClaims, error) {
+	parser := jwt.Parser{ValidMethods: []string{"RS256", "ES256", "EdDSA"}}
+
+	token, err := parser.ParseWithClaims(idToken, &IDTokenClaims{}, p.keyFunc)
+	if err != nil {
+		return IDTokenClaims{}, err
+	}
+
+	claims, ok := token.Claims.(*IDTokenClaims)
+	if !ok || !token.Valid {
+		return IDTokenClaims{}, ErrInvalidIDToken
+	}
+
+	if claims.Issuer != metadata.Issuer || !claims.VerifyAudience(p.config.ClientID, true) || claims.Subject == "" {
+		return IDTokenClaims{}, ErrInvalidIDToken
+	}
+
+	return *claims, nil
+}
+
+func (p *Provider) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.keys.Find(kid)
+	if !ok && time.Since(p.keysFetchedAt) > KeysRefreshInterval {
+		if err := p.fetchKeys(); err != nil {
+			return nil, err
+		}
+		key, ok = p.keys.Find(kid)
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key [%s]", kid)
+	}
+
+	return key.PublicKey()
+}
+
+// fetchKeys must be called while holding p.mu.
+func (p *Provider) fetchKeys() error {
+	var keys jwk.Set
+
+	if err := p.getJSON(p.metadata.JWKSURI, &keys); err != nil {
+		return err
+	}
+
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+
+	return nil
+}
+
+func (p *Provider) discover() (*Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	var metadata Metadata
+	if err := p.getJSON(p.config.Issuer+"/.well-known/openid-configuration", &metadata); err != nil {
+		return nil, err
+	}
+
+	if metadata.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("issuer mismatch, expected [%s] got [%s]", p.config.Issuer, metadata.Issuer)
+	}
+
+	p.metadata = &metadata
+
+	return p.metadata, nil
+}
+
+func (p *Provider) getJSON(url string, dest interface{}) error {
+	response, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("[%s] responded with [%d]", url, response.StatusCode)
+	}
+
+	return json.NewDecoder(response.Body).Decode(dest)
+}
+
+// VerifyState checks the state returned to the redirect URL against the state the authorization request was made with.
+func VerifyState(expected string, actual string) error {
+	if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) != 1 {
+		return ErrStateMismatch
+	}
+
+	return nil
+}
+
+// CodeChallenge derives the S256 PKCE code challenge from the code verifier.
+func CodeChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func NewProvider(config Config) *Provider {
+	return &Provider{
+		config: config,
+		client: &http.Client{Timeout: HTTPTimeout},
+	}
+}
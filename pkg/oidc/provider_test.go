@@ -0,0 +1,363 @@
+package oidc
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"atraf-server/pkg/jwk"
+)
+
+const (
+	testClientID = "atraf"
+	testCode     = "authorization-code"
+	testVerifier = "code-verifier-of-at-least-forty-three-characters"
+	testNonce    = "nonce"
+)
+
+// testProvider is an httptest identity provider. The token endpoint returns the ID token
+// built by idToken, once the code and the PKCE code verifier are checked.
+type testProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	kid    string
+	key    ed25519.PrivateKey
+
+	mu        sync.Mutex
+	challenge string
+	idToken   func(claims *IDTokenClaims) string
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tp := &testProvider{t: t, kid: "key-1", key: private}
+	tp.idToken = tp.sign
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(Metadata{
+			Issuer:                tp.server.URL,
+			AuthorizationEndpoint: tp.server.URL + "/authorize",
+			TokenEndpoint:         tp.server.URL + "/token",
+			JWKSURI:               tp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		key, err := jwk.NewKey(tp.kid, "EdDSA", public)
+		if err != nil {
+			t.Error(err)
+		}
+		_ = json.NewEncoder(w).Encode(jwk.Set{Keys: []jwk.Key{key}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		tp.mu.Lock()
+		defer tp.mu.Unlock()
+
+		if r.PostFormValue("code") != testCode || CodeChallenge(r.PostFormValue("code_verifier")) != tp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": tp.idToken(tp.claims())})
+	})
+
+	tp.server = httptest.NewServer(mux)
+	t.Cleanup(tp.server.Close)
+
+	return tp
+}
+
+func (tp *testProvider) claims() *IDTokenClaims {
+	return &IDTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tp.server.URL,
+			Subject:   "subject",
+			Audience:  jwt.ClaimStrings{testClientID},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+		Email:         "user@example.com",
+		EmailVerified: true,
+		Nonce:         testNonce,
+	}
+}
+
+func (tp *testProvider) sign(claims *IDTokenClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = tp.kid
+
+	signed, err := token.SignedString(tp.key)
+	if err != nil {
+		tp.t.Fatal(err)
+	}
+
+	return signed
+}
+
+// authorize makes the authorization request the way a user agent would, the provider keeps
+// the code challenge to check the code verifier against.
+func (tp *testProvider) authorize(p *Provider, state string) url.Values {
+	authURL, err := p.AuthCodeURL(state, testNonce, testVerifier)
+	if err != nil {
+		tp.t.Fatal(err)
+	}
+
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		tp.t.Fatal(err)
+	}
+
+	query := parsed.Query()
+
+	tp.mu.Lock()
+	tp.challenge = query.Get("code_challenge")
+	tp.mu.Unlock()
+
+	return query
+}
+
+func (tp *testProvider) provider() *Provider {
+	return NewProvider(Config{
+		Name:        "test",
+		Issuer:      tp.server.URL,
+		ClientID:    testClientID,
+		RedirectURL: "https://atraf.app/callback",
+		Scopes:      DefaultScopes,
+	})
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	tp := newTestProvider(t)
+	query := tp.authorize(tp.provider(), "state")
+
+	expected := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"state":                 "state",
+		"nonce":                 testNonce,
+		"code_challenge":        CodeChallenge(testVerifier),
+		"code_challenge_method": "S256",
+	}
+
+	for name, value := range expected {
+		if query.Get(name) != value {
+			t.Errorf("%s: expected [%s] got [%s]", name, value, query.Get(name))
+		}
+	}
+
+	if query.Get("code_challenge") == testVerifier {
+		t.Error("the code verifier must not be sent in the authorization request")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	tp := newTestProvider(t)
+	p := tp.provider()
+	tp.authorize(p, "state")
+
+	claims, err := p.Exchange(testCode, testVerifier, testNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Subject != "subject" || claims.Email != "user@example.com" || !claims.EmailVerified {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+}
+
+func TestExchangeWrongCodeVerifier(t *testing.T) {
+	tp := newTestProvider(t)
+	p := tp.provider()
+	tp.authorize(p, "state")
+
+	if _, err := p.Exchange(testCode, "another-code-verifier", testNonce); err == nil {
+		t.Fatal("expected the exchange to fail")
+	}
+}
+
+func TestExchangeRejectsInvalidIDTokens(t *testing.T) {
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		idToken func(tp *testProvider, claims *IDTokenClaims) string
+		nonce   string
+		err     error
+	}{
+		{
+			name: "signed by another key",
+			idToken: func(tp *testProvider, claims *IDTokenClaims) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+				token.Header["kid"] = tp.kid
+				signed, _ := token.SignedString(otherKey)
+				return signed
+			},
+		},
+		{
+			name: "unknown key id",
+			idToken: func(tp *testProvider, claims *IDTokenClaims) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+				token.Header["kid"] = "key-2"
+				signed, _ := token.SignedString(tp.key)
+				return signed
+			},
+		},
+		{
+			name: "tampered payload",
+			idToken: func(tp *testProvider, claims *IDTokenClaims) string {
+				signed := tp.sign(claims)
+				claims.Subject = "another-subject"
+				tampered := tp.sign(claims)
+				return tampered[:strings.LastIndex(tampered, ".")] + signed[strings.LastIndex(signed, "."):]
+			},
+		},
+		{
+			name: "hmac signed",
+			idToken: func(tp *testProvider, claims *IDTokenClaims) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+				token.Header["kid"] = tp.kid
+				signed, _ := token.SignedString([]byte("secret"))
+				return signed
+			},
+		},
+		{
+			name: "unsigned",
+			idToken: func(tp *testProvider, claims *IDTokenClaims) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+				signed, _ := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+				return signed
+			},
+		},
+		{
+			name: "wrong issuer",
+			idToken: func(tp *testProvider, claims *IDTokenClaims) string {
+				claims.Issuer = "https://attacker.example.com"
+				return tp.sign(claims)
+			},
+			err: ErrInvalidIDToken,
+		},
+		{
+			name: "wrong audience",
+			idToken: func(tp *testProvider, claims *IDTokenClaims) string {
+				claims.Audience = jwt.ClaimStrings{"another-client"}
+				return tp.sign(claims)
+			},
+			err: ErrInvalidIDToken,
+		},
+		{
+			name: "missing subject",
+			idToken: func(tp *testProvider, claims *IDTokenClaims) string {
+				claims.Subject = ""
+				return tp.sign(claims)
+			},
+			err: ErrInvalidIDToken,
+		},
+		{
+			name: "expired",
+			idToken: func(tp *testProvider, claims *IDTokenClaims) string {
+				claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+				return tp.sign(claims)
+			},
+		},
+		{
+			name: "wrong nonce",
+			idToken: func(tp *testProvider, claims *IDTokenClaims) string {
+				return tp.sign(claims)
+			},
+			nonce: "another-nonce",
+			err:   ErrNonceMismatch,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tp := newTestProvider(t)
+			tp.idToken = func(claims *IDTokenClaims) string {
+				return c.idToken(tp, claims)
+			}
+
+			p := tp.provider()
+			tp.authorize(p, "state")
+
+			nonce := testNonce
+			if c.nonce != "" {
+				nonce = c.nonce
+			}
+
+			_, err := p.Exchange(testCode, testVerifier, nonce)
+			if err == nil {
+				t.Fatal("expected the id token to be rejected")
+			}
+
+			if c.err != nil && !errors.Is(err, c.err) {
+				t.Errorf("expected [%v] got [%v]", c.err, err)
+			}
+		})
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	tp := newTestProvider(t)
+
+	p := NewProvider(Config{Name: "test", Issuer: tp.server.URL + "/other", ClientID: testClientID})
+	if _, err := p.AuthCodeURL("state", testNonce, testVerifier); err == nil {
+		t.Fatal("expected the discovery document of another issuer to be rejected")
+	}
+}
+
+func TestEmailVerified(t *testing.T) {
+	cases := map[string]bool{
+		`{"email_verified": true}`:    true,
+		`{"email_verified": "true"}`:  true,
+		`{"email_verified": false}`:   false,
+		`{"email_verified": "false"}`: false,
+		`{"email_verified": null}`:    false,
+		`{}`:                          false,
+	}
+
+	for payload, expected := range cases {
+		var claims IDTokenClaims
+		if err := json.Unmarshal([]byte(payload), &claims); err != nil {
+			t.Fatal(err)
+		}
+
+		if bool(claims.EmailVerified) != expected {
+			t.Errorf("%s: expected [%t] got [%t]", payload, expected, claims.EmailVerified)
+		}
+	}
+}
+
+func TestVerifyState(t *testing.T) {
+	if err := VerifyState("state", "state"); err != nil {
+		t.Errorf("expected matching states to be accepted, got [%v]", err)
+	}
+
+	cases := []struct{ expected, actual string }{
+		{"state", "other"},
+		{"state", ""},
+		{"", ""},
+	}
+
+	for _, c := range cases {
+		if err := VerifyState(c.expected, c.actual); !errors.Is(err, ErrStateMismatch) {
+			t.Errorf("expected [%s] and [%s] to mismatch, got [%v]", c.expected, c.actual, err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RangePrefixLength is the length of the SHA-1 hash prefix range files are named after.
+const RangePrefixLength = 5
+
+// BreachedList reports whether a password is known to have been exposed in a data breach.
+type BreachedList interface {
+	Contains(password string) (bool, error)
+}
+
+// RangeDirectory is a locally stored copy of a k-anonymity breached password list,
+// such as the one published by Have I Been Pwned. The directory holds one file per
+// 5 character SHA-1 hash prefix, each listing the "SUFFIX:COUNT" lines of that range.
+// Only the range of the password hash is ever read.
+type RangeDirectory struct {
+	dir string
+}
+
+func (d RangeDirectory) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:RangePrefixLength], hash[RangePrefixLength:]
+
+	file, err := os.Open(filepath.Join(d.dir, prefix))
+	if os.IsNotExist(err) {
+		// A missing range means no breached password hashes to it.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, ':'); i != -1 {
+			line = line[:i]
+		}
+
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+func NewRangeDirectory(dir string) (*RangeDirectory, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	return &RangeDirectory{dir}, nil
+}
@@ -0,0 +1,188 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Algorithms supported by Hasher, identified by the prefix of the hashes they produce.
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+var (
+	ErrMismatch         = errors.New("password does not match the hash")
+	ErrUnknownHash      = errors.New("password hash format is not recognized")
+	ErrUnknownAlgorithm = errors.New("password hash algorithm is not supported")
+)
+
+type Argon2Params struct {
+	// Memory is in KiB.
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// Hasher hashes passwords using the configured algorithm and parameters,
+// and verifies hashes produced by any supported algorithm or parameters.
+type Hasher struct {
+	Algorithm  string
+	Argon2     Argon2Params
+	BcryptCost int
+}
+
+// DefaultHasher follows the OWASP recommended Argon2id parameters.
+var DefaultHasher = Hasher{
+	Algorithm: Argon2id,
+	Argon2: Argon2Params{
+		Memory:      19 * 1024,
+		Iterations:  2,
+		Parallelism: 1,
+		SaltLength:  16,
+		KeyLength:   32,
+	},
+	BcryptCost: bcrypt.DefaultCost,
+}
+
+// Hash returns the encoded hash, which embeds the algorithm, its version and parameters,
+// e.g. $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key> (PHC string format) or a bcrypt hash.
+func (h Hasher) Hash(password string) ([]byte, error) {
+	switch h.Algorithm {
+	case Argon2id:
+		salt := make([]byte, h.Argon2.SaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+
+		return encodeArgon2(h.Argon2, salt, argon2Key(password, salt, h.Argon2)), nil
+	case Bcrypt:
+		return bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+	default:
+		return nil, ErrUnknownAlgorithm
+	}
+}
+
+// Compare returns ErrMismatch when the password doesn't match the encoded hash.
+func (h Hasher) Compare(hash []byte, password string) error {
+	if len(hash) == 0 {
+		// Accounts created by an external identity provider have no usable password.
+		return ErrMismatch
+	}
+
+	switch algorithm(hash) {
+	case Argon2id:
+		params, salt, key, err := decodeArgon2(hash)
+		if err != nil {
+			return err
+		}
+
+		if subtle.ConstantTimeCompare(key, argon2Key(password, salt, params)) != 1 {
+			return ErrMismatch
+		}
+
+		return nil
+	case Bcrypt:
+		err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrMismatch
+		}
+
+		return err
+	default:
+		return ErrUnknownHash
+	}
+}
+
+// NeedsRehash reports whether the hash was produced by another algorithm or with other parameters
+// than the configured ones, in which case it should be replaced once the password is known.
+func (h Hasher) NeedsRehash(hash []byte) bool {
+	if algorithm(hash) != h.Algorithm {
+		return true
+	}
+
+	switch h.Algorithm {
+	case Argon2id:
+		params, salt, key, err := decodeArgon2(hash)
+		if err != nil {
+			return true
+		}
+
+		return params.Memory != h.Argon2.Memory ||
+			params.Iterations != h.Argon2.Iterations ||
+			params.Parallelism != h.Argon2.Parallelism ||
+			uint32(len(salt)) != h.Argon2.SaltLength ||
+			uint32(len(key)) != h.Argon2.KeyLength
+	case Bcrypt:
+		cost, err := bcrypt.Cost(hash)
+		return err != nil || cost != h.BcryptCost
+	default:
+		return true
+	}
+}
+
+func algorithm(hash []byte) string {
+	switch {
+	case strings.HasPrefix(string(hash), "$"+Argon2id+"$"):
+		return Argon2id
+	case strings.HasPrefix(string(hash), "$2a$"), strings.HasPrefix(string(hash), "$2b$"), strings.HasPrefix(string(hash), "$2y$"):
+		return Bcrypt
+	default:
+		return ""
+	}
+}
+
+func argon2Key(password string, salt []byte, p Argon2Params) []byte {
+	return argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+}
+
+func encodeArgon2(p Argon2Params, salt []byte, key []byte) []byte {
+	return []byte(fmt.Sprintf(
+		"$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		Argon2id,
+		argon2.Version,
+		p.Memory,
+		p.Iterations,
+		p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	))
+}
+
+func decodeArgon2(hash []byte) (params Argon2Params, salt []byte, key []byte, err error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
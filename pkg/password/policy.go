@@ -0,0 +1,103 @@
+package password
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Violations reported by Policy.Check.
+const (
+	TooShort          = "too_short"
+	TooLong           = "too_long"
+	TooWeak           = "too_weak"
+	ContainsUserInput = "contains_user_input"
+	Breached          = "breached"
+)
+
+// MinUserInputLength keeps short emails or nicknames from rejecting most passwords.
+const MinUserInputLength = 3
+
+type Policy struct {
+	MinLength int
+	// MaxLength guards against bcrypt silently truncating passwords past 72 bytes.
+	MaxLength int
+	// MinScore is the minimum Strength score, from 0 (too guessable) to 4 (very unguessable).
+	MinScore int
+	// Breached is optional, passwords found in it are rejected.
+	Breached BreachedList
+}
+
+var DefaultPolicy = Policy{
+	MinLength: 8,
+	MaxLength: 72,
+	MinScore:  2,
+}
+
+// PolicyError lists every rule a password violates.
+type PolicyError struct {
+	Violations []string
+}
+
+func (e *PolicyError) Error() string {
+	return "password violates policy: " + strings.Join(e.Violations, ", ")
+}
+
+// Check returns a *PolicyError when the password violates the policy.
+// userInputs are values the password must not contain, such as the account email and nickname.
+func (p Policy) Check(password string, userInputs ...string) error {
+	// Strength and the breached list aren't worth running on passwords which can't be accepted anyway,
+	// and Strength gets costly on very long input.
+	if len(password) > p.MaxLength {
+		return &PolicyError{[]string{TooLong}}
+	}
+
+	violations := make([]string, 0)
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, TooShort)
+	}
+
+	if Strength(password) < p.MinScore {
+		violations = append(violations, TooWeak)
+	}
+
+	if containsUserInput(password, userInputs) {
+		violations = append(violations, ContainsUserInput)
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return err
+		}
+
+		if breached {
+			violations = append(violations, Breached)
+		}
+	}
+
+	if len(violations) != 0 {
+		return &PolicyError{violations}
+	}
+
+	return nil
+}
+
+func containsUserInput(password string, userInputs []string) bool {
+	password = strings.ToLower(password)
+
+	for _, input := range userInputs {
+		input = strings.ToLower(input)
+
+		// Only the local part of an email is meaningful, the domain is shared by many.
+		if at := strings.LastIndex(input, "@"); at != -1 {
+			input = input[:at]
+		}
+
+		if utf8.RuneCountInString(input) >= MinUserInputLength && strings.Contains(password, input) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,274 @@
+package password
+
+import (
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MinMatchLength is the shortest run of characters matched as a pattern rather than guessed one by one.
+	MinMatchLength = 3
+	// MaxMatchLength is the longest run matched as a single pattern, longer runs are split in several.
+	// It bounds the cost of Guesses to O(n * MaxMatchLength).
+	MaxMatchLength = 40
+	// MaxStrengthLength is the number of characters Guesses looks at, characters past it are brute forced.
+	MaxStrengthLength = 256
+)
+
+// Score thresholds, in guesses, following zxcvbn.
+var scoreThresholds = []float64{1e3, 1e6, 1e8, 1e10}
+
+// commonPasswords are ranked by popularity, the rank is the number of guesses an attacker needs.
+var commonPasswords = []string{
+	"password", "123456", "qwerty", "abc123", "letmein", "monkey", "dragon", "111111", "baseball", "iloveyou",
+	"trustno1", "sunshine", "master", "welcome", "shadow", "ashley", "football", "jesus", "michael", "ninja",
+	"mustang", "admin", "login", "princess", "solo", "starwars", "passw0rd", "whatever", "freedom", "hello",
+	"charlie", "donald", "superman", "batman", "secret", "summer", "winter", "spring", "autumn", "flower",
+	"hunter", "soccer", "hockey", "killer", "george", "jordan", "harley", "ranger", "buster", "thomas",
+	"tigger", "robert", "access", "love", "pepper", "daniel", "joshua", "maggie", "cheese", "computer",
+	"internet", "service", "matrix", "silver", "orange", "purple", "yellow", "banana", "chocolate", "cookie",
+	"qazwsx", "zaq1zaq1", "google", "apple", "samsung", "pokemon", "naruto", "liverpool", "chelsea", "arsenal",
+	"london", "paris", "berlin", "america", "canada", "india", "china", "israel", "atraf", "default",
+	"changeme", "test", "guest", "root", "user", "pass", "lovely", "angel", "baby", "family",
+}
+
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+	"qwertzuiop",
+	"azertyuiop",
+	"1qaz2wsx3edc4rfv5tgb6yhn7ujm8ik9ol0p",
+}
+
+var leet = map[rune]rune{
+	'4': 'a', '@': 'a', '8': 'b', '3': 'e', '6': 'g', '1': 'i', '!': 'i',
+	'0': 'o', '5': 's', '$': 's', '7': 't', '+': 't', '2': 'z',
+}
+
+// commonPasswordRanks maps each of commonPasswords to its rank.
+var commonPasswordRanks = make(map[string]int)
+
+var reversedKeyboardRows = make([]string, 0)
+
+func init() {
+	for rank, common := range commonPasswords {
+		commonPasswordRanks[common] = rank + 1
+	}
+
+	for _, row := range keyboardRows {
+		reversedKeyboardRows = append(reversedKeyboardRows, reverse(row))
+	}
+}
+
+// normalized holds the lowercased and un-leeted forms of a password, computed once
+// so matching a run of characters slices them rather than allocating.
+type normalized struct {
+	runes []rune
+	// lower and unleet are indexed by the byte offsets in offsets, offsets[i] being where rune i starts.
+	lower   string
+	unleet  string
+	offsets []int
+	// uppers[i] counts the characters of runes[:i] lowercasing changes.
+	uppers []int
+}
+
+func normalize(runes []rune) normalized {
+	var lower, unleet strings.Builder
+
+	n := normalized{
+		runes:   runes,
+		offsets: make([]int, len(runes)+1),
+		uppers:  make([]int, len(runes)+1),
+	}
+
+	for i, r := range runes {
+		n.offsets[i] = lower.Len()
+		n.uppers[i+1] = n.uppers[i]
+
+		l := unicode.ToLower(r)
+		if l != r {
+			n.uppers[i+1]++
+		}
+
+		// Both forms must keep the same byte offsets, only single byte characters are substituted.
+		u := l
+		if s, ok := leet[l]; ok {
+			u = s
+		}
+		if utf8.RuneLen(u) != utf8.RuneLen(l) {
+			u = l
+		}
+
+		lower.WriteRune(l)
+		unleet.WriteRune(u)
+	}
+	n.offsets[len(runes)] = lower.Len()
+
+	n.lower = lower.String()
+	n.unleet = unleet.String()
+
+	return n
+}
+
+// Strength estimates how guessable the password is, zxcvbn style, by splitting it into
+// the cheapest sequence of known patterns (common passwords, keyboard walks, sequences,
+// repeats and years) and brute forced characters. The score ranges from 0 to 4.
+func Strength(password string) int {
+	guesses := Guesses(password)
+
+	for score, threshold := range scoreThresholds {
+		if guesses < threshold {
+			return score
+		}
+	}
+
+	return len(scoreThresholds)
+}
+
+// Guesses estimates the number of guesses needed to crack the password.
+func Guesses(password string) float64 {
+	runes := []rune(password)
+
+	rest := 0.0
+	if len(runes) > MaxStrengthLength {
+		for _, r := range runes[MaxStrengthLength:] {
+			rest += math.Log10(bruteforceCardinality(r))
+		}
+		runes = runes[:MaxStrengthLength]
+	}
+
+	n := len(runes)
+	norm := normalize(runes)
+
+	// best[i] holds the log10 guesses of the cheapest way to produce runes[:i].
+	best := make([]float64, n+1)
+	for i := 1; i <= n; i++ {
+		best[i] = best[i-1] + math.Log10(bruteforceCardinality(runes[i-1]))
+
+		from := i - MaxMatchLength
+		if from < 0 {
+			from = 0
+		}
+
+		for j := from; j <= i-MinMatchLength; j++ {
+			if guesses := norm.matchGuesses(j, i); guesses > 0 {
+				best[i] = math.Min(best[i], best[j]+math.Log10(guesses))
+			}
+		}
+	}
+
+	return math.Pow(10, best[n]+rest)
+}
+
+// matchGuesses returns the guesses needed for the run of characters [i, j) when it matches a pattern, 0 otherwise.
+func (n normalized) matchGuesses(i, j int) float64 {
+	runes := n.runes[i:j]
+	lower := n.lower[n.offsets[i]:n.offsets[j]]
+
+	// Capitalization only adds a handful of guesses.
+	variations := 1.0
+	if n.uppers[j] != n.uppers[i] {
+		variations = 2
+	}
+
+	if rank, ok := commonPasswordRanks[lower]; ok {
+		return float64(rank) * variations
+	}
+	if rank, ok := commonPasswordRanks[n.unleet[n.offsets[i]:n.offsets[j]]]; ok {
+		return float64(rank) * variations * 2
+	}
+
+	if isRepeat(runes) {
+		return bruteforceCardinality(runes[0]) * float64(len(runes))
+	}
+
+	if isSequence(runes) {
+		return 26 * float64(len(runes)) * variations
+	}
+
+	if isKeyboardWalk(lower) {
+		return 100 * float64(len(runes)) * variations
+	}
+
+	if isYear(lower) {
+		return 120
+	}
+
+	return 0
+}
+
+func isRepeat(runes []rune) bool {
+	for _, r := range runes[1:] {
+		if r != runes[0] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isSequence matches runs with a constant step of 1 or -1, such as "abc", "987" or "xyz".
+func isSequence(runes []rune) bool {
+	step := runes[1] - runes[0]
+	if step != 1 && step != -1 {
+		return false
+	}
+
+	for i := 2; i < len(runes); i++ {
+		if runes[i]-runes[i-1] != step {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isKeyboardWalk(token string) bool {
+	for i, row := range keyboardRows {
+		if strings.Contains(row, token) || strings.Contains(reversedKeyboardRows[i], token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isYear(token string) bool {
+	if len(token) != 4 || (!strings.HasPrefix(token, "19") && !strings.HasPrefix(token, "20")) {
+		return false
+	}
+
+	for _, r := range token {
+		if !unicode.IsDigit(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func bruteforceCardinality(r rune) float64 {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		return 26
+	case r >= '0' && r <= '9':
+		return 10
+	case r < unicode.MaxASCII:
+		return 33
+	default:
+		return 100
+	}
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+
+	return string(runes)
+}
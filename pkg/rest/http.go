@@ -2,14 +2,27 @@ package rest
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Response struct {
 	Data interface{} `json:"data"`
 }
 
+// ErrorResponse is the body of error responses which tell the client why the request failed.
+type ErrorResponse struct {
+	Reason string `json:"reason,omitempty"`
+	// Fields maps request fields to the rules they violate.
+	Fields map[string][]string `json:"fields,omitempty"`
+}
+
 func SetHeaders(w http.ResponseWriter) {
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 }
@@ -47,3 +60,128 @@ func Error(w http.ResponseWriter, err error, code int) {
 
 	w.WriteHeader(code)
 }
+
+// Forbidden responds with 403 and a machine-readable reason.
+func Forbidden(w http.ResponseWriter, err error, reason string) {
+	ErrorWithBody(w, err, http.StatusForbidden, &ErrorResponse{Reason: reason})
+}
+
+// InvalidFields responds with 422 and the rules each request field violates.
+func InvalidFields(w http.ResponseWriter, err error, fields map[string][]string) {
+	ErrorWithBody(w, err, http.StatusUnprocessableEntity, &ErrorResponse{Fields: fields})
+}
+
+// ErrorWithBody is Error for responses which tell the client why the request failed.
+func ErrorWithBody(w http.ResponseWriter, err error, code int, body *ErrorResponse) {
+	SetHeaders(w)
+
+	log.SetFlags(log.Lshortfile)
+	log.Println(err)
+
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		w.WriteHeader(code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	_, _ = w.Write(encoded)
+}
+
+// TooManyRequests responds with 429 and tells the client when it may retry.
+func TooManyRequests(w http.ResponseWriter, err error, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	Error(w, err, http.StatusTooManyRequests)
+}
+
+// TrustedProxies are the load balancers allowed to report the client address in X-Forwarded-For,
+// see ParseTrustedProxies. The header is ignored when the list is empty.
+var TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a comma separated list of IP addresses and CIDR ranges.
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	proxies := make([]*net.IPNet, 0)
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy [%s]", entry)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy [%s]: %w", entry, err)
+		}
+		proxies = append(proxies, network)
+	}
+
+	return proxies, nil
+}
+
+// ClientIP returns the address of the originating client. X-Forwarded-For is only read when the request
+// comes from a trusted proxy, the client is then the right-most hop which isn't a trusted proxy,
+// as every entry left of it may have been made up by the client.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+
+		if net.ParseIP(hop) == nil {
+			// A malformed hop can't be attributed, the last trusted address is all there is.
+			return host
+		}
+
+		if !isTrustedProxy(hop) {
+			return hop
+		}
+
+		host = hop
+	}
+
+	return host
+}
+
+func isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,55 @@
+package token
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"atraf-server/pkg/uid"
+)
+
+const (
+	ChallengeTokenValidFor = time.Minute * 5
+)
+
+// ChallengeTokenCustomClaims identify an account which passed the first authentication factor.
+type ChallengeTokenCustomClaims struct {
+	AccountId uid.UID `json:"account_id"`
+}
+
+type ChallengeTokenClaims struct {
+	jwt.StandardClaims
+	ChallengeTokenCustomClaims
+}
+
+// NewChallengeToken issues a challenge identified by tokenId,
+// which the caller is responsible for recording and consuming.
+func NewChallengeToken(tokenId uid.UID, claims ChallengeTokenCustomClaims) (string, error) {
+	return Keys.Sign(ChallengeTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        tokenId.String(),
+			Audience:  ChallengeTokenAudience,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(ChallengeTokenValidFor).Unix(),
+		},
+		ChallengeTokenCustomClaims: claims,
+	})
+}
+
+func VerifyChallengeToken(unverifiedToken string) (ChallengeTokenClaims, error) {
+	token, err := jwt.ParseWithClaims(unverifiedToken, &ChallengeTokenClaims{}, Keys.Keyfunc)
+	if err != nil {
+		return ChallengeTokenClaims{}, err
+	}
+
+	claims, ok := token.Claims.(*ChallengeTokenClaims)
+	if !ok || !token.Valid {
+		return ChallengeTokenClaims{}, err
+	}
+
+	if !claims.VerifyAudience(ChallengeTokenAudience, true) {
+		return ChallengeTokenClaims{}, ErrInvalidAudience
+	}
+
+	return *claims, nil
+}
@@ -0,0 +1,54 @@
+package token
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"atraf-server/pkg/uid"
+)
+
+const (
+	DeletionTokenValidFor = time.Minute * 15
+)
+
+type DeletionCustomClaims struct {
+	AccountId uid.UID `json:"account_id"`
+}
+
+type DeletionTokenClaims struct {
+	jwt.StandardClaims
+	DeletionCustomClaims
+}
+
+// NewDeletionToken issues an account deletion token identified by tokenId,
+// which the caller is responsible for recording and consuming.
+func NewDeletionToken(tokenId uid.UID, claims DeletionCustomClaims) (string, error) {
+	return Keys.Sign(DeletionTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        tokenId.String(),
+			Audience:  DeletionTokenAudience,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(DeletionTokenValidFor).Unix(),
+		},
+		DeletionCustomClaims: claims,
+	})
+}
+
+func VerifyDeletionToken(unverifiedToken string) (DeletionTokenClaims, error) {
+	token, err := jwt.ParseWithClaims(unverifiedToken, &DeletionTokenClaims{}, Keys.Keyfunc)
+	if err != nil {
+		return DeletionTokenClaims{}, err
+	}
+
+	claims, ok := token.Claims.(*DeletionTokenClaims)
+	if !ok || !token.Valid {
+		return DeletionTokenClaims{}, err
+	}
+
+	if !claims.VerifyAudience(DeletionTokenAudience, true) {
+		return DeletionTokenClaims{}, ErrInvalidAudience
+	}
+
+	return *claims, nil
+}
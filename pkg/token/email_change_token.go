@@ -0,0 +1,55 @@
+package token
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"atraf-server/pkg/uid"
+)
+
+const (
+	EmailChangeTokenValidFor = time.Hour
+)
+
+type EmailChangeCustomClaims struct {
+	AccountId uid.UID `json:"account_id"`
+	NewEmail  string  `json:"new_email"`
+}
+
+type EmailChangeTokenClaims struct {
+	jwt.StandardClaims
+	EmailChangeCustomClaims
+}
+
+// NewEmailChangeToken issues an email change token identified by tokenId,
+// which the caller is responsible for recording and consuming.
+func NewEmailChangeToken(tokenId uid.UID, claims EmailChangeCustomClaims) (string, error) {
+	return Keys.Sign(EmailChangeTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        tokenId.String(),
+			Audience:  EmailChangeTokenAudience,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(EmailChangeTokenValidFor).Unix(),
+		},
+		EmailChangeCustomClaims: claims,
+	})
+}
+
+func VerifyEmailChangeToken(unverifiedToken string) (EmailChangeTokenClaims, error) {
+	token, err := jwt.ParseWithClaims(unverifiedToken, &EmailChangeTokenClaims{}, Keys.Keyfunc)
+	if err != nil {
+		return EmailChangeTokenClaims{}, err
+	}
+
+	claims, ok := token.Claims.(*EmailChangeTokenClaims)
+	if !ok || !token.Valid {
+		return EmailChangeTokenClaims{}, err
+	}
+
+	if !claims.VerifyAudience(EmailChangeTokenAudience, true) {
+		return EmailChangeTokenClaims{}, ErrInvalidAudience
+	}
+
+	return *claims, nil
+}
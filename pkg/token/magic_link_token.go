@@ -0,0 +1,54 @@
+package token
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"atraf-server/pkg/uid"
+)
+
+const (
+	MagicLinkTokenValidFor = time.Minute * 15
+)
+
+type MagicLinkCustomClaims struct {
+	AccountId uid.UID `json:"account_id"`
+}
+
+type MagicLinkTokenClaims struct {
+	jwt.StandardClaims
+	MagicLinkCustomClaims
+}
+
+// NewMagicLinkToken issues a sign-in token identified by tokenId,
+// which the caller is responsible for recording and consuming.
+func NewMagicLinkToken(tokenId uid.UID, claims MagicLinkCustomClaims) (string, error) {
+	return Keys.Sign(MagicLinkTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        tokenId.String(),
+			Audience:  MagicLinkTokenAudience,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(MagicLinkTokenValidFor).Unix(),
+		},
+		MagicLinkCustomClaims: claims,
+	})
+}
+
+func VerifyMagicLinkToken(unverifiedToken string) (MagicLinkTokenClaims, error) {
+	token, err := jwt.ParseWithClaims(unverifiedToken, &MagicLinkTokenClaims{}, Keys.Keyfunc)
+	if err != nil {
+		return MagicLinkTokenClaims{}, err
+	}
+
+	claims, ok := token.Claims.(*MagicLinkTokenClaims)
+	if !ok || !token.Valid {
+		return MagicLinkTokenClaims{}, err
+	}
+
+	if !claims.VerifyAudience(MagicLinkTokenAudience, true) {
+		return MagicLinkTokenClaims{}, ErrInvalidAudience
+	}
+
+	return *claims, nil
+}
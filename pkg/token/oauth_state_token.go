@@ -0,0 +1,54 @@
+package token
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	OAuthStateTokenValidFor = time.Minute * 10
+)
+
+// OAuthStateCustomClaims hold the values generated when an OAuth flow starts,
+// which have to be checked against the values returned by the provider.
+type OAuthStateCustomClaims struct {
+	Provider     string `json:"provider"`
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+}
+
+type OAuthStateTokenClaims struct {
+	jwt.StandardClaims
+	OAuthStateCustomClaims
+}
+
+func NewOAuthStateToken(claims OAuthStateCustomClaims) (string, error) {
+	return Keys.Sign(OAuthStateTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Audience:  OAuthStateTokenAudience,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(OAuthStateTokenValidFor).Unix(),
+		},
+		OAuthStateCustomClaims: claims,
+	})
+}
+
+func VerifyOAuthStateToken(unverifiedToken string) (OAuthStateTokenClaims, error) {
+	token, err := jwt.ParseWithClaims(unverifiedToken, &OAuthStateTokenClaims{}, Keys.Keyfunc)
+	if err != nil {
+		return OAuthStateTokenClaims{}, err
+	}
+
+	claims, ok := token.Claims.(*OAuthStateTokenClaims)
+	if !ok || !token.Valid {
+		return OAuthStateTokenClaims{}, err
+	}
+
+	if !claims.VerifyAudience(OAuthStateTokenAudience, true) {
+		return OAuthStateTokenClaims{}, ErrInvalidAudience
+	}
+
+	return *claims, nil
+}
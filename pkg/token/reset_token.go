@@ -16,7 +16,8 @@ const (
 var ResetTokenSecret = os.Getenv("RESET_TOKEN_SECRET")
 
 type ResetTokensCustomClaims struct {
-	AccountId uid.UID `json:"account_id"`
+	AccountId           uid.UID `json:"account_id"`
+	PasswordFingerprint string  `json:"password_fingerprint"`
 }
 
 type ResetTokenClaims struct {
@@ -24,20 +25,22 @@ type ResetTokenClaims struct {
 	ResetTokensCustomClaims
 }
 
-func NewResetToken(claims ResetTokensCustomClaims) (string, error) {
-	unsignedToken := jwt.NewWithClaims(jwt.SigningMethodHS512, ResetTokenClaims{
+// NewResetToken issues a reset token identified by tokenId,
+// which the caller is responsible for recording and consuming.
+func NewResetToken(tokenId uid.UID, claims ResetTokensCustomClaims) (string, error) {
+	return Keys.Sign(ResetTokenClaims{
 		StandardClaims: jwt.StandardClaims{
+			Id:        tokenId.String(),
+			Audience:  ResetTokenAudience,
 			IssuedAt:  time.Now().Unix(),
 			ExpiresAt: time.Now().Add(ResetTokenValidFor).Unix(),
 		},
 		ResetTokensCustomClaims: claims,
 	})
-
-	return unsignedToken.SignedString([]byte(ResetTokenSecret))
 }
 
 func VerifyResetToken(unverifiedToken string) (ResetTokenClaims, error) {
-	token, err := jwt.ParseWithClaims(unverifiedToken, &ResetTokenClaims{}, signingSecret(ResetTokenSecret))
+	token, err := jwt.ParseWithClaims(unverifiedToken, &ResetTokenClaims{}, Keys.Keyfunc)
 	if err != nil {
 		return ResetTokenClaims{}, err
 	}
@@ -47,5 +50,9 @@ func VerifyResetToken(unverifiedToken string) (ResetTokenClaims, error) {
 		return ResetTokenClaims{}, err
 	}
 
+	if !claims.VerifyAudience(ResetTokenAudience, true) {
+		return ResetTokenClaims{}, ErrInvalidAudience
+	}
+
 	return *claims, nil
 }
@@ -1,11 +1,82 @@
 package token
 
 import (
-	"github.com/golang-jwt/jwt/v4"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+
+	"atraf-server/pkg/jwk"
+)
+
+// Tokens of different kinds are signed using the same keys,
+// their audience prevents a token from being accepted as another kind.
+const (
+	ResetTokenAudience       = "reset"
+	ChallengeTokenAudience   = "challenge"
+	EmailChangeTokenAudience = "email_change"
+	OAuthStateTokenAudience  = "oauth_state"
+	MagicLinkTokenAudience   = "magic_link"
+	DeletionTokenAudience    = "deletion"
 )
 
-func signingSecret(secret string) jwt.Keyfunc {
-	return func(token *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
+var ErrInvalidAudience = errors.New("token audience is invalid")
+
+// Keys signs and verifies every token kind of the package, see jwk.KeysetFromEnv.
+// It defaults to signing using ResetTokenSecret alone.
+var Keys = jwk.NewHMACKeyset(ResetTokenSecret)
+
+// FingerprintSecrets key the fingerprints, the first secret computes new fingerprints
+// and every secret verifies them. Rotating the secret goes: prepend the new secret, and remove
+// the old one once the tokens embedding its fingerprints have expired.
+// It defaults to ResetTokenSecret alone, see FingerprintSecretsFromEnv.
+var FingerprintSecrets = []string{ResetTokenSecret}
+
+// FingerprintSecretsFromEnv reads the comma separated FINGERPRINT_SECRETS,
+// falling back to the legacy RESET_TOKEN_SECRET.
+func FingerprintSecretsFromEnv() ([]string, error) {
+	secrets := make([]string, 0)
+	for _, secret := range strings.Split(os.Getenv("FINGERPRINT_SECRETS"), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+
+	if len(secrets) == 0 && ResetTokenSecret != "" {
+		secrets = append(secrets, ResetTokenSecret)
+	}
+
+	if len(secrets) == 0 {
+		return nil, errors.New("neither FINGERPRINT_SECRETS nor RESET_TOKEN_SECRET are defined")
 	}
+
+	return secrets, nil
+}
+
+// Fingerprint returns a keyed digest of b.
+// Embedding the fingerprint of mutable account data (e.g. the password hash) in a token
+// invalidates the token once the data changes, without revealing the data itself.
+func Fingerprint(b []byte) string {
+	return fingerprint(FingerprintSecrets[0], b)
+}
+
+// VerifyFingerprint reports whether fp is the fingerprint of b under any of the FingerprintSecrets.
+func VerifyFingerprint(b []byte, fp string) bool {
+	for _, secret := range FingerprintSecrets {
+		if subtle.ConstantTimeCompare([]byte(fingerprint(secret, b)), []byte(fp)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func fingerprint(secret string, b []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(b)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
 }
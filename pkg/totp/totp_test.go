@@ -0,0 +1,69 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the RFC 6238 test secret "12345678901234567890", base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestCode uses the RFC 6238 SHA1 test vectors, truncated to Digits.
+func TestCode(t *testing.T) {
+	cases := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for unix, expected := range cases {
+		code, err := Code(rfcSecret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code != expected {
+			t.Errorf("%d: expected [%s] got [%s]", unix, expected, code)
+		}
+	}
+}
+
+func TestValidateStep(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := now.Unix() / Period
+
+	cases := []struct {
+		name  string
+		at    time.Time
+		valid bool
+		step  int64
+	}{
+		{"current period", now, true, step},
+		{"previous period", now.Add(-Period * time.Second), true, step - 1},
+		{"next period", now.Add(Period * time.Second), true, step + 1},
+		{"outside the skew", now.Add(-Period * (Skew + 1) * time.Second), false, 0},
+	}
+
+	for _, c := range cases {
+		code, err := Code(rfcSecret, c.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		matched, ok := ValidateStep(rfcSecret, code, now)
+		if ok != c.valid || matched != c.step {
+			t.Errorf("%s: expected %t at step %d got %t at step %d", c.name, c.valid, c.step, ok, matched)
+		}
+	}
+
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := ValidateStep(rfcSecret, code, now); ok {
+			t.Errorf("expected [%s] to be rejected", code)
+		}
+	}
+
+	if _, ok := ValidateStep("not base32!", "287082", now); ok {
+		t.Error("expected an invalid secret to be rejected")
+	}
+}
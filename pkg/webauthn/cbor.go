@@ -0,0 +1,164 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// MaxNesting bounds the depth of nested arrays and maps, authenticator data never goes deeper than a few levels.
+const MaxNesting = 16
+
+var ErrMalformedCBOR = errors.New("malformed cbor")
+
+// decodeCBOR decodes the first CBOR (RFC 8949) data item of b and returns it along with the
+// remaining bytes. Only the subset used by WebAuthn is supported: unsigned and negative integers,
+// byte and text strings, arrays, maps, booleans and null, all with definite lengths.
+//
+// Integers are returned as int64, byte strings as []byte, text strings as string, arrays as
+// []interface{} and maps as map[interface{}]interface{} keyed by int64 or string.
+func decodeCBOR(b []byte) (interface{}, []byte, error) {
+	return decodeItem(b, 0)
+}
+
+func decodeItem(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > MaxNesting {
+		return nil, nil, ErrMalformedCBOR
+	}
+
+	if len(b) == 0 {
+		return nil, nil, ErrMalformedCBOR
+	}
+
+	major := b[0] >> 5
+	info := b[0] & 0x1f
+
+	// Simple values and floats don't carry a length.
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, b[1:], nil
+		case 21:
+			return true, b[1:], nil
+		case 22, 23:
+			return nil, b[1:], nil
+		default:
+			return nil, nil, ErrMalformedCBOR
+		}
+	}
+
+	arg, b, err := decodeArgument(info, b[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, ErrMalformedCBOR
+		}
+
+		return int64(arg), b, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, ErrMalformedCBOR
+		}
+
+		return -1 - int64(arg), b, nil
+	case 2, 3:
+		if arg > uint64(len(b)) {
+			return nil, nil, ErrMalformedCBOR
+		}
+
+		value := make([]byte, arg)
+		copy(value, b[:arg])
+
+		if major == 3 {
+			return string(value), b[arg:], nil
+		}
+
+		return value, b[arg:], nil
+	case 4:
+		// Every item takes at least a byte, which bounds the allocation by the input size.
+		if arg > uint64(len(b)) {
+			return nil, nil, ErrMalformedCBOR
+		}
+
+		items := make([]interface{}, arg)
+		for i := range items {
+			if items[i], b, err = decodeItem(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		return items, b, nil
+	case 5:
+		if arg > uint64(len(b))/2 {
+			return nil, nil, ErrMalformedCBOR
+		}
+
+		items := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+
+			if key, b, err = decodeItem(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, ErrMalformedCBOR
+			}
+
+			if _, ok := items[key]; ok {
+				return nil, nil, ErrMalformedCBOR
+			}
+
+			if value, b, err = decodeItem(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+
+			items[key] = value
+		}
+
+		return items, b, nil
+	default:
+		// Tags (major type 6) aren't used by WebAuthn.
+		return nil, nil, ErrMalformedCBOR
+	}
+}
+
+// decodeArgument reads the length or value following the initial byte.
+// Indefinite lengths (info 31) aren't allowed in the CTAP2 canonical encoding.
+func decodeArgument(info byte, b []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), b, nil
+	case info == 24 && len(b) >= 1:
+		return uint64(b[0]), b[1:], nil
+	case info == 25 && len(b) >= 2:
+		return uint64(binary.BigEndian.Uint16(b)), b[2:], nil
+	case info == 26 && len(b) >= 4:
+		return uint64(binary.BigEndian.Uint32(b)), b[4:], nil
+	case info == 27 && len(b) >= 8:
+		return binary.BigEndian.Uint64(b), b[8:], nil
+	default:
+		return 0, nil, ErrMalformedCBOR
+	}
+}
+
+// cborMap decodes b, which must hold exactly one CBOR map.
+func cborMap(b []byte) (map[interface{}]interface{}, error) {
+	item, rest, err := decodeCBOR(b)
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := item.(map[interface{}]interface{})
+	if !ok || len(rest) != 0 {
+		return nil, ErrMalformedCBOR
+	}
+
+	return m, nil
+}
@@ -0,0 +1,160 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// cborPair is a map entry, maps are encoded as ordered pairs so the encoding is deterministic.
+type cborPair struct {
+	key   interface{}
+	value interface{}
+}
+
+type cborPairs []cborPair
+
+// encodeCBOR encodes the subset of CBOR decodeCBOR supports, for building test inputs.
+func encodeCBOR(v interface{}) []byte {
+	var b bytes.Buffer
+
+	switch value := v.(type) {
+	case int:
+		if value < 0 {
+			b.Write(cborHead(1, uint64(-1-value)))
+		} else {
+			b.Write(cborHead(0, uint64(value)))
+		}
+	case []byte:
+		b.Write(cborHead(2, uint64(len(value))))
+		b.Write(value)
+	case string:
+		b.Write(cborHead(3, uint64(len(value))))
+		b.WriteString(value)
+	case []interface{}:
+		b.Write(cborHead(4, uint64(len(value))))
+		for _, item := range value {
+			b.Write(encodeCBOR(item))
+		}
+	case cborPairs:
+		b.Write(cborHead(5, uint64(len(value))))
+		for _, pair := range value {
+			b.Write(encodeCBOR(pair.key))
+			b.Write(encodeCBOR(pair.value))
+		}
+	case bool:
+		if value {
+			b.WriteByte(0xf5)
+		} else {
+			b.WriteByte(0xf4)
+		}
+	case nil:
+		b.WriteByte(0xf6)
+	default:
+		panic(fmt.Sprintf("unsupported cbor value %T", v))
+	}
+
+	return b.Bytes()
+}
+
+func cborHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= 0xffff:
+		head := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(head[1:], uint16(arg))
+		return head
+	case arg <= 0xffffffff:
+		head := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(head[1:], uint32(arg))
+		return head
+	default:
+		head := []byte{major<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(head[1:], arg)
+		return head
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	encoded := encodeCBOR(cborPairs{
+		{1, 2},
+		{-7, -300},
+		{"bytes", []byte{1, 2, 3}},
+		{"text", "value"},
+		{"array", []interface{}{1, "two", true, false, nil}},
+		{"nested", cborPairs{{"key", 1 << 40}}},
+	})
+
+	m, err := cborMap(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m[int64(1)] != int64(2) || m[int64(-7)] != int64(-300) || m["text"] != "value" {
+		t.Errorf("unexpected integers or text %v", m)
+	}
+
+	if !bytes.Equal(m["bytes"].([]byte), []byte{1, 2, 3}) {
+		t.Errorf("unexpected bytes %v", m["bytes"])
+	}
+
+	array := m["array"].([]interface{})
+	if len(array) != 5 || array[1] != "two" || array[2] != true || array[3] != false || array[4] != nil {
+		t.Errorf("unexpected array %v", array)
+	}
+
+	if m["nested"].(map[interface{}]interface{})["key"] != int64(1<<40) {
+		t.Errorf("unexpected nested map %v", m["nested"])
+	}
+}
+
+func TestDecodeCBORMalformed(t *testing.T) {
+	deep := bytes.Repeat([]byte{0x81}, MaxNesting+2)
+	deep = append(deep, 0x01)
+
+	cases := map[string][]byte{
+		"empty":                   {},
+		"truncated argument":      {0x19, 0x01},
+		"byte string overflow":    {0x45, 0x01, 0x02},
+		"text string overflow":    {0x7a, 0xff, 0xff, 0xff, 0xff, 0x61},
+		"huge array":              {0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"huge map":                {0xbb, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"truncated array":         {0x82, 0x01},
+		"truncated map":           {0xa1, 0x01},
+		"indefinite length":       {0x5f, 0x41, 0x01, 0xff},
+		"reserved additional":     {0x1c},
+		"tag":                     {0xc0, 0x01},
+		"float":                   {0xf9, 0x3c, 0x00},
+		"integer overflow":        {0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"negative overflow":       {0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"nested too deep":         deep,
+		"byte string map key":     {0xa1, 0x41, 0x01, 0x01},
+		"duplicate map key":       {0xa2, 0x01, 0x01, 0x01, 0x02},
+		"map key without a value": {0xa1, 0x01},
+	}
+
+	for name, input := range cases {
+		if _, _, err := decodeCBOR(input); !errors.Is(err, ErrMalformedCBOR) {
+			t.Errorf("%s: expected [%v] got [%v]", name, ErrMalformedCBOR, err)
+		}
+	}
+}
+
+func TestCBORMapRejectsOtherItems(t *testing.T) {
+	cases := map[string][]byte{
+		"array":          encodeCBOR([]interface{}{1}),
+		"integer":        encodeCBOR(1),
+		"trailing bytes": append(encodeCBOR(cborPairs{{1, 1}}), 0x00),
+	}
+
+	for name, input := range cases {
+		if _, err := cborMap(input); !errors.Is(err, ErrMalformedCBOR) {
+			t.Errorf("%s: expected [%v] got [%v]", name, ErrMalformedCBOR, err)
+		}
+	}
+}
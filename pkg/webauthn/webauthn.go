@@ -0,0 +1,487 @@
+// Package webauthn implements the relying party side of the WebAuthn (FIDO2) registration
+// and authentication ceremonies, https://www.w3.org/TR/webauthn-2/.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	ChallengeSize = 32
+	Timeout       = time.Minute * 5
+
+	CredentialType = "public-key"
+
+	ClientDataCreate = "webauthn.create"
+	ClientDataGet    = "webauthn.get"
+)
+
+// User verification requirements.
+const (
+	VerificationRequired  = "required"
+	VerificationPreferred = "preferred"
+)
+
+// Authenticator data flags.
+const (
+	FlagUserPresent    = 0x01
+	FlagUserVerified   = 0x04
+	FlagBackupEligible = 0x08
+	FlagBackedUp       = 0x10
+	FlagAttestedData   = 0x40
+	FlagExtensionData  = 0x80
+)
+
+var (
+	ErrClientDataInvalid      = errors.New("client data is invalid")
+	ErrChallengeMismatch      = errors.New("challenge does not match")
+	ErrOriginMismatch         = errors.New("origin is not allowed")
+	ErrRPIDMismatch           = errors.New("relying party id does not match")
+	ErrUserNotPresent         = errors.New("user presence was not asserted")
+	ErrUserNotVerified        = errors.New("user verification is required")
+	ErrAuthenticatorData      = errors.New("authenticator data is malformed")
+	ErrUnsupportedAttestation = errors.New("attestation format is not supported")
+	// ErrCredentialCloned is returned when the signature counter didn't increase, which means
+	// the private key was likely copied to another authenticator.
+	ErrCredentialCloned = errors.New("credential signature counter went backwards, it may have been cloned")
+)
+
+// Config identifies the relying party.
+type Config struct {
+	// RPID is the domain credentials are scoped to, e.g. "atraf.app".
+	RPID   string
+	RPName string
+	// Origins are the origins ceremonies may be performed from, e.g. "https://atraf.app".
+	Origins []string
+}
+
+// ConfigFromEnv reads the relying party from WEBAUTHN_RP_ID, WEBAUTHN_RP_NAME and WEBAUTHN_ORIGINS
+// (comma separated). Both the id and the origin are derived from CLIENT_URL when unset.
+func ConfigFromEnv() (Config, error) {
+	config := Config{
+		RPID:   os.Getenv("WEBAUTHN_RP_ID"),
+		RPName: os.Getenv("WEBAUTHN_RP_NAME"),
+	}
+
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			config.Origins = append(config.Origins, origin)
+		}
+	}
+
+	clientURL, err := url.Parse(os.Getenv("CLIENT_URL"))
+	if err != nil {
+		return config, err
+	}
+
+	if config.RPID == "" {
+		config.RPID = clientURL.Hostname()
+	}
+
+	if len(config.Origins) == 0 {
+		config.Origins = []string{clientURL.Scheme + "://" + clientURL.Host}
+	}
+
+	if config.RPName == "" {
+		config.RPName = "Atraf"
+	}
+
+	if config.RPID == "" {
+		return config, errors.New("webauthn relying party id is not configured")
+	}
+
+	return config, nil
+}
+
+// Base64 is binary data encoded as unpadded base64url in JSON, as WebAuthn clients expect.
+type Base64 []byte
+
+func (b Base64) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Base64) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+
+	*b = decoded
+	return nil
+}
+
+// NewChallenge returns a random challenge, which must only ever be used for a single ceremony.
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, ChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+
+	return challenge, nil
+}
+
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// User is the account a credential is created for. The ID is the user handle
+// returned by discoverable credentials, it must not contain personal information.
+type User struct {
+	ID          Base64 `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type Parameter struct {
+	Type      string `json:"type"`
+	Algorithm int64  `json:"alg"`
+}
+
+type Descriptor struct {
+	Type       string   `json:"type"`
+	ID         Base64   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions are passed to navigator.credentials.create() as the publicKey member.
+type CreationOptions struct {
+	Challenge              Base64                 `json:"challenge"`
+	RelyingParty           RelyingParty           `json:"rp"`
+	User                   User                   `json:"user"`
+	Parameters             []Parameter            `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []Descriptor           `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are passed to navigator.credentials.get() as the publicKey member.
+type RequestOptions struct {
+	Challenge        Base64       `json:"challenge"`
+	Timeout          int64        `json:"timeout"`
+	RPID             string       `json:"rpId"`
+	AllowCredentials []Descriptor `json:"allowCredentials"`
+	UserVerification string       `json:"userVerification"`
+}
+
+// AttestationResponse is the PublicKeyCredential returned by navigator.credentials.create().
+type AttestationResponse struct {
+	RawID    Base64 `json:"rawId" validate:"required"`
+	Type     string `json:"type" validate:"required,eq=public-key"`
+	Response struct {
+		ClientDataJSON    Base64   `json:"clientDataJSON" validate:"required"`
+		AttestationObject Base64   `json:"attestationObject" validate:"required"`
+		Transports        []string `json:"transports"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the PublicKeyCredential returned by navigator.credentials.get().
+type AssertionResponse struct {
+	RawID    Base64 `json:"rawId" validate:"required"`
+	Type     string `json:"type" validate:"required,eq=public-key"`
+	Response struct {
+		ClientDataJSON    Base64 `json:"clientDataJSON" validate:"required"`
+		AuthenticatorData Base64 `json:"authenticatorData" validate:"required"`
+		Signature         Base64 `json:"signature" validate:"required"`
+		UserHandle        Base64 `json:"userHandle"`
+	} `json:"response"`
+}
+
+// Credential is a verified newly created credential.
+type Credential struct {
+	ID []byte
+	// PublicKey is COSE encoded, see ParsePublicKey.
+	PublicKey      []byte
+	Algorithm      int64
+	SignCount      uint32
+	AAGUID         []byte
+	Transports     []string
+	BackupEligible bool
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge Base64 `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+	// Set along with FlagAttestedData only.
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// CreationOptions returns the options of a registration ceremony, exclude lists the credentials
+// the user already registered so the same authenticator isn't registered twice.
+func (c Config) CreationOptions(challenge []byte, user User, exclude []Descriptor) CreationOptions {
+	parameters := make([]Parameter, 0)
+	for _, alg := range SupportedAlgorithms {
+		parameters = append(parameters, Parameter{CredentialType, alg})
+	}
+
+	return CreationOptions{
+		Challenge:          challenge,
+		RelyingParty:       RelyingParty{c.RPID, c.RPName},
+		User:               user,
+		Parameters:         parameters,
+		Timeout:            Timeout.Milliseconds(),
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: VerificationPreferred,
+		},
+		// Attestation statements aren't verified, authenticators aren't restricted by model.
+		Attestation: "none",
+	}
+}
+
+// RequestOptions returns the options of an authentication ceremony. An empty allow list
+// lets the user pick any discoverable credential, for logging in without a username.
+func (c Config) RequestOptions(challenge []byte, allow []Descriptor, userVerification string) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		Timeout:          Timeout.Milliseconds(),
+		RPID:             c.RPID,
+		AllowCredentials: allow,
+		UserVerification: userVerification,
+	}
+}
+
+// VerifyRegistration verifies the response to a registration ceremony and returns the new credential.
+// Only the "none" attestation format and "packed" self attestation are accepted.
+func (c Config) VerifyRegistration(challenge []byte, r AttestationResponse, requireVerification bool) (Credential, error) {
+	if err := c.verifyClientData(r.Response.ClientDataJSON, ClientDataCreate, challenge); err != nil {
+		return Credential{}, err
+	}
+
+	attestation, err := cborMap(r.Response.AttestationObject)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	format, _ := attestation["fmt"].(string)
+	statement, _ := attestation["attStmt"].(map[interface{}]interface{})
+	rawAuthData, _ := attestation["authData"].([]byte)
+	if statement == nil || rawAuthData == nil {
+		return Credential{}, ErrAuthenticatorData
+	}
+
+	authData, err := c.verifyAuthenticatorData(rawAuthData, requireVerification)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	if authData.Flags&FlagAttestedData == 0 {
+		return Credential{}, ErrAuthenticatorData
+	}
+
+	publicKey, err := ParsePublicKey(authData.PublicKey)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	switch format {
+	case "none":
+		if len(statement) != 0 {
+			return Credential{}, ErrUnsupportedAttestation
+		}
+	case "packed":
+		if err = verifySelfAttestation(statement, publicKey, rawAuthData, r.Response.ClientDataJSON); err != nil {
+			return Credential{}, err
+		}
+	default:
+		return Credential{}, ErrUnsupportedAttestation
+	}
+
+	return Credential{
+		ID:             authData.CredentialID,
+		PublicKey:      authData.PublicKey,
+		Algorithm:      publicKey.Algorithm,
+		SignCount:      authData.SignCount,
+		AAGUID:         authData.AAGUID,
+		Transports:     r.Response.Transports,
+		BackupEligible: authData.Flags&FlagBackupEligible != 0,
+	}, nil
+}
+
+// VerifyAssertion verifies the response to an authentication ceremony, signed by the credential
+// with the given COSE public key, and returns the new signature counter.
+// ErrCredentialCloned is returned when the counter didn't increase although the signature is valid.
+func (c Config) VerifyAssertion(challenge []byte, r AssertionResponse, publicKey []byte, signCount uint32, requireVerification bool) (uint32, error) {
+	if err := c.verifyClientData(r.Response.ClientDataJSON, ClientDataGet, challenge); err != nil {
+		return 0, err
+	}
+
+	authData, err := c.verifyAuthenticatorData(r.Response.AuthenticatorData, requireVerification)
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = key.Verify(signedData(r.Response.AuthenticatorData, r.Response.ClientDataJSON), r.Response.Signature); err != nil {
+		return 0, err
+	}
+
+	// Authenticators which don't implement a counter always return 0.
+	if (authData.SignCount != 0 || signCount != 0) && authData.SignCount <= signCount {
+		return authData.SignCount, ErrCredentialCloned
+	}
+
+	return authData.SignCount, nil
+}
+
+func (c Config) verifyClientData(raw []byte, ceremony string, challenge []byte) error {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return ErrClientDataInvalid
+	}
+
+	if data.Type != ceremony {
+		return ErrClientDataInvalid
+	}
+
+	if subtle.ConstantTimeCompare(data.Challenge, challenge) != 1 {
+		return ErrChallengeMismatch
+	}
+
+	for _, origin := range c.Origins {
+		if data.Origin == origin {
+			return nil
+		}
+	}
+
+	return ErrOriginMismatch
+}
+
+func (c Config) verifyAuthenticatorData(raw []byte, requireVerification bool) (authenticatorData, error) {
+	authData, err := parseAuthenticatorData(raw)
+	if err != nil {
+		return authenticatorData{}, err
+	}
+
+	rpIdHash := sha256.Sum256([]byte(c.RPID))
+	if !bytes.Equal(authData.RPIDHash, rpIdHash[:]) {
+		return authenticatorData{}, ErrRPIDMismatch
+	}
+
+	if authData.Flags&FlagUserPresent == 0 {
+		return authenticatorData{}, ErrUserNotPresent
+	}
+
+	if requireVerification && authData.Flags&FlagUserVerified == 0 {
+		return authenticatorData{}, ErrUserNotVerified
+	}
+
+	return authData, nil
+}
+
+// parseAuthenticatorData decodes the binary authenticator data:
+// rpIdHash (32) | flags (1) | signCount (4) | [aaguid (16) | idLength (2) | id | COSE key] | [extensions].
+func parseAuthenticatorData(raw []byte) (authenticatorData, error) {
+	if len(raw) < 37 {
+		return authenticatorData{}, ErrAuthenticatorData
+	}
+
+	authData := authenticatorData{
+		RPIDHash:  raw[:32],
+		Flags:     raw[32],
+		SignCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+
+	rest := raw[37:]
+
+	if authData.Flags&FlagAttestedData != 0 {
+		if len(rest) < 18 {
+			return authenticatorData{}, ErrAuthenticatorData
+		}
+
+		authData.AAGUID = rest[:16]
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+
+		if idLength == 0 || idLength > 1023 || len(rest) < idLength {
+			return authenticatorData{}, ErrAuthenticatorData
+		}
+
+		authData.CredentialID = rest[:idLength]
+		rest = rest[idLength:]
+
+		_, remaining, err := decodeCBOR(rest)
+		if err != nil {
+			return authenticatorData{}, err
+		}
+
+		authData.PublicKey = rest[:len(rest)-len(remaining)]
+		rest = remaining
+	}
+
+	if authData.Flags&FlagExtensionData != 0 {
+		if _, err := cborMap(rest); err != nil {
+			return authenticatorData{}, err
+		}
+		rest = nil
+	}
+
+	if len(rest) != 0 {
+		return authenticatorData{}, ErrAuthenticatorData
+	}
+
+	return authData, nil
+}
+
+// verifySelfAttestation verifies a "packed" attestation signed by the credential key itself.
+// Attestations signed by an attestation certificate (x5c) are not supported.
+func verifySelfAttestation(statement map[interface{}]interface{}, key PublicKey, authData []byte, clientDataJSON []byte) error {
+	if _, ok := statement["x5c"]; ok {
+		return ErrUnsupportedAttestation
+	}
+
+	alg, _ := statement["alg"].(int64)
+	signature, _ := statement["sig"].([]byte)
+	if alg != key.Algorithm || signature == nil {
+		return fmt.Errorf("%w: self attestation algorithm mismatch", ErrUnsupportedAttestation)
+	}
+
+	return key.Verify(signedData(authData, clientDataJSON), signature)
+}
+
+// signedData is what authenticators sign, the authenticator data followed by the client data hash.
+func signedData(authData []byte, clientDataJSON []byte) []byte {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+
+	data := make([]byte, 0, len(authData)+len(clientDataHash))
+	data = append(data, authData...)
+
+	return append(data, clientDataHash[:]...)
+}
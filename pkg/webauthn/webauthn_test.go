@@ -0,0 +1,550 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+var testConfig = Config{
+	RPID:    "atraf.app",
+	RPName:  "Atraf",
+	Origins: []string{"https://atraf.app"},
+}
+
+// authenticator is a software authenticator holding a single ES256 or Ed25519 credential.
+type authenticator struct {
+	t            *testing.T
+	rpID         string
+	origin       string
+	credentialID []byte
+	signCount    uint32
+	flags        byte
+	es256        *ecdsa.PrivateKey
+	ed25519      ed25519.PrivateKey
+}
+
+func newAuthenticator(t *testing.T, alg int64) *authenticator {
+	a := &authenticator{
+		t:            t,
+		rpID:         testConfig.RPID,
+		origin:       testConfig.Origins[0],
+		credentialID: []byte("credential-id"),
+		flags:        FlagUserPresent | FlagUserVerified,
+	}
+
+	var err error
+	switch alg {
+	case AlgES256:
+		a.es256, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, a.ed25519, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		t.Fatalf("unsupported algorithm [%d]", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+// coseKey returns the COSE encoding of the credential public key.
+func (a *authenticator) coseKey() []byte {
+	if a.es256 != nil {
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		a.es256.X.FillBytes(x)
+		a.es256.Y.FillBytes(y)
+
+		return encodeCBOR(cborPairs{
+			{coseKty, ktyEC2},
+			{coseAlg, AlgES256},
+			{coseCrv, crvP256},
+			{coseX, x},
+			{coseY, y},
+		})
+	}
+
+	return encodeCBOR(cborPairs{
+		{coseKty, ktyOKP},
+		{coseAlg, AlgEdDSA},
+		{coseCrv, crvEd25519},
+		{coseX, []byte(a.ed25519.Public().(ed25519.PublicKey))},
+	})
+}
+
+func (a *authenticator) sign(data []byte) []byte {
+	if a.es256 != nil {
+		digest := sha256.Sum256(data)
+
+		signature, err := ecdsa.SignASN1(rand.Reader, a.es256, digest[:])
+		if err != nil {
+			a.t.Fatal(err)
+		}
+
+		return signature
+	}
+
+	return ed25519.Sign(a.ed25519, data)
+}
+
+func (a *authenticator) authenticatorData(attested bool) []byte {
+	rpIdHash := sha256.Sum256([]byte(a.rpID))
+
+	data := append([]byte{}, rpIdHash[:]...)
+	flags := a.flags
+	if attested {
+		flags |= FlagAttestedData
+	}
+	data = append(data, flags)
+	data = append(data, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[len(data)-4:], a.signCount)
+
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = append(data, 0, 0)
+		binary.BigEndian.PutUint16(data[len(data)-2:], uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+
+	return data
+}
+
+func (a *authenticator) clientData(ceremony string, challenge []byte) []byte {
+	data, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    a.origin,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return data
+}
+
+// register answers navigator.credentials.create(), with a "packed" self attestation
+// when packed is set, or no attestation at all.
+func (a *authenticator) register(challenge []byte, packed bool) AttestationResponse {
+	clientDataJSON := a.clientData(ClientDataCreate, challenge)
+	authData := a.authenticatorData(true)
+
+	format, statement := "none", cborPairs{}
+	if packed {
+		alg := AlgEdDSA
+		if a.es256 != nil {
+			alg = AlgES256
+		}
+
+		format = "packed"
+		statement = cborPairs{
+			{"alg", alg},
+			{"sig", a.sign(signedData(authData, clientDataJSON))},
+		}
+	}
+
+	var r AttestationResponse
+	r.RawID = a.credentialID
+	r.Type = CredentialType
+	r.Response.ClientDataJSON = clientDataJSON
+	r.Response.AttestationObject = encodeCBOR(cborPairs{
+		{"fmt", format},
+		{"attStmt", statement},
+		{"authData", authData},
+	})
+	r.Response.Transports = []string{"internal"}
+
+	return r
+}
+
+// assert answers navigator.credentials.get().
+func (a *authenticator) assert(challenge []byte) AssertionResponse {
+	clientDataJSON := a.clientData(ClientDataGet, challenge)
+	authData := a.authenticatorData(false)
+
+	var r AssertionResponse
+	r.RawID = a.credentialID
+	r.Type = CredentialType
+	r.Response.ClientDataJSON = clientDataJSON
+	r.Response.AuthenticatorData = authData
+	r.Response.Signature = a.sign(signedData(authData, clientDataJSON))
+
+	return r
+}
+
+func challenge(t *testing.T) []byte {
+	c, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestRegistrationAndAssertion(t *testing.T) {
+	for _, alg := range []int64{AlgES256, AlgEdDSA} {
+		a := newAuthenticator(t, alg)
+
+		registration := challenge(t)
+		credential, err := testConfig.VerifyRegistration(registration, a.register(registration, false), true)
+		if err != nil {
+			t.Fatalf("alg %d: %v", alg, err)
+		}
+
+		if !bytes.Equal(credential.ID, a.credentialID) || credential.Algorithm != alg || credential.SignCount != 0 {
+			t.Errorf("alg %d: unexpected credential %+v", alg, credential)
+		}
+
+		for i := 1; i <= 2; i++ {
+			a.signCount++
+			login := challenge(t)
+
+			signCount, err := testConfig.VerifyAssertion(login, a.assert(login), credential.PublicKey, credential.SignCount, true)
+			if err != nil {
+				t.Fatalf("alg %d: %v", alg, err)
+			}
+
+			if signCount != uint32(i) {
+				t.Errorf("alg %d: expected sign count [%d] got [%d]", alg, i, signCount)
+			}
+
+			credential.SignCount = signCount
+		}
+	}
+}
+
+func TestRegistrationPackedSelfAttestation(t *testing.T) {
+	a := newAuthenticator(t, AlgEdDSA)
+	c := challenge(t)
+
+	if _, err := testConfig.VerifyRegistration(c, a.register(c, true), true); err != nil {
+		t.Fatal(err)
+	}
+
+	r := a.register(c, true)
+	attestation, _ := cborMap(r.Response.AttestationObject)
+	r.Response.AttestationObject = encodeCBOR(cborPairs{
+		{"fmt", "packed"},
+		{"attStmt", cborPairs{{"alg", AlgEdDSA}, {"sig", make([]byte, ed25519.SignatureSize)}}},
+		{"authData", attestation["authData"].([]byte)},
+	})
+
+	if _, err := testConfig.VerifyRegistration(c, r, true); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("expected [%v] got [%v]", ErrBadSignature, err)
+	}
+}
+
+func TestRegistrationRejected(t *testing.T) {
+	cases := []struct {
+		name    string
+		prepare func(a *authenticator, c []byte) ([]byte, AttestationResponse)
+		err     error
+	}{
+		{
+			name: "wrong origin",
+			prepare: func(a *authenticator, c []byte) ([]byte, AttestationResponse) {
+				a.origin = "https://attacker.example.com"
+				return c, a.register(c, false)
+			},
+			err: ErrOriginMismatch,
+		},
+		{
+			name: "wrong rp id",
+			prepare: func(a *authenticator, c []byte) ([]byte, AttestationResponse) {
+				a.rpID = "attacker.example.com"
+				return c, a.register(c, false)
+			},
+			err: ErrRPIDMismatch,
+		},
+		{
+			name: "wrong challenge",
+			prepare: func(a *authenticator, c []byte) ([]byte, AttestationResponse) {
+				return challenge(a.t), a.register(c, false)
+			},
+			err: ErrChallengeMismatch,
+		},
+		{
+			name: "assertion client data",
+			prepare: func(a *authenticator, c []byte) ([]byte, AttestationResponse) {
+				r := a.register(c, false)
+				r.Response.ClientDataJSON = a.clientData(ClientDataGet, c)
+				return c, r
+			},
+			err: ErrClientDataInvalid,
+		},
+		{
+			name: "malformed client data",
+			prepare: func(a *authenticator, c []byte) ([]byte, AttestationResponse) {
+				r := a.register(c, false)
+				r.Response.ClientDataJSON = []byte("{")
+				return c, r
+			},
+			err: ErrClientDataInvalid,
+		},
+		{
+			name: "user not present",
+			prepare: func(a *authenticator, c []byte) ([]byte, AttestationResponse) {
+				a.flags = 0
+				return c, a.register(c, false)
+			},
+			err: ErrUserNotPresent,
+		},
+		{
+			name: "user not verified",
+			prepare: func(a *authenticator, c []byte) ([]byte, AttestationResponse) {
+				a.flags = FlagUserPresent
+				return c, a.register(c, false)
+			},
+			err: ErrUserNotVerified,
+		},
+		{
+			name: "malformed attestation object",
+			prepare: func(a *authenticator, c []byte) ([]byte, AttestationResponse) {
+				r := a.register(c, false)
+				r.Response.AttestationObject = r.Response.AttestationObject[:len(r.Response.AttestationObject)-1]
+				return c, r
+			},
+			err: ErrMalformedCBOR,
+		},
+		{
+			name: "truncated authenticator data",
+			prepare: func(a *authenticator, c []byte) ([]byte, AttestationResponse) {
+				r := a.register(c, false)
+				r.Response.AttestationObject = encodeCBOR(cborPairs{
+					{"fmt", "none"},
+					{"attStmt", cborPairs{}},
+					{"authData", a.authenticatorData(true)[:40]},
+				})
+				return c, r
+			},
+			err: ErrAuthenticatorData,
+		},
+		{
+			name: "no attested credential",
+			prepare: func(a *authenticator, c []byte) ([]byte, AttestationResponse) {
+				r := a.register(c, false)
+				r.Response.AttestationObject = encodeCBOR(cborPairs{
+					{"fmt", "none"},
+					{"attStmt", cborPairs{}},
+					{"authData", a.authenticatorData(false)},
+				})
+				return c, r
+			},
+			err: ErrAuthenticatorData,
+		},
+		{
+			name: "unsupported attestation format",
+			prepare: func(a *authenticator, c []byte) ([]byte, AttestationResponse) {
+				r := a.register(c, false)
+				r.Response.AttestationObject = encodeCBOR(cborPairs{
+					{"fmt", "fido-u2f"},
+					{"attStmt", cborPairs{}},
+					{"authData", a.authenticatorData(true)},
+				})
+				return c, r
+			},
+			err: ErrUnsupportedAttestation,
+		},
+		{
+			name: "none attestation with a statement",
+			prepare: func(a *authenticator, c []byte) ([]byte, AttestationResponse) {
+				r := a.register(c, false)
+				r.Response.AttestationObject = encodeCBOR(cborPairs{
+					{"fmt", "none"},
+					{"attStmt", cborPairs{{"alg", AlgES256}}},
+					{"authData", a.authenticatorData(true)},
+				})
+				return c, r
+			},
+			err: ErrUnsupportedAttestation,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a := newAuthenticator(t, AlgES256)
+			expected, r := c.prepare(a, challenge(t))
+
+			if _, err := testConfig.VerifyRegistration(expected, r, true); !errors.Is(err, c.err) {
+				t.Errorf("expected [%v] got [%v]", c.err, err)
+			}
+		})
+	}
+}
+
+func TestAssertionRejected(t *testing.T) {
+	cases := []struct {
+		name    string
+		prepare func(a *authenticator, c []byte) ([]byte, AssertionResponse)
+		err     error
+	}{
+		{
+			name: "wrong origin",
+			prepare: func(a *authenticator, c []byte) ([]byte, AssertionResponse) {
+				a.origin = "https://attacker.example.com"
+				return c, a.assert(c)
+			},
+			err: ErrOriginMismatch,
+		},
+		{
+			name: "wrong rp id",
+			prepare: func(a *authenticator, c []byte) ([]byte, AssertionResponse) {
+				a.rpID = "attacker.example.com"
+				return c, a.assert(c)
+			},
+			err: ErrRPIDMismatch,
+		},
+		{
+			name: "wrong challenge",
+			prepare: func(a *authenticator, c []byte) ([]byte, AssertionResponse) {
+				return challenge(a.t), a.assert(c)
+			},
+			err: ErrChallengeMismatch,
+		},
+		{
+			name: "registration client data",
+			prepare: func(a *authenticator, c []byte) ([]byte, AssertionResponse) {
+				r := a.assert(c)
+				r.Response.ClientDataJSON = a.clientData(ClientDataCreate, c)
+				return c, r
+			},
+			err: ErrClientDataInvalid,
+		},
+		{
+			name: "user not verified",
+			prepare: func(a *authenticator, c []byte) ([]byte, AssertionResponse) {
+				a.flags = FlagUserPresent
+				return c, a.assert(c)
+			},
+			err: ErrUserNotVerified,
+		},
+		{
+			name: "signed by another key",
+			prepare: func(a *authenticator, c []byte) ([]byte, AssertionResponse) {
+				other := newAuthenticator(a.t, AlgES256)
+				return c, other.assert(c)
+			},
+			err: ErrBadSignature,
+		},
+		{
+			name: "tampered authenticator data",
+			prepare: func(a *authenticator, c []byte) ([]byte, AssertionResponse) {
+				r := a.assert(c)
+				// Raise the signature counter after signing.
+				r.Response.AuthenticatorData[36]++
+				return c, r
+			},
+			err: ErrBadSignature,
+		},
+		{
+			name: "tampered client data",
+			prepare: func(a *authenticator, c []byte) ([]byte, AssertionResponse) {
+				r := a.assert(c)
+				r.Response.ClientDataJSON = append(r.Response.ClientDataJSON[:len(r.Response.ClientDataJSON)-1], []byte(` }`)...)
+				return c, r
+			},
+			err: ErrBadSignature,
+		},
+		{
+			name: "trailing authenticator data",
+			prepare: func(a *authenticator, c []byte) ([]byte, AssertionResponse) {
+				r := a.assert(c)
+				r.Response.AuthenticatorData = append(r.Response.AuthenticatorData, 0x00)
+				return c, r
+			},
+			err: ErrAuthenticatorData,
+		},
+		{
+			name: "malformed extensions",
+			prepare: func(a *authenticator, c []byte) ([]byte, AssertionResponse) {
+				a.flags |= FlagExtensionData
+				r := a.assert(c)
+				r.Response.AuthenticatorData = append(r.Response.AuthenticatorData, 0xa1, 0x01)
+				return c, r
+			},
+			err: ErrMalformedCBOR,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a := newAuthenticator(t, AlgES256)
+			publicKey := a.coseKey()
+			expected, r := c.prepare(a, challenge(t))
+
+			if _, err := testConfig.VerifyAssertion(expected, r, publicKey, 0, true); !errors.Is(err, c.err) {
+				t.Errorf("expected [%v] got [%v]", c.err, err)
+			}
+		})
+	}
+}
+
+func TestAssertionSignCount(t *testing.T) {
+	cases := []struct {
+		name      string
+		stored    uint32
+		asserted  uint32
+		err       error
+		signCount uint32
+	}{
+		{name: "increased", stored: 4, asserted: 5, signCount: 5},
+		{name: "not implemented", stored: 0, asserted: 0, signCount: 0},
+		{name: "repeated", stored: 5, asserted: 5, err: ErrCredentialCloned, signCount: 5},
+		{name: "went backwards", stored: 5, asserted: 3, err: ErrCredentialCloned, signCount: 3},
+		{name: "reset to zero", stored: 5, asserted: 0, err: ErrCredentialCloned, signCount: 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a := newAuthenticator(t, AlgES256)
+			a.signCount = c.asserted
+			login := challenge(t)
+
+			signCount, err := testConfig.VerifyAssertion(login, a.assert(login), a.coseKey(), c.stored, true)
+			if !errors.Is(err, c.err) {
+				t.Errorf("expected [%v] got [%v]", c.err, err)
+			}
+
+			if signCount != c.signCount {
+				t.Errorf("expected sign count [%d] got [%d]", c.signCount, signCount)
+			}
+		})
+	}
+}
+
+func TestParsePublicKeyRejected(t *testing.T) {
+	a := newAuthenticator(t, AlgES256)
+	x := make([]byte, 32)
+	a.es256.X.FillBytes(x)
+
+	cases := map[string][]byte{
+		"malformed":        {0xa1},
+		"unknown key type": encodeCBOR(cborPairs{{coseKty, 4}, {coseAlg, AlgES256}}),
+		"wrong algorithm":  encodeCBOR(cborPairs{{coseKty, ktyEC2}, {coseAlg, AlgEdDSA}}),
+		"point off curve": encodeCBOR(cborPairs{
+			{coseKty, ktyEC2}, {coseAlg, AlgES256}, {coseCrv, crvP256}, {coseX, x}, {coseY, x},
+		}),
+		"short ed25519 key": encodeCBOR(cborPairs{
+			{coseKty, ktyOKP}, {coseAlg, AlgEdDSA}, {coseCrv, crvEd25519}, {coseX, x[:16]},
+		}),
+		"short rsa modulus": encodeCBOR(cborPairs{
+			{coseKty, ktyRSA}, {coseAlg, AlgRS256}, {coseN, x}, {coseE, []byte{1, 0, 1}},
+		}),
+	}
+
+	for name, key := range cases {
+		if _, err := ParsePublicKey(key); err == nil {
+			t.Errorf("%s: expected the key to be rejected", name)
+		}
+	}
+}
@@ -1,21 +1,49 @@
 package account
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 
+	"github.com/go-chi/chi/v5"
+
+	"atraf-server/services/audit"
+	"atraf-server/services/invites"
+	"atraf-server/services/sessions"
 	"atraf-server/services/users"
 
 	"atraf-server/pkg/authentication"
+	"atraf-server/pkg/oidc"
+	"atraf-server/pkg/password"
 	"atraf-server/pkg/rest"
 	"atraf-server/pkg/token"
+	"atraf-server/pkg/uid"
 	"atraf-server/pkg/validate"
+	"atraf-server/pkg/webauthn"
+)
+
+const (
+	OAuthStateCookie = "ostId"
+	OAuthStatePath   = "/account/oauth"
+)
+
+// Reasons sent along with 403 responses, see rest.Forbidden.
+const (
+	ReasonRegistrationClosed = "registration_closed"
 )
 
 type RegisterRequest struct {
 	Email    string `json:"email" validate:"required,email"`
 	Nickname string `json:"nickname" validate:"required"`
 	Password string `json:"password" validate:"required"`
+	// InviteCode is required when registration is invite only.
+	InviteCode string `json:"invite_code"`
 }
 
 type RegisterResponse struct {
@@ -35,8 +63,73 @@ type LoginRequest struct {
 	Password string `json:"password" validate:"required"`
 }
 
+// LoginResponse either carries the logged-in account, or when the account has a second factor,
+// a challenge which has to be verified along with one of the TwoFactorMethods.
 type LoginResponse struct {
-	Account Account `json:"account"`
+	Account           Account  `json:"account"`
+	TwoFactorRequired bool     `json:"two_factor_required"`
+	TwoFactorMethods  []string `json:"two_factor_methods,omitempty"`
+	Challenge         string   `json:"challenge,omitempty"`
+}
+
+type MagicLinkRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type MagicLinkVerifyRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type TwoFactorSetupResponse struct {
+	URI string `json:"uri"`
+}
+
+type TwoFactorConfirmRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+type TwoFactorConfirmResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type TwoFactorVerifyRequest struct {
+	Challenge string `json:"challenge" validate:"required"`
+	Code      string `json:"code" validate:"required"`
+}
+
+type PasskeyRegisterStartResponse struct {
+	ChallengeId uid.UID                  `json:"challenge_id"`
+	Options     webauthn.CreationOptions `json:"options"`
+}
+
+type PasskeyRegisterFinishRequest struct {
+	ChallengeId uid.UID                      `json:"challenge_id" validate:"required"`
+	Name        string                       `json:"name" validate:"required,max=100"`
+	Credential  webauthn.AttestationResponse `json:"credential"`
+}
+
+type PasskeyResponse struct {
+	Passkey Passkey `json:"passkey"`
+}
+
+type PasskeysResponse struct {
+	Passkeys []Passkey `json:"passkeys"`
+}
+
+// PasskeyLoginStartRequest optionally carries the challenge returned by Login,
+// in which case the passkey is used as the second factor.
+type PasskeyLoginStartRequest struct {
+	Challenge string `json:"challenge"`
+}
+
+type PasskeyLoginStartResponse struct {
+	ChallengeId uid.UID                 `json:"challenge_id"`
+	Options     webauthn.RequestOptions `json:"options"`
+}
+
+type PasskeyLoginFinishRequest struct {
+	ChallengeId uid.UID                    `json:"challenge_id" validate:"required"`
+	Credential  webauthn.AssertionResponse `json:"credential"`
 }
 
 type ForgotRequest struct {
@@ -48,10 +141,47 @@ type ResetRequest struct {
 	NewPassword string `json:"new_password" validate:"required"`
 }
 
+type EmailChangeRequest struct {
+	NewEmail string `json:"new_email" validate:"required,email"`
+	Password string `json:"password" validate:"required"`
+}
+
+type EmailConfirmRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required"`
+}
+
+type RoleChangeRequest struct {
+	Role string `json:"role" validate:"required,oneof=user moderator admin"`
+}
+
+// DeleteRequest is sent without a password by accounts which don't have one.
+type DeleteRequest struct {
+	Password string `json:"password"`
+}
+
+type DeleteConfirmRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type RefreshResponse struct {
+	Account Account `json:"account"`
+}
+
+type SessionsResponse struct {
+	CurrentSessionId uid.UID            `json:"current_session_id"`
+	Sessions         []sessions.Session `json:"sessions"`
+}
+
 type Handler struct {
-	service  *Service
-	users    *users.Service
-	validate *validate.Validate
+	service   *Service
+	sessions  *sessions.Service
+	providers map[string]*oidc.Provider
+	validate  *validate.Validate
 }
 
 func (h Handler) Register() http.HandlerFunc {
@@ -68,24 +198,33 @@ func (h Handler) Register() http.HandlerFunc {
 			return
 		}
 
-		account, err := h.service.Register(request.Email, request.Nickname, request.Password)
+		account, err := h.service.Register(request.Email, request.Nickname, request.Password, request.InviteCode, audit.ClientFromRequest(r))
 		if err != nil {
-			rest.Error(w, err, http.StatusConflict)
-			return
-		}
-
-		// Dependency(Users)
-		// This could be a webhook
-		userFields := &users.Fields{
-			Email:    account.Email,
-			Nickname: account.Nickname,
-		}
-		if h.users.NewUser(account.Id, userFields) != nil {
-			rest.Error(w, err, http.StatusInternalServerError)
+			var policy *password.PolicyError
+			switch {
+			case errors.As(err, &policy):
+				rest.InvalidFields(w, err, map[string][]string{"password": policy.Violations})
+			case errors.Is(err, ErrRegistrationClosed):
+				rest.Forbidden(w, err, ReasonRegistrationClosed)
+			case errors.Is(err, ErrInviteRequired):
+				rest.InvalidFields(w, err, map[string][]string{"invite_code": {"required"}})
+			case errors.Is(err, invites.ErrInviteInvalid):
+				rest.InvalidFields(w, err, map[string][]string{"invite_code": {"invalid"}})
+			case errors.Is(err, users.ErrNicknameLength):
+				rest.InvalidFields(w, err, map[string][]string{"nickname": {"length"}})
+			case errors.Is(err, users.ErrNicknameInvalid):
+				rest.InvalidFields(w, err, map[string][]string{"nickname": {"invalid"}})
+			case errors.Is(err, users.ErrNicknameTaken):
+				rest.InvalidFields(w, err, map[string][]string{"nickname": {"taken"}})
+			case errors.Is(err, users.ErrNicknameReserved):
+				rest.InvalidFields(w, err, map[string][]string{"nickname": {"reserved"}})
+			default:
+				rest.Error(w, err, http.StatusConflict)
+			}
 			return
 		}
 
-		if err = authentication.SetCookie(w, account.Id, account.Active); err != nil {
+		if err = h.newSession(w, r, account); err != nil {
 			rest.Error(w, err, http.StatusInternalServerError)
 			return
 		}
@@ -111,8 +250,17 @@ func (h Handler) Activate() http.HandlerFunc {
 			return
 		}
 
-		if err := h.service.Activate(auth.AccountId, request.Code); err != nil {
-			rest.Error(w, err, http.StatusBadRequest)
+		if err := h.service.Activate(auth.AccountId, request.Code, audit.ClientFromRequest(r)); err != nil {
+			switch {
+			case errors.Is(err, ErrActivationCodeExpired):
+				rest.Error(w, err, http.StatusGone)
+			case errors.Is(err, ErrActivationLocked):
+				rest.Error(w, err, http.StatusLocked)
+			case errors.Is(err, ErrAccountActive):
+				rest.Error(w, err, http.StatusConflict)
+			default:
+				rest.Error(w, err, http.StatusBadRequest)
+			}
 			return
 		}
 
@@ -123,7 +271,7 @@ func (h Handler) Activate() http.HandlerFunc {
 		}
 
 		// Issue New Access Token
-		if err = authentication.SetCookie(w, account.Id, account.Active); err != nil {
+		if err = authentication.SetCookie(w, h.claims(account, auth.SessionId)); err != nil {
 			rest.Error(w, err, http.StatusInternalServerError)
 			return
 		}
@@ -134,6 +282,26 @@ func (h Handler) Activate() http.HandlerFunc {
 	}
 }
 
+func (h Handler) ResendActivation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := authentication.Context(r)
+
+		err := h.service.ResendActivation(auth.AccountId)
+
+		var throttled *ThrottledError
+		switch {
+		case err == nil:
+			rest.Success(w, http.StatusNoContent, nil)
+		case errors.As(err, &throttled):
+			rest.TooManyRequests(w, err, throttled.RetryAfter)
+		case errors.Is(err, ErrAccountActive):
+			rest.Error(w, err, http.StatusConflict)
+		default:
+			rest.Error(w, err, http.StatusInternalServerError)
+		}
+	}
+}
+
 func (h Handler) Login() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var request LoginRequest
@@ -148,26 +316,106 @@ func (h Handler) Login() http.HandlerFunc {
 			return
 		}
 
-		account, err := h.service.Login(request.Email, request.Password)
+		account, err := h.service.Login(request.Email, request.Password, audit.ClientFromRequest(r))
 		if err != nil {
+			var throttled *ThrottledError
+			if errors.As(err, &throttled) {
+				rest.TooManyRequests(w, err, throttled.RetryAfter)
+				return
+			}
+
 			rest.Error(w, err, http.StatusUnauthorized)
 			return
 		}
 
-		if err = authentication.SetCookie(w, account.Id, account.Active); err != nil {
+		h.completeLogin(w, r, account)
+	}
+}
+
+func (h Handler) MagicLink() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request MagicLinkRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err := h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		// Whether an account can be found or not, a "successful" response is returned.
+		if err := h.service.SendMagicLink(request.Email, audit.ClientFromRequest(r)); err != nil {
+			var throttled *ThrottledError
+			if errors.As(err, &throttled) {
+				rest.TooManyRequests(w, err, throttled.RetryAfter)
+				return
+			}
+
+			rest.Success(w, http.StatusNoContent, nil)
+			return
+		}
+
+		rest.Success(w, http.StatusNoContent, nil)
+	}
+}
+
+func (h Handler) MagicLinkVerify() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request MagicLinkVerifyRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err := h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		account, err := h.service.MagicLogin(request.Token, audit.ClientFromRequest(r))
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrMagicLinkInvalid), errors.Is(err, ErrAccountDeleted):
+				rest.Error(w, err, http.StatusUnauthorized)
+			default:
+				rest.Error(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		h.completeLogin(w, r, account)
+	}
+}
+
+func (h Handler) TwoFactorSetup() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := authentication.Context(r)
+
+		uri, err := h.service.SetupTwoFactor(auth.AccountId)
+		if err != nil {
+			if errors.Is(err, ErrTwoFactorEnabled) {
+				rest.Error(w, err, http.StatusConflict)
+				return
+			}
+
 			rest.Error(w, err, http.StatusInternalServerError)
 			return
 		}
 
-		rest.Success(w, http.StatusOK, &LoginResponse{
-			Account: account,
+		rest.Success(w, http.StatusOK, &TwoFactorSetupResponse{
+			URI: uri,
 		})
 	}
 }
 
-func (h Handler) Forgot() http.HandlerFunc {
+func (h Handler) TwoFactorConfirm() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var request ForgotRequest
+		var request TwoFactorConfirmRequest
+		auth := authentication.Context(r)
 
 		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 			rest.Error(w, err, http.StatusUnsupportedMediaType)
@@ -179,19 +427,28 @@ func (h Handler) Forgot() http.HandlerFunc {
 			return
 		}
 
-		// Whether an account can be found or not, a "successful" response is returned.
-		if err := h.service.Forgot(request.Email); err != nil {
-			rest.Success(w, http.StatusNoContent, nil)
+		codes, err := h.service.ConfirmTwoFactor(auth.AccountId, request.Code, audit.ClientFromRequest(r))
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrTwoFactorEnabled):
+				rest.Error(w, err, http.StatusConflict)
+			case errors.Is(err, ErrTwoFactorNotSetUp), errors.Is(err, ErrTwoFactorCodeInvalid):
+				rest.Error(w, err, http.StatusBadRequest)
+			default:
+				rest.Error(w, err, http.StatusInternalServerError)
+			}
 			return
 		}
 
-		rest.Success(w, http.StatusNoContent, nil)
+		rest.Success(w, http.StatusOK, &TwoFactorConfirmResponse{
+			RecoveryCodes: codes,
+		})
 	}
 }
 
-func (h Handler) Reset() http.HandlerFunc {
+func (h Handler) TwoFactorVerify() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var request ResetRequest
+		var request TwoFactorVerifyRequest
 
 		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 			rest.Error(w, err, http.StatusUnsupportedMediaType)
@@ -203,27 +460,787 @@ func (h Handler) Reset() http.HandlerFunc {
 			return
 		}
 
-		t, err := token.VerifyResetToken(request.Token)
+		account, err := h.service.VerifyTwoFactor(request.Challenge, request.Code, audit.ClientFromRequest(r))
 		if err != nil {
+			var throttled *ThrottledError
+			if errors.As(err, &throttled) {
+				rest.TooManyRequests(w, err, throttled.RetryAfter)
+				return
+			}
+
 			rest.Error(w, err, http.StatusUnauthorized)
 			return
 		}
 
-		account, err := h.service.ByAccountId(t.AccountId)
+		if err = h.newSession(w, r, account); err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		rest.Success(w, http.StatusOK, &LoginResponse{
+			Account: account,
+		})
+	}
+}
+
+func (h Handler) PasskeyRegisterStart() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := authentication.Context(r)
+
+		challengeId, options, err := h.service.BeginPasskeyRegistration(auth.AccountId)
 		if err != nil {
-			rest.Error(w, err, http.StatusUnauthorized)
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		rest.Success(w, http.StatusOK, &PasskeyRegisterStartResponse{
+			ChallengeId: challengeId,
+			Options:     options,
+		})
+	}
+}
+
+func (h Handler) PasskeyRegisterFinish() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request PasskeyRegisterFinishRequest
+		auth := authentication.Context(r)
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err := h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		passkey, err := h.service.FinishPasskeyRegistration(auth.AccountId, request.ChallengeId, request.Name, request.Credential, audit.ClientFromRequest(r))
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrPasskeyTaken):
+				rest.Error(w, err, http.StatusConflict)
+			default:
+				rest.Error(w, err, http.StatusBadRequest)
+			}
 			return
 		}
 
-		if err = h.service.UpdatePassword(account.Id, request.NewPassword); err != nil {
+		rest.Success(w, http.StatusCreated, &PasskeyResponse{
+			Passkey: passkey,
+		})
+	}
+}
+
+func (h Handler) Passkeys() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := authentication.Context(r)
+
+		passkeys, err := h.service.Passkeys(auth.AccountId)
+		if err != nil {
 			rest.Error(w, err, http.StatusInternalServerError)
 			return
 		}
 
+		rest.Success(w, http.StatusOK, &PasskeysResponse{
+			Passkeys: passkeys,
+		})
+	}
+}
+
+func (h Handler) RemovePasskey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := authentication.Context(r)
+
+		passkeyId, err := uid.FromString(chi.URLParam(r, "passkey_id"))
+		if err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		if err = h.service.RemovePasskey(auth.AccountId, passkeyId, audit.ClientFromRequest(r)); err != nil {
+			rest.Error(w, err, http.StatusNotFound)
+			return
+		}
+
 		rest.Success(w, http.StatusNoContent, nil)
 	}
 }
 
-func NewHandler(s *Service, u *users.Service, v *validate.Validate) *Handler {
-	return &Handler{s, u, v}
+func (h Handler) PasskeyLoginStart() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request PasskeyLoginStartRequest
+
+		// The body is optional, passwordless logins don't send one.
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		accountId := uid.Nil
+		if request.Challenge != "" {
+			var err error
+			if accountId, err = h.service.ConsumeLoginChallenge(request.Challenge); err != nil {
+				rest.Error(w, err, http.StatusUnauthorized)
+				return
+			}
+		}
+
+		challengeId, options, err := h.service.BeginPasskeyLogin(accountId)
+		if err != nil {
+			if errors.Is(err, ErrNoPasskeys) {
+				rest.Error(w, err, http.StatusNotFound)
+				return
+			}
+
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		rest.Success(w, http.StatusOK, &PasskeyLoginStartResponse{
+			ChallengeId: challengeId,
+			Options:     options,
+		})
+	}
+}
+
+func (h Handler) PasskeyLoginFinish() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request PasskeyLoginFinishRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err := h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		account, err := h.service.PasskeyLogin(request.ChallengeId, request.Credential, audit.ClientFromRequest(r))
+		if err != nil {
+			rest.Error(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		if err = h.newSession(w, r, account); err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		rest.Success(w, http.StatusOK, &LoginResponse{
+			Account: account,
+		})
+	}
+}
+
+func (h Handler) Forgot() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request ForgotRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err := h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		// Whether an account can be found or not, a "successful" response is returned.
+		if err := h.service.Forgot(request.Email, audit.ClientFromRequest(r)); err != nil {
+			var throttled *ThrottledError
+			if errors.As(err, &throttled) {
+				rest.TooManyRequests(w, err, throttled.RetryAfter)
+				return
+			}
+
+			rest.Success(w, http.StatusNoContent, nil)
+			return
+		}
+
+		rest.Success(w, http.StatusNoContent, nil)
+	}
+}
+
+func (h Handler) Reset() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request ResetRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err := h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		if err := h.service.Reset(request.Token, request.NewPassword, audit.ClientFromRequest(r)); err != nil {
+			var policy *password.PolicyError
+			switch {
+			case errors.As(err, &policy):
+				rest.InvalidFields(w, err, map[string][]string{"new_password": policy.Violations})
+			case errors.Is(err, ErrResetTokenInvalid):
+				rest.Error(w, err, http.StatusUnauthorized)
+			default:
+				rest.Error(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		rest.Success(w, http.StatusNoContent, nil)
+	}
+}
+
+func (h Handler) ChangeEmail() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request EmailChangeRequest
+		auth := authentication.Context(r)
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err := h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		if err := h.service.RequestEmailChange(auth.AccountId, request.NewEmail, request.Password, audit.ClientFromRequest(r)); err != nil {
+			switch {
+			case errors.Is(err, ErrEmailTaken):
+				rest.Error(w, err, http.StatusConflict)
+			case errors.Is(err, password.ErrMismatch):
+				rest.Error(w, err, http.StatusUnauthorized)
+			default:
+				rest.Error(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		rest.Success(w, http.StatusAccepted, nil)
+	}
+}
+
+func (h Handler) ConfirmEmail() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request EmailConfirmRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err := h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		if err := h.service.ConfirmEmailChange(request.Token, audit.ClientFromRequest(r)); err != nil {
+			switch {
+			case errors.Is(err, ErrEmailTaken):
+				rest.Error(w, err, http.StatusConflict)
+			case errors.Is(err, ErrEmailChangeTokenInvalid):
+				rest.Error(w, err, http.StatusUnauthorized)
+			default:
+				rest.Error(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		rest.Success(w, http.StatusNoContent, nil)
+	}
+}
+
+func (h Handler) ChangePassword() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request PasswordChangeRequest
+		auth := authentication.Context(r)
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err := h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		err := h.service.ChangePassword(auth.AccountId, request.CurrentPassword, request.NewPassword, audit.ClientFromRequest(r))
+		if err != nil {
+			var policy *password.PolicyError
+			switch {
+			case errors.As(err, &policy):
+				rest.InvalidFields(w, err, map[string][]string{"new_password": policy.Violations})
+			case errors.Is(err, password.ErrMismatch):
+				rest.Error(w, err, http.StatusUnauthorized)
+			default:
+				rest.Error(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// Any other device still logged in may belong to whoever knew the old password.
+		if err = h.sessions.RevokeOthers(auth.AccountId, auth.SessionId); err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		rest.Success(w, http.StatusNoContent, nil)
+	}
+}
+
+// ChangeRole is only available to admins.
+func (h Handler) ChangeRole() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request RoleChangeRequest
+		auth := authentication.Context(r)
+
+		accountId, err := uid.FromString(chi.URLParam(r, "account_id"))
+		if err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		if err = json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err = h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		demoted, err := h.service.ChangeRole(auth.AccountId, accountId, request.Role, audit.ClientFromRequest(r))
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrOwnRole):
+				rest.Error(w, err, http.StatusUnprocessableEntity)
+			case errors.Is(err, sql.ErrNoRows):
+				rest.Error(w, err, http.StatusNotFound)
+			default:
+				rest.Error(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// Roles are carried in access tokens, a demotion must not wait for them to expire.
+		if demoted {
+			if err = h.sessions.RevokeAll(accountId); err != nil {
+				rest.Error(w, err, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		rest.Success(w, http.StatusNoContent, nil)
+	}
+}
+
+func (h Handler) Delete() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request DeleteRequest
+		auth := authentication.Context(r)
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err := h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		deleted, err := h.service.Delete(auth.AccountId, request.Password, audit.ClientFromRequest(r))
+		if err != nil {
+			if errors.Is(err, password.ErrMismatch) {
+				rest.Error(w, err, http.StatusUnauthorized)
+				return
+			}
+
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		// The deletion is confirmed through the emailed link.
+		if !deleted {
+			rest.Success(w, http.StatusAccepted, nil)
+			return
+		}
+
+		if err = h.sessions.RevokeAll(auth.AccountId); err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		authentication.ClearCookies(w)
+
+		rest.Success(w, http.StatusNoContent, nil)
+	}
+}
+
+func (h Handler) ConfirmDelete() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request DeleteConfirmRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err := h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		accountId, err := h.service.ConfirmDeletion(request.Token, audit.ClientFromRequest(r))
+		if err != nil {
+			if errors.Is(err, ErrDeletionTokenInvalid) {
+				rest.Error(w, err, http.StatusUnauthorized)
+				return
+			}
+
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		if err = h.sessions.RevokeAll(accountId); err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		authentication.ClearCookies(w)
+
+		rest.Success(w, http.StatusNoContent, nil)
+	}
+}
+
+func (h Handler) OAuthStart() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := h.providers[chi.URLParam(r, "provider")]
+		if !ok {
+			rest.Error(w, errors.New("unknown identity provider"), http.StatusNotFound)
+			return
+		}
+
+		// state, nonce and the PKCE code verifier are each made of independent random values.
+		values := make([]string, 3)
+		for i := range values {
+			value, err := token.NewOpaqueToken(32)
+			if err != nil {
+				rest.Error(w, err, http.StatusInternalServerError)
+				return
+			}
+			values[i] = value
+		}
+		state, nonce, codeVerifier := values[0], values[1], values[2]
+
+		stateToken, err := token.NewOAuthStateToken(token.OAuthStateCustomClaims{
+			Provider:     provider.Name(),
+			State:        state,
+			Nonce:        nonce,
+			CodeVerifier: codeVerifier,
+		})
+		if err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		authURL, err := provider.AuthCodeURL(state, nonce, codeVerifier)
+		if err != nil {
+			rest.Error(w, err, http.StatusBadGateway)
+			return
+		}
+
+		// Lax, since the cookie has to be sent along with the cross-site redirect back from the provider.
+		http.SetCookie(w, &http.Cookie{
+			Name:     OAuthStateCookie,
+			Value:    stateToken,
+			Path:     OAuthStatePath,
+			MaxAge:   int(token.OAuthStateTokenValidFor.Seconds()),
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+func (h Handler) OAuthCallback() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := h.providers[chi.URLParam(r, "provider")]
+		if !ok {
+			rest.Error(w, errors.New("unknown identity provider"), http.StatusNotFound)
+			return
+		}
+
+		cookie, err := r.Cookie(OAuthStateCookie)
+		if err != nil {
+			rest.Error(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{Name: OAuthStateCookie, Path: OAuthStatePath, MaxAge: -1})
+
+		state, err := token.VerifyOAuthStateToken(cookie.Value)
+		if err != nil {
+			rest.Error(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		query := r.URL.Query()
+		if state.Provider != provider.Name() {
+			rest.Error(w, oidc.ErrStateMismatch, http.StatusUnauthorized)
+			return
+		}
+
+		if err = oidc.VerifyState(state.State, query.Get("state")); err != nil {
+			rest.Error(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		if query.Get("error") != "" {
+			rest.Error(w, errors.New(query.Get("error")), http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := provider.Exchange(query.Get("code"), state.CodeVerifier, state.Nonce)
+		if err != nil {
+			rest.Error(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		account, err := h.service.ExternalLogin(Identity{
+			Provider:      provider.Name(),
+			Subject:       claims.Subject,
+			Email:         claims.Email,
+			EmailVerified: bool(claims.EmailVerified),
+			Name:          claims.Name,
+		}, audit.ClientFromRequest(r))
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrEmailNotVerified):
+				rest.Error(w, err, http.StatusForbidden)
+			case errors.Is(err, ErrRegistrationClosed):
+				rest.Forbidden(w, err, ReasonRegistrationClosed)
+			case errors.Is(err, ErrAccountDeleted):
+				rest.Error(w, err, http.StatusUnauthorized)
+			default:
+				rest.Error(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		factors, err := h.service.SecondFactors(account)
+		if err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		if len(factors) != 0 {
+			challenge, err := h.service.NewLoginChallenge(account)
+			if err != nil {
+				rest.Error(w, err, http.StatusInternalServerError)
+				return
+			}
+
+			redirectURL := fmt.Sprintf("%s/login/2fa?challenge=%s&methods=%s",
+				os.Getenv("CLIENT_URL"), url.QueryEscape(challenge), url.QueryEscape(strings.Join(factors, ",")))
+			http.Redirect(w, r, redirectURL, http.StatusFound)
+			return
+		}
+
+		if err = h.newSession(w, r, account); err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, os.Getenv("CLIENT_URL"), http.StatusFound)
+	}
+}
+
+func (h Handler) Refresh() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		refreshToken, err := authentication.ReadRefreshCookie(r)
+		if err != nil {
+			rest.Error(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		session, refreshToken, err := h.sessions.Refresh(refreshToken, rest.ClientIP(r))
+		if err != nil {
+			rest.Error(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		account, err := h.service.ByAccountId(session.AccountId)
+		if err != nil {
+			rest.Error(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		if err = h.setCookies(w, account, session, refreshToken); err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		rest.Success(w, http.StatusOK, &RefreshResponse{
+			Account: account,
+		})
+	}
+}
+
+func (h Handler) Logout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Logging out must succeed even when the access token has already expired,
+		// so the session is looked up by whichever cookie is still available.
+		if refreshToken, err := authentication.ReadRefreshCookie(r); err == nil {
+			_ = h.sessions.RevokeByRefreshToken(refreshToken)
+		}
+
+		if claims, err := authentication.ReadCookie(r); err == nil {
+			_ = h.sessions.Revoke(claims.AccountId, claims.SessionId)
+		}
+
+		authentication.ClearCookies(w)
+
+		rest.Success(w, http.StatusNoContent, nil)
+	}
+}
+
+func (h Handler) Sessions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := authentication.Context(r)
+
+		activeSessions, err := h.sessions.ActiveSessions(auth.AccountId)
+		if err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		rest.Success(w, http.StatusOK, &SessionsResponse{
+			CurrentSessionId: auth.SessionId,
+			Sessions:         activeSessions,
+		})
+	}
+}
+
+func (h Handler) RevokeSession() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := authentication.Context(r)
+
+		sessionId, err := uid.FromString(chi.URLParam(r, "session_id"))
+		if err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		if err = h.sessions.Revoke(auth.AccountId, sessionId); err != nil {
+			rest.Error(w, err, http.StatusNotFound)
+			return
+		}
+
+		if sessionId == auth.SessionId {
+			authentication.ClearCookies(w)
+		}
+
+		rest.Success(w, http.StatusNoContent, nil)
+	}
+}
+
+func (h Handler) RevokeSessions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := authentication.Context(r)
+
+		if err := h.sessions.RevokeAll(auth.AccountId); err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		authentication.ClearCookies(w)
+
+		rest.Success(w, http.StatusNoContent, nil)
+	}
+}
+
+// completeLogin starts a session for an account which passed the first authentication factor.
+// When the account has a second factor (TOTP or a passkey), the access cookie is withheld until
+// the second factor is verified and a challenge is returned instead.
+func (h Handler) completeLogin(w http.ResponseWriter, r *http.Request, account Account) {
+	factors, err := h.service.SecondFactors(account)
+	if err != nil {
+		rest.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if len(factors) != 0 {
+		challenge, err := h.service.NewLoginChallenge(account)
+		if err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		rest.Success(w, http.StatusOK, &LoginResponse{
+			Account:           account,
+			TwoFactorRequired: true,
+			TwoFactorMethods:  factors,
+			Challenge:         challenge,
+		})
+		return
+	}
+
+	if err := h.newSession(w, r, account); err != nil {
+		rest.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	rest.Success(w, http.StatusOK, &LoginResponse{
+		Account: account,
+	})
+}
+
+// newSession starts a new session for the account and issues both the access and refresh cookies.
+func (h Handler) newSession(w http.ResponseWriter, r *http.Request, account Account) error {
+	session, refreshToken, err := h.sessions.NewSession(account.Id, r.UserAgent(), rest.ClientIP(r))
+	if err != nil {
+		return err
+	}
+
+	return h.setCookies(w, account, session, refreshToken)
+}
+
+func (h Handler) setCookies(w http.ResponseWriter, account Account, session sessions.Session, refreshToken string) error {
+	if err := authentication.SetCookie(w, h.claims(account, session.Id)); err != nil {
+		return err
+	}
+
+	authentication.SetRefreshCookie(w, refreshToken, session.ExpiresAt)
+
+	return nil
+}
+
+func (Handler) claims(account Account, sessionId uid.UID) authentication.CustomClaims {
+	return authentication.CustomClaims{
+		AccountId:     account.Id,
+		AccountActive: account.Active,
+		SessionId:     sessionId,
+		Role:          account.Role,
+	}
+}
+
+func NewHandler(s *Service, ss *sessions.Service, p []*oidc.Provider, v *validate.Validate) *Handler {
+	providers := make(map[string]*oidc.Provider)
+	for _, provider := range p {
+		providers[provider.Name()] = provider
+	}
+
+	return &Handler{s, ss, providers, v}
 }
@@ -6,37 +6,114 @@ import (
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 
 	"atraf-server/pkg/uid"
+	"atraf-server/pkg/webauthn"
 )
 
 type PostgresAccount struct {
+	Uuid                uid.UID        `db:"uuid"`
+	Email               string         `db:"email"`
+	PasswordHash        []byte         `db:"password_hash"`
+	Active              bool           `db:"active"`
+	ActivationCode      sql.NullString `db:"activation_code"`
+	ActivationSentAt    time.Time      `db:"activation_sent_at"`
+	ActivationResends   int            `db:"activation_resends"`
+	ActivationExpiresAt time.Time      `db:"activation_expires_at"`
+	ActivationAttempts  int            `db:"activation_attempts"`
+	TOTPSecret          sql.NullString `db:"totp_secret"`
+	TOTPEnabled         bool           `db:"totp_enabled"`
+	TOTPLastStep        sql.NullInt64  `db:"totp_last_step"`
+	Role                string         `db:"role"`
+	CreatedAt           time.Time      `db:"created_at"`
+	UpdatedAt           sql.NullTime   `db:"updated_at"`
+	DeletedAt           sql.NullTime   `db:"deleted_at"`
+}
+
+type PostgresPasskey struct {
 	Uuid           uid.UID        `db:"uuid"`
-	Email          string         `db:"email"`
-	PasswordHash   []byte         `db:"password_hash"`
-	Active         bool           `db:"active"`
-	ActivationCode sql.NullString `db:"activation_code"`
-	Nickname       string         `db:"nickname"`
+	AccountUuid    uid.UID        `db:"account_uuid"`
+	CredentialId   []byte         `db:"credential_id"`
+	Name           string         `db:"name"`
+	PublicKey      []byte         `db:"public_key"`
+	Algorithm      int64          `db:"algorithm"`
+	SignCount      int64          `db:"sign_count"`
+	AAGUID         []byte         `db:"aaguid"`
+	Transports     pq.StringArray `db:"transports"`
+	BackupEligible bool           `db:"backup_eligible"`
+	LastUsedAt     sql.NullTime   `db:"last_used_at"`
 	CreatedAt      time.Time      `db:"created_at"`
-	UpdatedAt      sql.NullTime   `db:"updated_at"`
-	DeletedAt      sql.NullTime   `db:"deleted_at"`
+}
+
+type PostgresWebAuthnChallenge struct {
+	Uuid        uid.UID   `db:"uuid"`
+	AccountUuid *uid.UID  `db:"account_uuid"`
+	Purpose     string    `db:"purpose"`
+	Challenge   []byte    `db:"challenge"`
+	ExpiresAt   time.Time `db:"expires_at"`
+	CreatedAt   time.Time `db:"created_at"`
 }
 
 type Postgres struct {
 	db *sqlx.DB
 }
 
-func (p Postgres) Insert(email string, nickname string, passwordHash []byte) (Account, error) {
+func (p Postgres) Insert(tx *sqlx.Tx, email string, passwordHash []byte) (Account, error) {
+	var account PostgresAccount
+
+	query := `INSERT INTO accounts (email, password_hash) VALUES ($1, $2) RETURNING *`
+	if err := tx.Get(&account, query, email, passwordHash); err != nil {
+		return Account{}, err
+	}
+
+	return prepareOne(account), nil
+}
+
+// InsertExternal inserts an account authenticated by an external identity provider.
+// The account is active since the provider verified the email, and has no usable password.
+func (p Postgres) InsertExternal(tx *sqlx.Tx, email string) (Account, error) {
+	var account PostgresAccount
+
+	query := `
+	INSERT INTO accounts (email, password_hash, active, activation_code)
+	VALUES ($1, '', true, NULL)
+	RETURNING *`
+
+	if err := tx.Get(&account, query, email); err != nil {
+		return Account{}, err
+	}
+
+	return prepareOne(account), nil
+}
+
+func (p Postgres) ByIdentity(provider string, subject string) (Account, error) {
 	var account PostgresAccount
 
-	query := `INSERT INTO accounts (email, password_hash, nickname) VALUES ($1, $2, $3) RETURNING *`
-	if err := p.db.Get(&account, query, email, passwordHash, nickname); err != nil {
+	query := `
+	SELECT accounts.*
+	FROM accounts
+	JOIN account_identities ON account_identities.account_uuid = accounts.uuid
+	WHERE account_identities.provider = $1
+	  AND account_identities.subject = $2
+	LIMIT 1`
+
+	if err := p.db.Get(&account, query, provider, subject); err != nil {
 		return Account{}, err
 	}
 
 	return prepareOne(account), nil
 }
 
+func (p Postgres) InsertIdentity(tx *sqlx.Tx, accountId uid.UID, provider string, subject string, email string) error {
+	query := `INSERT INTO account_identities (account_uuid, provider, subject, email) VALUES ($1, $2, $3, $4)`
+	if _, err := tx.Exec(query, accountId, provider, subject, email); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (p Postgres) ByEmail(email string) (Account, error) {
 	var account PostgresAccount
 
@@ -59,23 +136,46 @@ func (p Postgres) ByAccountId(accountId uid.UID) (Account, error) {
 	return prepareOne(account), nil
 }
 
-func (p Postgres) SetPending(accountId uid.UID) (string, error) {
+func (p Postgres) SetPending(accountId uid.UID, expiresAt time.Time) (string, error) {
 	var code string
 
 	query := `
 	UPDATE accounts 
 	SET active = false, 
-	    activation_code = DEFAULT
+	    activation_code = DEFAULT,
+	    activation_expires_at = $2,
+	    activation_attempts = 0,
+	    activation_sent_at = current_timestamp,
+	    activation_resends = CASE
+	        WHEN activation_sent_at :: date = current_date THEN activation_resends + 1
+	        ELSE 1
+	    END
 	WHERE uuid = $1
 	RETURNING activation_code`
 
-	if err := p.db.Get(&code, query, accountId); err != nil {
+	if err := p.db.Get(&code, query, accountId, expiresAt); err != nil {
 		return code, err
 	}
 
 	return code, nil
 }
 
+func (p Postgres) IncrementActivationAttempts(accountId uid.UID) (int, error) {
+	var attempts int
+
+	query := `
+	UPDATE accounts
+	SET activation_attempts = activation_attempts + 1
+	WHERE uuid = $1
+	RETURNING activation_attempts`
+
+	if err := p.db.Get(&attempts, query, accountId); err != nil {
+		return attempts, err
+	}
+
+	return attempts, nil
+}
+
 func (p Postgres) SetActive(accountId uid.UID, activationCode string) error {
 	query := `
 	UPDATE accounts 
@@ -83,7 +183,8 @@ func (p Postgres) SetActive(accountId uid.UID, activationCode string) error {
 	    activation_code = NULL
 	WHERE uuid = $1 
 	  AND active = false
-	  AND activation_code = $2`
+	  AND activation_code = $2
+	  AND activation_expires_at > current_timestamp`
 
 	result, err := p.db.Exec(query, accountId, activationCode)
 	if err != nil {
@@ -102,6 +203,57 @@ func (p Postgres) SetActive(accountId uid.UID, activationCode string) error {
 	return nil
 }
 
+// ActivateClaimed activates a never activated account without an activation code, for when email
+// ownership was proven by other means. Whoever registered the account didn't necessarily own the email,
+// so the password, second factors and sessions they set up are discarded along the way.
+func (p Postgres) ActivateClaimed(accountId uid.UID) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE accounts
+	SET active = true,
+	    activation_code = NULL,
+	    password_hash = '',
+	    totp_secret = NULL,
+	    totp_enabled = false
+	WHERE uuid = $1
+	  AND active = false`
+
+	result, err := tx.Exec(query, accountId)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	// Activated in the meantime, by its owner.
+	if rows == 0 {
+		return nil
+	}
+
+	queries := []string{
+		`DELETE FROM recovery_codes WHERE account_uuid = $1`,
+		`DELETE FROM webauthn_credentials WHERE account_uuid = $1`,
+		`DELETE FROM webauthn_challenges WHERE account_uuid = $1`,
+		`UPDATE sessions SET revoked_at = current_timestamp WHERE account_uuid = $1 AND revoked_at IS NULL`,
+	}
+
+	for _, query := range queries {
+		if _, err = tx.Exec(query, accountId); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 func (p Postgres) UpdatePassword(accountId uid.UID, passwordHash []byte) error {
 	query := `UPDATE accounts SET password_hash = $2 WHERE uuid = $1`
 
@@ -122,16 +274,440 @@ func (p Postgres) UpdatePassword(accountId uid.UID, passwordHash []byte) error {
 	return nil
 }
 
+func (p Postgres) UpdateRole(accountId uid.UID, role string) error {
+	query := `UPDATE accounts SET role = $2, updated_at = current_timestamp WHERE uuid = $1`
+
+	result, err := p.db.Exec(query, accountId, role)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return errors.New("role couldn't be updated")
+	}
+
+	return nil
+}
+
+func (p Postgres) SetTOTPSecret(accountId uid.UID, secret string) error {
+	query := `UPDATE accounts SET totp_secret = $2, totp_enabled = false, totp_last_step = NULL WHERE uuid = $1`
+	if _, err := p.db.Exec(query, accountId, secret); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// EnableTOTP enables two-factor authentication and replaces the recovery codes in a single transaction.
+func (p Postgres) EnableTOTP(accountId uid.UID, recoveryCodeHashes []string) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE accounts SET totp_enabled = true WHERE uuid = $1 AND totp_secret IS NOT NULL`
+	if _, err = tx.Exec(query, accountId); err != nil {
+		return err
+	}
+
+	query = `DELETE FROM recovery_codes WHERE account_uuid = $1`
+	if _, err = tx.Exec(query, accountId); err != nil {
+		return err
+	}
+
+	query = `INSERT INTO recovery_codes (account_uuid, code_hash) VALUES ($1, $2)`
+	for _, hash := range recoveryCodeHashes {
+		if _, err = tx.Exec(query, accountId, hash); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (p Postgres) UseRecoveryCode(accountId uid.UID, codeHash string) error {
+	query := `
+	UPDATE recovery_codes
+	SET used_at = current_timestamp
+	WHERE account_uuid = $1
+	  AND code_hash = $2
+	  AND used_at IS NULL`
+
+	result, err := p.db.Exec(query, accountId, codeHash)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return errors.New("recovery code couldn't be used")
+	}
+
+	return nil
+}
+
+// UseTOTPStep records the time step of an accepted TOTP code,
+// provided it comes after the last accepted one so a code can't be replayed.
+func (p Postgres) UseTOTPStep(accountId uid.UID, step int64) error {
+	query := `
+	UPDATE accounts
+	SET totp_last_step = $2
+	WHERE uuid = $1
+	  AND (totp_last_step IS NULL OR totp_last_step < $2)`
+
+	result, err := p.db.Exec(query, accountId, step)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return errors.New("totp code was already used")
+	}
+
+	return nil
+}
+
+// UpdateEmail updates the account email along with the copy kept on the user profile.
+// Both rows are updated in a single transaction so they never diverge.
+func (p Postgres) UpdateEmail(accountId uid.UID, email string) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE accounts SET email = $2, updated_at = current_timestamp WHERE uuid = $1`
+	result, err := tx.Exec(query, accountId, email)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return errors.New("email couldn't be updated")
+	}
+
+	query = `UPDATE users SET email = $2, updated_at = current_timestamp WHERE account_uuid = $1`
+	if _, err = tx.Exec(query, accountId, email); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SoftDelete marks both the account and its user profile as deleted.
+func (p Postgres) SoftDelete(accountId uid.UID) error {
+	return p.setDeletedAt(accountId, "current_timestamp")
+}
+
+// Restore reverts SoftDelete.
+func (p Postgres) Restore(accountId uid.UID) error {
+	return p.setDeletedAt(accountId, "NULL")
+}
+
+func (p Postgres) setDeletedAt(accountId uid.UID, value string) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE accounts SET deleted_at = ` + value + ` WHERE uuid = $1`
+	if _, err = tx.Exec(query, accountId); err != nil {
+		return err
+	}
+
+	query = `UPDATE users SET deleted_at = ` + value + ` WHERE account_uuid = $1`
+	if _, err = tx.Exec(query, accountId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p Postgres) DeletedBefore(cutoff time.Time) ([]Account, error) {
+	var accounts []PostgresAccount
+
+	query := `SELECT * FROM accounts WHERE deleted_at < $1`
+	if err := p.db.Select(&accounts, query, cutoff); err != nil {
+		return nil, err
+	}
+
+	result := make([]Account, 0)
+	for _, account := range accounts {
+		result = append(result, prepareOne(account))
+	}
+
+	return result, nil
+}
+
+// Delete permanently deletes the account along with its recovery codes, passkeys, linked identities,
+// invites and own invite redemption, webhooks, single use and access tokens. The redemptions of
+// the accounts it invited are kept, without the inviter.
+// The user profile, nickname history included, is deleted beforehand by users.Service.PurgeUser.
+func (p Postgres) Delete(accountId uid.UID) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queries := []string{
+		`DELETE FROM recovery_codes WHERE account_uuid = $1`,
+		`DELETE FROM single_use_tokens WHERE account_uuid = $1`,
+		`DELETE FROM access_tokens WHERE account_uuid = $1`,
+		`DELETE FROM webauthn_credentials WHERE account_uuid = $1`,
+		`DELETE FROM webauthn_challenges WHERE account_uuid = $1`,
+		`DELETE FROM invites WHERE account_uuid = $1`,
+		`DELETE FROM invite_redemptions WHERE account_uuid = $1`,
+		`UPDATE invite_redemptions SET invited_by = NULL WHERE invited_by = $1`,
+		`DELETE FROM account_identities WHERE account_uuid = $1`,
+		`DELETE FROM webhook_deliveries WHERE webhook_uuid IN (SELECT uuid FROM webhooks WHERE account_uuid = $1)`,
+		`DELETE FROM webhooks WHERE account_uuid = $1`,
+		`DELETE FROM accounts WHERE uuid = $1`,
+	}
+
+	for _, query := range queries {
+		if _, err = tx.Exec(query, accountId); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (p Postgres) InsertSingleUseToken(accountId uid.UID, purpose string) (uid.UID, error) {
+	var uuid uid.UID
+
+	query := `INSERT INTO single_use_tokens (account_uuid, purpose) VALUES ($1, $2) RETURNING uuid`
+	if err := p.db.Get(&uuid, query, accountId, purpose); err != nil {
+		return uuid, err
+	}
+
+	return uuid, nil
+}
+
+func (p Postgres) ConsumeSingleUseToken(tokenId uid.UID, accountId uid.UID, purpose string) error {
+	query := `
+	UPDATE single_use_tokens
+	SET used_at = current_timestamp
+	WHERE uuid = $1
+	  AND account_uuid = $2
+	  AND purpose = $3
+	  AND used_at IS NULL`
+
+	result, err := p.db.Exec(query, tokenId, accountId, purpose)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return errors.New("token was already used")
+	}
+
+	return nil
+}
+
+func (p Postgres) InsertPasskey(accountId uid.UID, name string, c webauthn.Credential) (Passkey, error) {
+	var passkey PostgresPasskey
+
+	query := `
+	INSERT INTO webauthn_credentials (account_uuid, credential_id, name, public_key, algorithm, sign_count, aaguid, transports, backup_eligible)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	RETURNING *`
+
+	err := p.db.Get(&passkey, query,
+		accountId,
+		c.ID,
+		name,
+		c.PublicKey,
+		c.Algorithm,
+		int64(c.SignCount),
+		c.AAGUID,
+		pq.StringArray(c.Transports),
+		c.BackupEligible,
+	)
+	if err != nil {
+		return Passkey{}, err
+	}
+
+	return preparePasskey(passkey), nil
+}
+
+func (p Postgres) PasskeysByAccountId(accountId uid.UID) ([]Passkey, error) {
+	var passkeys []PostgresPasskey
+
+	query := `SELECT * FROM webauthn_credentials WHERE account_uuid = $1 ORDER BY created_at`
+	if err := p.db.Select(&passkeys, query, accountId); err != nil {
+		return nil, err
+	}
+
+	result := make([]Passkey, 0)
+	for _, passkey := range passkeys {
+		result = append(result, preparePasskey(passkey))
+	}
+
+	return result, nil
+}
+
+func (p Postgres) PasskeyByCredentialId(credentialId []byte) (Passkey, error) {
+	var passkey PostgresPasskey
+
+	query := `SELECT * FROM webauthn_credentials WHERE credential_id = $1 LIMIT 1`
+	if err := p.db.Get(&passkey, query, credentialId); err != nil {
+		return Passkey{}, err
+	}
+
+	return preparePasskey(passkey), nil
+}
+
+// UsePasskey stores the signature counter of the latest assertion.
+func (p Postgres) UsePasskey(passkeyId uid.UID, signCount uint32) error {
+	query := `
+	UPDATE webauthn_credentials
+	SET sign_count = $2,
+	    last_used_at = current_timestamp
+	WHERE uuid = $1`
+
+	if _, err := p.db.Exec(query, passkeyId, int64(signCount)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p Postgres) DeletePasskey(accountId uid.UID, passkeyId uid.UID) error {
+	query := `DELETE FROM webauthn_credentials WHERE uuid = $1 AND account_uuid = $2`
+
+	result, err := p.db.Exec(query, passkeyId, accountId)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// InsertWebAuthnChallenge stores a ceremony challenge, accountId is Nil for passwordless logins.
+func (p Postgres) InsertWebAuthnChallenge(accountId uid.UID, purpose string, challenge []byte, expiresAt time.Time) (uid.UID, error) {
+	var uuid uid.UID
+
+	var account *uid.UID
+	if accountId != uid.Nil {
+		account = &accountId
+	}
+
+	query := `
+	INSERT INTO webauthn_challenges (account_uuid, purpose, challenge, expires_at)
+	VALUES ($1, $2, $3, $4)
+	RETURNING uuid`
+
+	if err := p.db.Get(&uuid, query, account, purpose, challenge, expiresAt); err != nil {
+		return uuid, err
+	}
+
+	return uuid, nil
+}
+
+// ConsumeWebAuthnChallenge deletes the challenge and returns it, provided it hasn't expired.
+// Deleting makes sure a challenge is only ever answered once.
+func (p Postgres) ConsumeWebAuthnChallenge(challengeId uid.UID, purpose string) (WebAuthnChallenge, error) {
+	var challenge PostgresWebAuthnChallenge
+
+	query := `
+	DELETE FROM webauthn_challenges
+	WHERE uuid = $1
+	  AND purpose = $2
+	RETURNING *`
+
+	if err := p.db.Get(&challenge, query, challengeId, purpose); err != nil {
+		return WebAuthnChallenge{}, err
+	}
+
+	if time.Now().UTC().After(challenge.ExpiresAt) {
+		return WebAuthnChallenge{}, sql.ErrNoRows
+	}
+
+	result := WebAuthnChallenge{
+		Id:        challenge.Uuid,
+		Purpose:   challenge.Purpose,
+		Challenge: challenge.Challenge,
+		ExpiresAt: challenge.ExpiresAt,
+	}
+
+	if challenge.AccountUuid != nil {
+		result.AccountId = *challenge.AccountUuid
+	}
+
+	return result, nil
+}
+
+func preparePasskey(pp PostgresPasskey) Passkey {
+	return Passkey{
+		Id:             pp.Uuid,
+		AccountId:      pp.AccountUuid,
+		CredentialId:   pp.CredentialId,
+		Name:           pp.Name,
+		PublicKey:      pp.PublicKey,
+		Algorithm:      pp.Algorithm,
+		SignCount:      uint32(pp.SignCount),
+		AAGUID:         pp.AAGUID,
+		Transports:     pp.Transports,
+		BackupEligible: pp.BackupEligible,
+		LastUsedAt:     pp.LastUsedAt.Time,
+		CreatedAt:      pp.CreatedAt,
+	}
+}
+
 func prepareOne(pa PostgresAccount) Account {
 	return Account{
-		Id:             pa.Uuid,
-		Email:          pa.Email,
-		PasswordHash:   pa.PasswordHash,
-		Active:         pa.Active,
-		ActivationCode: pa.ActivationCode.String,
-		Nickname:       pa.Nickname,
-		CreatedAt:      pa.CreatedAt,
-		UpdatedAt:      pa.UpdatedAt.Time,
+		Id:                  pa.Uuid,
+		Email:               pa.Email,
+		PasswordHash:        pa.PasswordHash,
+		Active:              pa.Active,
+		ActivationCode:      pa.ActivationCode.String,
+		ActivationSentAt:    pa.ActivationSentAt,
+		ActivationResends:   pa.ActivationResends,
+		ActivationExpiresAt: pa.ActivationExpiresAt,
+		ActivationAttempts:  pa.ActivationAttempts,
+		TOTPSecret:          pa.TOTPSecret.String,
+		TOTPEnabled:         pa.TOTPEnabled,
+		Role:                pa.Role,
+		CreatedAt:           pa.CreatedAt,
+		UpdatedAt:           pa.UpdatedAt.Time,
+		DeletedAt:           pa.DeletedAt.Time,
 	}
 }
 
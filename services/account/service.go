@@ -1,133 +1,1399 @@
 package account
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
 	"net/mail"
 	"os"
+	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/jmoiron/sqlx"
 
+	"atraf-server/services/audit"
+	"atraf-server/services/events"
+	"atraf-server/services/invites"
+	"atraf-server/services/users"
+
+	"atraf-server/pkg/authorization"
+	"atraf-server/pkg/database"
+	"atraf-server/pkg/limiter"
 	"atraf-server/pkg/mailer"
+	"atraf-server/pkg/password"
 	"atraf-server/pkg/token"
+	"atraf-server/pkg/totp"
 	"atraf-server/pkg/uid"
+	"atraf-server/pkg/webauthn"
+)
+
+const (
+	ActivationCodeValidFor   = time.Hour
+	ActivationMaxAttempts    = 5
+	ActivationResendCooldown = time.Minute
+	ActivationResendDailyCap = 5
+
+	TwoFactorIssuer   = "Atraf"
+	RecoveryCodeCount = 10
+
+	// DummyPassword is hashed once to compare against when logging in with an unknown email.
+	DummyPassword = "atraf-dummy-password"
+
+	PasswordResetPurpose  = "password_reset"
+	EmailChangePurpose    = "email_change"
+	MagicLinkPurpose      = "magic_link"
+	LoginChallengePurpose = "login_challenge"
+	DeletionPurpose       = "deletion"
+
+	PasskeyRegistrationPurpose = "passkey_registration"
+	PasskeyLoginPurpose        = "passkey_login"
+)
+
+// Second factors a login can be completed with.
+const (
+	SecondFactorTOTP    = "totp"
+	SecondFactorPasskey = "passkey"
+)
+
+// Registration modes.
+const (
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+	RegistrationClosed = "closed"
+)
+
+var (
+	ErrAccountActive         = errors.New("account is already active")
+	ErrActivationCodeInvalid = errors.New("activation code is invalid")
+	ErrActivationCodeExpired = errors.New("activation code has expired")
+	ErrActivationLocked      = errors.New("activation code is locked after too many invalid attempts")
+
+	ErrTwoFactorEnabled      = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotSetUp     = errors.New("two-factor authentication was not set up")
+	ErrTwoFactorCodeInvalid  = errors.New("two-factor code is invalid")
+	ErrLoginChallengeInvalid = errors.New("login challenge is invalid, expired or was already used")
+
+	ErrResetTokenInvalid = errors.New("reset token is invalid, expired or was already used")
+
+	ErrInvalidCredentials = errors.New("email or password is invalid")
+
+	ErrAccountDeleted   = errors.New("account was deleted")
+	ErrEmailNotVerified = errors.New("identity provider email is not verified")
+
+	ErrEmailTaken              = errors.New("email is already in use")
+	ErrEmailChangeTokenInvalid = errors.New("email change token is invalid, expired or was already used")
+	ErrDeletionTokenInvalid    = errors.New("account deletion token is invalid, expired or was already used")
+
+	ErrMagicLinkInvalid = errors.New("sign-in link is invalid, expired or was already used")
+
+	ErrOwnRole = errors.New("accounts can't change their own role")
+
+	ErrRegistrationClosed = errors.New("registration is closed")
+	ErrInviteRequired     = errors.New("registration requires an invite code")
+
+	ErrPasskeyChallengeInvalid = errors.New("passkey challenge is invalid, expired or was already used")
+	ErrPasskeyInvalid          = errors.New("passkey is not registered or doesn't belong to the account")
+	ErrPasskeyTaken            = errors.New("passkey is already registered")
+	ErrNoPasskeys              = errors.New("account has no passkeys")
 )
 
+// ThrottledError is returned when an action was attempted too often and may only be retried later.
+type ThrottledError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", e.Reason, e.RetryAfter.Round(time.Second))
+}
+
 type Account struct {
-	Id             uid.UID   `json:"-"`
-	Email          string    `json:"-"`
-	PasswordHash   []byte    `json:"-"`
-	ActivationCode string    `json:"-"`
-	Active         bool      `json:"active"`
-	Nickname       string    `json:"-"`
-	CreatedAt      time.Time `json:"-"`
-	UpdatedAt      time.Time `json:"-"`
+	Id                  uid.UID   `json:"-"`
+	Email               string    `json:"-"`
+	PasswordHash        []byte    `json:"-"`
+	ActivationCode      string    `json:"-"`
+	ActivationSentAt    time.Time `json:"-"`
+	ActivationResends   int       `json:"-"`
+	ActivationExpiresAt time.Time `json:"-"`
+	ActivationAttempts  int       `json:"-"`
+	TOTPSecret          string    `json:"-"`
+	TOTPEnabled         bool      `json:"two_factor_enabled"`
+	Active              bool      `json:"active"`
+	Role                string    `json:"role"`
+	CreatedAt           time.Time `json:"-"`
+	UpdatedAt           time.Time `json:"-"`
+	DeletedAt           time.Time `json:"-"`
+}
+
+// Deleted reports whether the account was soft-deleted.
+func (a Account) Deleted() bool {
+	return !a.DeletedAt.IsZero()
+}
+
+// Passkey is a WebAuthn credential registered to an account.
+type Passkey struct {
+	Id             uid.UID   `json:"id"`
+	AccountId      uid.UID   `json:"-"`
+	CredentialId   []byte    `json:"-"`
+	Name           string    `json:"name"`
+	PublicKey      []byte    `json:"-"`
+	Algorithm      int64     `json:"-"`
+	SignCount      uint32    `json:"-"`
+	AAGUID         []byte    `json:"-"`
+	Transports     []string  `json:"-"`
+	BackupEligible bool      `json:"backup_eligible"`
+	LastUsedAt     time.Time `json:"last_used_at"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Descriptor identifies the passkey to the client, in allow and exclude lists.
+func (p Passkey) Descriptor() webauthn.Descriptor {
+	return webauthn.Descriptor{
+		Type:       webauthn.CredentialType,
+		ID:         p.CredentialId,
+		Transports: p.Transports,
+	}
+}
+
+// WebAuthnChallenge is the single use challenge of a registration or login ceremony.
+// AccountId is Nil for passwordless logins, and set when the passkey is used as a second factor.
+type WebAuthnChallenge struct {
+	Id        uid.UID
+	AccountId uid.UID
+	Purpose   string
+	Challenge []byte
+	ExpiresAt time.Time
+}
+
+// Identity is an account identity asserted by an external (OpenID Connect) provider.
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+type Config struct {
+	// DeletionGracePeriod is how long a deleted account can be reactivated by logging in,
+	// after which it is permanently purged.
+	DeletionGracePeriod time.Duration
+	// PasswordPolicy is enforced whenever a password is set.
+	PasswordPolicy password.Policy
+	// PasswordHasher hashes new passwords, existing hashes are upgraded to it on login.
+	PasswordHasher password.Hasher
+	// WebAuthn is the relying party passkeys are registered with.
+	WebAuthn webauthn.Config
+	// RegistrationMode is either RegistrationOpen, RegistrationInvite or RegistrationClosed.
+	// Accounts signing in with an external provider for the first time are only created when open.
+	RegistrationMode string
 }
 
 type Storage interface {
-	Insert(email string, nickname string, passwordHash []byte) (Account, error)
+	Insert(tx *sqlx.Tx, email string, passwordHash []byte) (Account, error)
+	InsertExternal(tx *sqlx.Tx, email string) (Account, error)
+	ByIdentity(provider string, subject string) (Account, error)
+	InsertIdentity(tx *sqlx.Tx, accountId uid.UID, provider string, subject string, email string) error
 	ByEmail(email string) (Account, error)
 	ByAccountId(accountId uid.UID) (Account, error)
-	SetPending(accountId uid.UID) (string, error)
+	SetPending(accountId uid.UID, expiresAt time.Time) (string, error)
+	IncrementActivationAttempts(accountId uid.UID) (int, error)
 	SetActive(accountId uid.UID, activationCode string) error
+	ActivateClaimed(accountId uid.UID) error
 	UpdatePassword(accountId uid.UID, passwordHash []byte) error
+	UpdateEmail(accountId uid.UID, email string) error
+	UpdateRole(accountId uid.UID, role string) error
+	SoftDelete(accountId uid.UID) error
+	Restore(accountId uid.UID) error
+	DeletedBefore(cutoff time.Time) ([]Account, error)
+	Delete(accountId uid.UID) error
+	SetTOTPSecret(accountId uid.UID, secret string) error
+	EnableTOTP(accountId uid.UID, recoveryCodeHashes []string) error
+	UseRecoveryCode(accountId uid.UID, codeHash string) error
+	UseTOTPStep(accountId uid.UID, step int64) error
+	InsertSingleUseToken(accountId uid.UID, purpose string) (uid.UID, error)
+	ConsumeSingleUseToken(tokenId uid.UID, accountId uid.UID, purpose string) error
+	InsertPasskey(accountId uid.UID, name string, credential webauthn.Credential) (Passkey, error)
+	PasskeysByAccountId(accountId uid.UID) ([]Passkey, error)
+	PasskeyByCredentialId(credentialId []byte) (Passkey, error)
+	UsePasskey(passkeyId uid.UID, signCount uint32) error
+	DeletePasskey(accountId uid.UID, passkeyId uid.UID) error
+	InsertWebAuthnChallenge(accountId uid.UID, purpose string, challenge []byte, expiresAt time.Time) (uid.UID, error)
+	ConsumeWebAuthnChallenge(challengeId uid.UID, purpose string) (WebAuthnChallenge, error)
+}
+
+type Service struct {
+	storage    Storage
+	users      *users.Service
+	invites    *invites.Service
+	transactor *database.Transactor
+	events     *events.Service
+	limiter    *limiter.Limiter
+	audit      *audit.Service
+	config     Config
+	// dummyHash is compared against when there is no password hash to compare against, see Login.
+	dummyHash []byte
+}
+
+func (s Service) ByAccountId(accountId uid.UID) (Account, error) {
+	return s.storage.ByAccountId(accountId)
+}
+
+// Register creates an account, subject to the registration mode. The invite code is required
+// in invite mode, and when given in open mode it is still redeemed to track who invited whom.
+func (s Service) Register(email string, nickname string, password string, inviteCode string, client audit.Client) (Account, error) {
+	switch {
+	case s.config.RegistrationMode == RegistrationClosed:
+		return Account{}, ErrRegistrationClosed
+	case s.config.RegistrationMode == RegistrationInvite && inviteCode == "":
+		return Account{}, ErrInviteRequired
+	}
+
+	// Dependency(Users)
+	nickname, err := users.ValidateNickname(nickname)
+	if err != nil {
+		return Account{}, err
+	}
+
+	if err = s.config.PasswordPolicy.Check(password, email, nickname); err != nil {
+		return Account{}, err
+	}
+
+	passwordHash, err := s.newPasswordHash(password)
+	if err != nil {
+		return Account{}, err
+	}
+
+	// The account and its user profile are only created together, and only when the invite is valid.
+	// The activation mail is sent by the AccountRegistered subscriber once committed.
+	var account Account
+	var invitedBy uid.UID
+	err = s.transactor.Transaction(func(tx *sqlx.Tx) error {
+		if account, err = s.storage.Insert(tx, email, passwordHash); err != nil {
+			return err
+		}
+
+		if inviteCode != "" {
+			if invitedBy, err = s.invites.Redeem(tx, inviteCode, account.Id); err != nil {
+				return err
+			}
+		}
+
+		if err = s.newUser(tx, account, nickname); err != nil {
+			return err
+		}
+
+		return s.events.Publish(tx, events.AccountRegistered, events.AccountRegisteredPayload{
+			AccountId: account.Id,
+		})
+	})
+	if err != nil {
+		return Account{}, err
+	}
+
+	var metadata map[string]string
+	if invitedBy != uid.Nil {
+		metadata = map[string]string{"invited_by": invitedBy.String()}
+	}
+
+	s.record(account.Id, audit.Registered, client, metadata)
+
+	return account, nil
+}
+
+// Login verifies the account credentials.
+// Attempts are throttled both per email address and per client IP, each attempt is reserved
+// before the password is compared and released when it succeeds. An account reaching
+// the lock threshold is notified by email.
+func (s Service) Login(email string, password string, client audit.Client) (Account, error) {
+	emailKey := "login:email:" + strings.ToLower(email)
+	ipKey := "login:ip:" + client.IP
+
+	_, wait, err := s.limiter.Reserve(ipKey)
+	if err != nil {
+		return Account{}, err
+	}
+
+	if wait > 0 {
+		return Account{}, &ThrottledError{"too many failed login attempts", wait}
+	}
+
+	record, wait, err := s.limiter.Reserve(emailKey)
+	if err != nil {
+		return Account{}, err
+	}
+
+	if wait > 0 {
+		return Account{}, &ThrottledError{"too many failed login attempts", wait}
+	}
+
+	account, err := s.storage.ByEmail(email)
+	if err == nil && len(account.PasswordHash) != 0 {
+		err = s.comparePasswordHash(password, account.PasswordHash)
+	} else if err == nil || errors.Is(err, sql.ErrNoRows) {
+		// Unknown emails and accounts without a password take as long as any other,
+		// so the response time doesn't tell which emails are registered.
+		_ = s.comparePasswordHash(password, s.dummyHash)
+		err = ErrInvalidCredentials
+	}
+
+	if err != nil {
+		s.record(account.Id, audit.LoginFailed, client, map[string]string{"email": email})
+
+		if s.limiter.Locked(record) && account.Id != uid.Nil {
+			s.record(account.Id, audit.AccountLocked, client, nil)
+
+			if mailErr := s.sendAccountLockedMail(account); mailErr != nil {
+				log.Println(mailErr)
+			}
+		}
+
+		return Account{}, err
+	}
+
+	if err = s.limiter.Reset(emailKey); err != nil {
+		return Account{}, err
+	}
+
+	if err = s.limiter.Release(ipKey); err != nil {
+		return Account{}, err
+	}
+
+	// Failing to upgrade the hash must not prevent logging in, it's retried next time.
+	if err = s.rehashPassword(account, password); err != nil {
+		log.Println(err)
+	}
+
+	if account, err = s.restoreDeleted(account, client); err != nil {
+		return Account{}, err
+	}
+
+	s.recordLogin(account, "password", client)
+
+	return account, nil
+}
+
+// ExternalLogin logs in using an identity asserted by an external provider.
+// Unknown identities are linked to the account registered with the same (verified) email,
+// or to a newly created account. A pending account is activated, see activateClaimed.
+func (s Service) ExternalLogin(identity Identity, client audit.Client) (account Account, err error) {
+	account, err = s.storage.ByIdentity(identity.Provider, identity.Subject)
+	if err == nil {
+		if account, err = s.restoreDeleted(account, client); err != nil {
+			return Account{}, err
+		}
+
+		s.recordLogin(account, identity.Provider, client)
+
+		return account, nil
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Account{}, err
+	}
+
+	// Linking by email is only safe when the provider vouches for the address.
+	if !identity.EmailVerified {
+		return Account{}, ErrEmailNotVerified
+	}
+
+	account, err = s.storage.ByEmail(identity.Email)
+	switch {
+	case err == nil:
+		if account, err = s.restoreDeleted(account, client); err != nil {
+			return Account{}, err
+		}
+
+		if !account.Active {
+			if account, err = s.activateClaimed(account, identity.Provider, client); err != nil {
+				return Account{}, err
+			}
+		}
+
+		err = s.transactor.Transaction(func(tx *sqlx.Tx) error {
+			return s.storage.InsertIdentity(tx, account.Id, identity.Provider, identity.Subject, identity.Email)
+		})
+		if err != nil {
+			return Account{}, err
+		}
+	case errors.Is(err, sql.ErrNoRows):
+		// External providers can't carry an invite code.
+		if s.config.RegistrationMode != RegistrationOpen {
+			return Account{}, ErrRegistrationClosed
+		}
+
+		nickname := identity.Name
+		if nickname == "" {
+			nickname = strings.Split(identity.Email, "@")[0]
+		}
+
+		err = s.transactor.Transaction(func(tx *sqlx.Tx) error {
+			// The provider's name may be anyone's nickname, it is only a suggestion.
+			// Dependency(Users)
+			if nickname, err = s.users.AvailableNickname(tx, nickname); err != nil {
+				return err
+			}
+
+			if account, err = s.storage.InsertExternal(tx, identity.Email); err != nil {
+				return err
+			}
+
+			if err = s.newUser(tx, account, nickname); err != nil {
+				return err
+			}
+
+			return s.storage.InsertIdentity(tx, account.Id, identity.Provider, identity.Subject, identity.Email)
+		})
+		if err != nil {
+			return Account{}, err
+		}
+
+		s.record(account.Id, audit.Registered, client, map[string]string{"provider": identity.Provider})
+	default:
+		return Account{}, err
+	}
+
+	s.recordLogin(account, identity.Provider, client)
+
+	return account, nil
+}
+
+// SendMagicLink mails a single use sign-in link to the account, requests are throttled per email and client IP.
+func (s Service) SendMagicLink(email string, client audit.Client) error {
+	if err := s.reserveMail("magic_link", email, client); err != nil {
+		return err
+	}
+
+	account, err := s.storage.ByEmail(email)
+	if err != nil {
+		return err
+	}
+
+	if account.Deleted() && time.Since(account.DeletedAt) > s.config.DeletionGracePeriod {
+		return ErrAccountDeleted
+	}
+
+	s.record(account.Id, audit.MagicLinkSent, client, nil)
+
+	return s.sendMagicLinkMail(account)
+}
+
+// MagicLogin logs in using a sign-in link token.
+// Following the link proves email ownership, so a pending account gets activated as well, see activateClaimed.
+func (s Service) MagicLogin(magicLinkToken string, client audit.Client) (Account, error) {
+	claims, err := token.VerifyMagicLinkToken(magicLinkToken)
+	if err != nil {
+		return Account{}, ErrMagicLinkInvalid
+	}
+
+	tokenId, err := uid.FromString(claims.Id)
+	if err != nil {
+		return Account{}, ErrMagicLinkInvalid
+	}
+
+	if err = s.storage.ConsumeSingleUseToken(tokenId, claims.AccountId, MagicLinkPurpose); err != nil {
+		return Account{}, ErrMagicLinkInvalid
+	}
+
+	account, err := s.storage.ByAccountId(claims.AccountId)
+	if err != nil {
+		return Account{}, err
+	}
+
+	if account, err = s.restoreDeleted(account, client); err != nil {
+		return Account{}, err
+	}
+
+	if !account.Active {
+		if account, err = s.activateClaimed(account, "magic_link", client); err != nil {
+			return Account{}, err
+		}
+	}
+
+	s.recordLogin(account, "magic_link", client)
+
+	return account, nil
+}
+
+// activateClaimed activates a pending account on behalf of whoever proved owning its email by method.
+// The pending account may have been registered by someone else in anticipation (pre-account hijacking),
+// so none of the credentials set up before the activation survive it.
+func (s Service) activateClaimed(account Account, method string, client audit.Client) (Account, error) {
+	if err := s.storage.ActivateClaimed(account.Id); err != nil {
+		return Account{}, err
+	}
+
+	s.record(account.Id, audit.AccountActivated, client, map[string]string{"method": method})
+
+	return s.storage.ByAccountId(account.Id)
+}
+
+// reserveMail throttles the mails of kind sent to an email address and requested by a client IP.
+// Every request is reserved and never released, whether an account can be found or not,
+// so the throttling doesn't tell which emails are registered.
+func (s Service) reserveMail(kind string, email string, client audit.Client) error {
+	keys := []string{kind + ":ip:" + client.IP, kind + ":email:" + strings.ToLower(email)}
+
+	for _, key := range keys {
+		_, wait, err := s.limiter.Reserve(key)
+		if err != nil {
+			return err
+		}
+
+		if wait > 0 {
+			return &ThrottledError{"too many emails requested", wait}
+		}
+	}
+
+	return nil
 }
 
-type Service struct {
-	storage Storage
+// restoreDeleted reactivates a deleted account, provided it is still within the grace period.
+func (s Service) restoreDeleted(account Account, client audit.Client) (Account, error) {
+	if !account.Deleted() {
+		return account, nil
+	}
+
+	if time.Since(account.DeletedAt) > s.config.DeletionGracePeriod {
+		return Account{}, ErrAccountDeleted
+	}
+
+	if err := s.storage.Restore(account.Id); err != nil {
+		return Account{}, err
+	}
+	account.DeletedAt = time.Time{}
+
+	s.record(account.Id, audit.AccountRestored, client, nil)
+
+	return account, nil
+}
+
+// Forgot mails a password reset link to the account, requests are throttled per email and client IP.
+func (s Service) Forgot(email string, client audit.Client) error {
+	if err := s.reserveMail("forgot", email, client); err != nil {
+		return err
+	}
+
+	account, err := s.storage.ByEmail(email)
+	if err != nil {
+		return err
+	}
+
+	if account.Deleted() {
+		return ErrAccountDeleted
+	}
+
+	s.record(account.Id, audit.PasswordResetRequested, client, nil)
+
+	return s.sendPasswordResetMail(account)
+}
+
+// Reset sets a new password using a reset token.
+// A reset token can only be used once, and only as long as the password it was issued for hasn't changed.
+func (s Service) Reset(resetToken string, newPassword string, client audit.Client) error {
+	claims, err := token.VerifyResetToken(resetToken)
+	if err != nil {
+		return ErrResetTokenInvalid
+	}
+
+	tokenId, err := uid.FromString(claims.Id)
+	if err != nil {
+		return ErrResetTokenInvalid
+	}
+
+	account, err := s.storage.ByAccountId(claims.AccountId)
+	if err != nil {
+		return ErrResetTokenInvalid
+	}
+
+	if !token.VerifyFingerprint(account.PasswordHash, claims.PasswordFingerprint) {
+		return ErrResetTokenInvalid
+	}
+
+	nickname, err := s.nickname(account.Id)
+	if err != nil {
+		return err
+	}
+
+	// Checked before the token is consumed, so the link can be reused with another password.
+	if err = s.config.PasswordPolicy.Check(newPassword, account.Email, nickname); err != nil {
+		return err
+	}
+
+	if err = s.storage.ConsumeSingleUseToken(tokenId, account.Id, PasswordResetPurpose); err != nil {
+		return ErrResetTokenInvalid
+	}
+
+	if err = s.UpdatePassword(account.Id, newPassword); err != nil {
+		return err
+	}
+
+	s.record(account.Id, audit.PasswordReset, client, nil)
+
+	return nil
+}
+
+// RequestEmailChange mails a confirmation link to the new address and a notice to the current one.
+// The email is only changed once the link is confirmed, see ConfirmEmailChange.
+func (s Service) RequestEmailChange(accountId uid.UID, newEmail string, password string, client audit.Client) error {
+	account, err := s.storage.ByAccountId(accountId)
+	if err != nil {
+		return err
+	}
+
+	if err = s.comparePasswordHash(password, account.PasswordHash); err != nil {
+		return err
+	}
+
+	if _, err = s.storage.ByEmail(newEmail); err == nil {
+		return ErrEmailTaken
+	}
+
+	s.record(account.Id, audit.EmailChangeRequested, client, map[string]string{"new_email": newEmail})
+
+	if err = s.sendEmailChangeMail(account, newEmail); err != nil {
+		return err
+	}
+
+	return s.sendEmailChangeNoticeMail(account, newEmail)
+}
+
+// ConfirmEmailChange applies the email change the token was issued for.
+func (s Service) ConfirmEmailChange(emailChangeToken string, client audit.Client) error {
+	claims, err := token.VerifyEmailChangeToken(emailChangeToken)
+	if err != nil {
+		return ErrEmailChangeTokenInvalid
+	}
+
+	tokenId, err := uid.FromString(claims.Id)
+	if err != nil {
+		return ErrEmailChangeTokenInvalid
+	}
+
+	if _, err = s.storage.ByEmail(claims.NewEmail); err == nil {
+		return ErrEmailTaken
+	}
+
+	if err = s.storage.ConsumeSingleUseToken(tokenId, claims.AccountId, EmailChangePurpose); err != nil {
+		return ErrEmailChangeTokenInvalid
+	}
+
+	if err = s.storage.UpdateEmail(claims.AccountId, claims.NewEmail); err != nil {
+		return err
+	}
+
+	s.record(claims.AccountId, audit.EmailChanged, client, map[string]string{"new_email": claims.NewEmail})
+
+	return nil
+}
+
+// Activate activates the account when the activation code matches.
+// Every attempt is counted before the code is compared, so concurrent guesses
+// can't exceed ActivationMaxAttempts. A locked code can only be replaced by resending it.
+func (s Service) Activate(accountId uid.UID, activationCode string, client audit.Client) error {
+	account, err := s.storage.ByAccountId(accountId)
+	if err != nil {
+		return err
+	}
+
+	if account.Active {
+		return ErrAccountActive
+	}
+
+	attempts, err := s.storage.IncrementActivationAttempts(accountId)
+	if err != nil {
+		return err
+	}
+
+	if attempts > ActivationMaxAttempts {
+		return ErrActivationLocked
+	}
+
+	if time.Now().After(account.ActivationExpiresAt) {
+		return ErrActivationCodeExpired
+	}
+
+	if subtle.ConstantTimeCompare([]byte(account.ActivationCode), []byte(activationCode)) != 1 {
+		s.record(accountId, audit.ActivationFailed, client, nil)
+		return ErrActivationCodeInvalid
+	}
+
+	if err = s.storage.SetActive(accountId, activationCode); err != nil {
+		return err
+	}
+
+	s.record(accountId, audit.AccountActivated, client, nil)
+
+	return nil
+}
+
+func (s Service) Pending(accountId uid.UID) (string, error) {
+	return s.storage.SetPending(accountId, time.Now().UTC().Add(ActivationCodeValidFor))
+}
+
+// ResendActivation regenerates the activation code and mails it again.
+// ActivationResends are subject to a cooldown and a daily cap per account.
+func (s Service) ResendActivation(accountId uid.UID) error {
+	account, err := s.storage.ByAccountId(accountId)
+	if err != nil {
+		return err
+	}
+
+	if account.Active {
+		return ErrAccountActive
+	}
+
+	now := time.Now()
+	if wait := account.ActivationSentAt.Add(ActivationResendCooldown).Sub(now); wait > 0 {
+		return &ThrottledError{"activation code was sent recently", wait}
+	}
+
+	today := now.UTC().Truncate(time.Hour * 24)
+	if account.ActivationSentAt.UTC().Truncate(time.Hour*24).Equal(today) && account.ActivationResends >= ActivationResendDailyCap {
+		return &ThrottledError{"daily activation resend limit reached", today.Add(time.Hour * 24).Sub(now)}
+	}
+
+	if account.ActivationCode, err = s.Pending(accountId); err != nil {
+		return err
+	}
+
+	return s.sendActivationMail(account)
+}
+
+// ChangePassword replaces the password of a logged-in account after verifying the current one.
+func (s Service) ChangePassword(accountId uid.UID, currentPassword string, newPassword string, client audit.Client) error {
+	account, err := s.storage.ByAccountId(accountId)
+	if err != nil {
+		return err
+	}
+
+	if err = s.comparePasswordHash(currentPassword, account.PasswordHash); err != nil {
+		return err
+	}
+
+	nickname, err := s.nickname(account.Id)
+	if err != nil {
+		return err
+	}
+
+	if err = s.config.PasswordPolicy.Check(newPassword, account.Email, nickname); err != nil {
+		return err
+	}
+
+	if err = s.UpdatePassword(account.Id, newPassword); err != nil {
+		return err
+	}
+
+	s.record(account.Id, audit.PasswordChanged, client, nil)
+
+	return nil
+}
+
+func (s Service) UpdatePassword(accountId uid.UID, password string) error {
+	passwordHash, err := s.newPasswordHash(password)
+	if err != nil {
+		return err
+	}
+
+	account, err := s.storage.ByAccountId(accountId)
+	if err != nil {
+		return err
+	}
+
+	if err = s.storage.UpdatePassword(account.Id, passwordHash); err != nil {
+		return err
+	}
+
+	if err = s.passwordNotificationMail(account); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ChangeRole changes the role of another account and reports whether it was demoted.
+func (s Service) ChangeRole(adminId uid.UID, accountId uid.UID, role string, client audit.Client) (bool, error) {
+	if adminId == accountId {
+		return false, ErrOwnRole
+	}
+
+	account, err := s.storage.ByAccountId(accountId)
+	if err != nil {
+		return false, err
+	}
+
+	if err = s.storage.UpdateRole(account.Id, role); err != nil {
+		return false, err
+	}
+
+	s.record(account.Id, audit.RoleChanged, client, map[string]string{
+		"role":          role,
+		"previous_role": account.Role,
+		"changed_by":    adminId.String(),
+	})
+
+	return !authorization.HasRole(role, account.Role), nil
+}
+
+// Delete soft-deletes the account after verifying its password, and reports whether it was deleted.
+// Accounts without a password (external identities, passkeys, claimed accounts) are mailed
+// a confirmation link instead, and are only deleted once it's confirmed, see ConfirmDeletion.
+// The account is permanently purged once the deletion grace period passes.
+func (s Service) Delete(accountId uid.UID, password string, client audit.Client) (bool, error) {
+	account, err := s.storage.ByAccountId(accountId)
+	if err != nil {
+		return false, err
+	}
+
+	if len(account.PasswordHash) == 0 {
+		s.record(account.Id, audit.AccountDeletionRequested, client, nil)
+		return false, s.sendDeletionMail(account)
+	}
+
+	if err = s.comparePasswordHash(password, account.PasswordHash); err != nil {
+		return false, err
+	}
+
+	if err = s.storage.SoftDelete(account.Id); err != nil {
+		return false, err
+	}
+
+	s.record(account.Id, audit.AccountDeleted, client, nil)
+
+	return true, nil
+}
+
+// ConfirmDeletion soft-deletes the account the token was issued for and returns its id.
+func (s Service) ConfirmDeletion(deletionToken string, client audit.Client) (uid.UID, error) {
+	claims, err := token.VerifyDeletionToken(deletionToken)
+	if err != nil {
+		return uid.Nil, ErrDeletionTokenInvalid
+	}
+
+	tokenId, err := uid.FromString(claims.Id)
+	if err != nil {
+		return uid.Nil, ErrDeletionTokenInvalid
+	}
+
+	if err = s.storage.ConsumeSingleUseToken(tokenId, claims.AccountId, DeletionPurpose); err != nil {
+		return uid.Nil, ErrDeletionTokenInvalid
+	}
+
+	if err = s.storage.SoftDelete(claims.AccountId); err != nil {
+		return uid.Nil, err
+	}
+
+	s.record(claims.AccountId, audit.AccountDeleted, client, nil)
+
+	return claims.AccountId, nil
+}
+
+// ExpiredDeletions returns the deleted accounts whose grace period has passed.
+func (s Service) ExpiredDeletions() ([]Account, error) {
+	return s.storage.DeletedBefore(time.Now().UTC().Add(-s.config.DeletionGracePeriod))
+}
+
+// Purge permanently deletes the account.
+func (s Service) Purge(accountId uid.UID) error {
+	return s.storage.Delete(accountId)
+}
+
+// SetupTwoFactor generates a new TOTP secret for the account and returns its otpauth URI.
+// Two-factor authentication is only enabled once a code generated from the secret is confirmed.
+func (s Service) SetupTwoFactor(accountId uid.UID) (string, error) {
+	account, err := s.storage.ByAccountId(accountId)
+	if err != nil {
+		return "", err
+	}
+
+	if account.TOTPEnabled {
+		return "", ErrTwoFactorEnabled
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return "", err
+	}
+
+	if err = s.storage.SetTOTPSecret(accountId, secret); err != nil {
+		return "", err
+	}
+
+	return totp.URI(secret, TwoFactorIssuer, account.Email), nil
+}
+
+// ConfirmTwoFactor enables two-factor authentication and returns the one-time recovery codes.
+// Recovery codes are only stored hashed, this is the only time they are available in plain text.
+func (s Service) ConfirmTwoFactor(accountId uid.UID, code string, client audit.Client) ([]string, error) {
+	account, err := s.storage.ByAccountId(accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	if account.TOTPEnabled {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	if account.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotSetUp
+	}
+
+	step, ok := totp.ValidateStep(account.TOTPSecret, code, time.Now())
+	if !ok {
+		return nil, ErrTwoFactorCodeInvalid
+	}
+
+	// The confirmation code can't be used again to log in.
+	if err = s.storage.UseTOTPStep(accountId, step); err != nil {
+		return nil, ErrTwoFactorCodeInvalid
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = s.newRecoveryCode(); err != nil {
+			return nil, err
+		}
+		hashes[i] = s.hashRecoveryCode(codes[i])
+	}
+
+	if err = s.storage.EnableTOTP(accountId, hashes); err != nil {
+		return nil, err
+	}
+
+	s.record(accountId, audit.TwoFactorEnabled, client, nil)
+
+	return codes, nil
+}
+
+// NewLoginChallenge returns the challenge of an account which passed the first authentication factor.
+// The challenge is exchanged for a session only once, along with the second factor.
+func (s Service) NewLoginChallenge(account Account) (string, error) {
+	tokenId, err := s.storage.InsertSingleUseToken(account.Id, LoginChallengePurpose)
+	if err != nil {
+		return "", err
+	}
+
+	return token.NewChallengeToken(tokenId, token.ChallengeTokenCustomClaims{
+		AccountId: account.Id,
+	})
+}
+
+// ConsumeLoginChallenge exchanges a login challenge for the passkey login of its account,
+// the passkey then serves as the second factor.
+func (s Service) ConsumeLoginChallenge(challenge string) (uid.UID, error) {
+	challengeId, accountId, err := parseLoginChallenge(challenge)
+	if err != nil {
+		return uid.Nil, err
+	}
+
+	if err = s.storage.ConsumeSingleUseToken(challengeId, accountId, LoginChallengePurpose); err != nil {
+		return uid.Nil, ErrLoginChallengeInvalid
+	}
+
+	return accountId, nil
 }
 
-func (s Service) ByAccountId(accountId uid.UID) (Account, error) {
-	return s.storage.ByAccountId(accountId)
+func parseLoginChallenge(challenge string) (uid.UID, uid.UID, error) {
+	claims, err := token.VerifyChallengeToken(challenge)
+	if err != nil {
+		return uid.Nil, uid.Nil, ErrLoginChallengeInvalid
+	}
+
+	challengeId, err := uid.FromString(claims.Id)
+	if err != nil {
+		return uid.Nil, uid.Nil, ErrLoginChallengeInvalid
+	}
+
+	return challengeId, claims.AccountId, nil
 }
 
-func (s Service) Register(email string, nickname string, password string) (Account, error) {
-	passwordHash, err := s.newPasswordHash(password)
+// VerifyTwoFactor verifies the second authentication factor of a login challenge, which is either
+// a TOTP code or one of the unused recovery codes. Attempts are throttled the same way as in Login.
+// A TOTP code is only accepted once, and so is the challenge.
+func (s Service) VerifyTwoFactor(challenge string, code string, client audit.Client) (Account, error) {
+	challengeId, accountId, err := parseLoginChallenge(challenge)
 	if err != nil {
 		return Account{}, err
 	}
 
-	account, err := s.storage.Insert(email, nickname, passwordHash)
+	key := "2fa:" + accountId.String()
+
+	_, wait, err := s.limiter.Reserve(key)
 	if err != nil {
 		return Account{}, err
 	}
 
-	if err = s.sendActivationMail(account); err != nil {
+	if wait > 0 {
+		return Account{}, &ThrottledError{"too many invalid two-factor codes", wait}
+	}
+
+	account, err := s.storage.ByAccountId(accountId)
+	if err != nil {
 		return Account{}, err
 	}
 
-	return account, nil
+	if !account.TOTPEnabled {
+		return Account{}, ErrTwoFactorNotSetUp
+	}
+
+	var method string
+	if step, ok := totp.ValidateStep(account.TOTPSecret, code, time.Now()); ok {
+		if s.storage.UseTOTPStep(accountId, step) == nil {
+			method = "totp"
+		}
+	} else if s.storage.UseRecoveryCode(accountId, s.hashRecoveryCode(code)) == nil {
+		method = "recovery_code"
+	}
+
+	if method == "" {
+		s.record(accountId, audit.TwoFactorFailed, client, nil)
+		return Account{}, ErrTwoFactorCodeInvalid
+	}
+
+	if err = s.storage.ConsumeSingleUseToken(challengeId, accountId, LoginChallengePurpose); err != nil {
+		return Account{}, ErrLoginChallengeInvalid
+	}
+
+	s.record(accountId, audit.LoginSucceeded, client, map[string]string{"method": method})
+
+	return account, s.limiter.Reset(key)
 }
 
-func (s Service) Login(email string, password string) (Account, error) {
-	account, err := s.storage.ByEmail(email)
+// BeginPasskeyRegistration starts registering a new passkey, the options are passed to
+// navigator.credentials.create() and the response is verified by FinishPasskeyRegistration.
+func (s Service) BeginPasskeyRegistration(accountId uid.UID) (uid.UID, webauthn.CreationOptions, error) {
+	account, err := s.storage.ByAccountId(accountId)
+	if err != nil {
+		return uid.Nil, webauthn.CreationOptions{}, err
+	}
+
+	nickname, err := s.nickname(accountId)
+	if err != nil {
+		return uid.Nil, webauthn.CreationOptions{}, err
+	}
+
+	passkeys, err := s.storage.PasskeysByAccountId(accountId)
+	if err != nil {
+		return uid.Nil, webauthn.CreationOptions{}, err
+	}
+
+	exclude := make([]webauthn.Descriptor, 0)
+	for _, passkey := range passkeys {
+		exclude = append(exclude, passkey.Descriptor())
+	}
+
+	challengeId, challenge, err := s.newWebAuthnChallenge(accountId, PasskeyRegistrationPurpose)
+	if err != nil {
+		return uid.Nil, webauthn.CreationOptions{}, err
+	}
+
+	// The user handle is the account id, so discoverable passkeys identify the account on login.
+	user := webauthn.User{
+		ID:          accountId[:],
+		Name:        account.Email,
+		DisplayName: nickname,
+	}
+
+	return challengeId, s.config.WebAuthn.CreationOptions(challenge, user, exclude), nil
+}
+
+// FinishPasskeyRegistration verifies the authenticator response and stores the new passkey.
+func (s Service) FinishPasskeyRegistration(accountId uid.UID, challengeId uid.UID, name string, response webauthn.AttestationResponse, client audit.Client) (Passkey, error) {
+	challenge, err := s.storage.ConsumeWebAuthnChallenge(challengeId, PasskeyRegistrationPurpose)
+	if err != nil || challenge.AccountId != accountId {
+		return Passkey{}, ErrPasskeyChallengeInvalid
+	}
+
+	credential, err := s.config.WebAuthn.VerifyRegistration(challenge.Challenge, response, false)
+	if err != nil {
+		return Passkey{}, err
+	}
+
+	if _, err = s.storage.PasskeyByCredentialId(credential.ID); err == nil {
+		return Passkey{}, ErrPasskeyTaken
+	}
+
+	passkey, err := s.storage.InsertPasskey(accountId, name, credential)
+	if err != nil {
+		return Passkey{}, err
+	}
+
+	s.record(accountId, audit.PasskeyAdded, client, map[string]string{"passkey_id": passkey.Id.String()})
+
+	return passkey, nil
+}
+
+func (s Service) Passkeys(accountId uid.UID) ([]Passkey, error) {
+	return s.storage.PasskeysByAccountId(accountId)
+}
+
+// RemovePasskey removes the passkey, provided it belongs to the account.
+func (s Service) RemovePasskey(accountId uid.UID, passkeyId uid.UID, client audit.Client) error {
+	if err := s.storage.DeletePasskey(accountId, passkeyId); err != nil {
+		return err
+	}
+
+	s.record(accountId, audit.PasskeyRemoved, client, map[string]string{"passkey_id": passkeyId.String()})
+
+	return nil
+}
+
+// BeginPasskeyLogin starts a login ceremony, the options are passed to navigator.credentials.get()
+// and the response is verified by PasskeyLogin. Without an account, any discoverable passkey
+// can be used to log in without a password. With an account which passed the first factor,
+// only its own passkeys are allowed and they serve as the second factor.
+func (s Service) BeginPasskeyLogin(accountId uid.UID) (uid.UID, webauthn.RequestOptions, error) {
+	allow := make([]webauthn.Descriptor, 0)
+	verification := webauthn.VerificationRequired
+
+	if accountId != uid.Nil {
+		passkeys, err := s.storage.PasskeysByAccountId(accountId)
+		if err != nil {
+			return uid.Nil, webauthn.RequestOptions{}, err
+		}
+
+		if len(passkeys) == 0 {
+			return uid.Nil, webauthn.RequestOptions{}, ErrNoPasskeys
+		}
+
+		for _, passkey := range passkeys {
+			allow = append(allow, passkey.Descriptor())
+		}
+
+		verification = webauthn.VerificationPreferred
+	}
+
+	challengeId, challenge, err := s.newWebAuthnChallenge(accountId, PasskeyLoginPurpose)
+	if err != nil {
+		return uid.Nil, webauthn.RequestOptions{}, err
+	}
+
+	return challengeId, s.config.WebAuthn.RequestOptions(challenge, allow, verification), nil
+}
+
+// PasskeyLogin verifies the authenticator response of a login ceremony.
+// Passwordless logins require user verification (a PIN or biometric), which makes the passkey
+// a second factor of its own, so they complete without a two-factor challenge.
+// A passkey whose signature counter went backwards is rejected as a likely clone.
+func (s Service) PasskeyLogin(challengeId uid.UID, response webauthn.AssertionResponse, client audit.Client) (Account, error) {
+	challenge, err := s.storage.ConsumeWebAuthnChallenge(challengeId, PasskeyLoginPurpose)
+	if err != nil {
+		return Account{}, ErrPasskeyChallengeInvalid
+	}
+
+	passkey, err := s.storage.PasskeyByCredentialId(response.RawID)
+	if err != nil {
+		return Account{}, ErrPasskeyInvalid
+	}
+
+	// A second factor must be a passkey of the account which passed the first one.
+	passwordless := challenge.AccountId == uid.Nil
+	if !passwordless && passkey.AccountId != challenge.AccountId {
+		return Account{}, ErrPasskeyInvalid
+	}
+
+	// Discoverable passkeys return the user handle, which must match the passkey owner.
+	if len(response.Response.UserHandle) != 0 && !bytes.Equal(response.Response.UserHandle, passkey.AccountId[:]) {
+		return Account{}, ErrPasskeyInvalid
+	}
+
+	signCount, err := s.config.WebAuthn.VerifyAssertion(challenge.Challenge, response, passkey.PublicKey, passkey.SignCount, passwordless)
+	if errors.Is(err, webauthn.ErrCredentialCloned) {
+		s.record(passkey.AccountId, audit.PasskeyCloneDetected, client, map[string]string{"passkey_id": passkey.Id.String()})
+		return Account{}, err
+	}
 	if err != nil {
+		s.record(passkey.AccountId, audit.LoginFailed, client, map[string]string{"method": "passkey"})
 		return Account{}, err
 	}
 
-	if err = s.comparePasswordHash(password, account.PasswordHash); err != nil {
+	if err = s.storage.UsePasskey(passkey.Id, signCount); err != nil {
+		return Account{}, err
+	}
+
+	account, err := s.storage.ByAccountId(passkey.AccountId)
+	if err != nil {
 		return Account{}, err
 	}
 
+	if passwordless {
+		if account, err = s.restoreDeleted(account, client); err != nil {
+			return Account{}, err
+		}
+	}
+
+	s.record(account.Id, audit.LoginSucceeded, client, map[string]string{"method": "passkey"})
+
 	return account, nil
 }
 
-func (s Service) Forgot(email string) error {
-	account, err := s.storage.ByEmail(email)
+// Subscribe registers the account subscribers on the event bus.
+func (s Service) Subscribe(bus *events.Service) {
+	bus.Subscribe(events.AccountRegistered, "account.activation_mail", s.onAccountRegistered)
+}
+
+func (s Service) onAccountRegistered(event events.Event) error {
+	var payload events.AccountRegisteredPayload
+	if err := event.Decode(&payload); err != nil {
+		return err
+	}
+
+	account, err := s.storage.ByAccountId(payload.AccountId)
 	if err != nil {
 		return err
 	}
 
-	return s.sendPasswordResetMail(account)
+	// Redelivered after the account was activated, or activated by other means.
+	if account.Active {
+		return nil
+	}
+
+	return s.sendActivationMail(account)
 }
 
-func (s Service) Activate(accountId uid.UID, activationCode string) error {
-	return s.storage.SetActive(accountId, activationCode)
+// newWebAuthnChallenge stores a new challenge for a ceremony of the given purpose.
+func (s Service) newWebAuthnChallenge(accountId uid.UID, purpose string) (uid.UID, []byte, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return uid.Nil, nil, err
+	}
+
+	expiresAt := time.Now().UTC().Add(webauthn.Timeout)
+
+	challengeId, err := s.storage.InsertWebAuthnChallenge(accountId, purpose, challenge, expiresAt)
+	if err != nil {
+		return uid.Nil, nil, err
+	}
+
+	return challengeId, challenge, nil
 }
 
-func (s Service) Pending(accountId uid.UID) (string, error) {
-	return s.storage.SetPending(accountId)
+// newUser creates the user profile of a newly inserted account.
+func (s Service) newUser(tx *sqlx.Tx, account Account, nickname string) error {
+	// Dependency(Users)
+	return s.users.NewUser(tx, account.Id, &users.Fields{
+		Email:    account.Email,
+		Nickname: nickname,
+	})
 }
 
-func (s Service) UpdatePassword(accountId uid.UID, password string) error {
-	passwordHash, err := s.newPasswordHash(password)
+// nickname returns the current nickname of the account, which is owned by its user profile.
+func (s Service) nickname(accountId uid.UID) (string, error) {
+	// Dependency(Users)
+	user, err := s.users.UserByAccountId(accountId)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	account, err := s.storage.ByAccountId(accountId)
+	return user.Nickname, nil
+}
+
+// SecondFactors returns the second factors the account set up, either TOTP or a registered passkey.
+// When there is any, a login is only completed once one of them is verified.
+func (s Service) SecondFactors(account Account) ([]string, error) {
+	factors := make([]string, 0)
+	if account.TOTPEnabled {
+		factors = append(factors, SecondFactorTOTP)
+	}
+
+	passkeys, err := s.storage.PasskeysByAccountId(account.Id)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err = s.storage.UpdatePassword(account.Id, passwordHash); err != nil {
-		return err
+	if len(passkeys) != 0 {
+		factors = append(factors, SecondFactorPasskey)
 	}
 
-	if err = s.passwordNotificationMail(account); err != nil {
-		return err
+	return factors, nil
+}
+
+// recordLogin records a successful first factor, which only completes the login
+// when the account has no second factor, see SecondFactors. method is the first factor used.
+func (s Service) recordLogin(account Account, method string, client audit.Client) {
+	eventType := audit.LoginSucceeded
+
+	factors, err := s.SecondFactors(account)
+	if err != nil {
+		log.Println(err)
 	}
 
-	return nil
+	// The handler fails the login when the second factors can't be loaded, it wasn't completed either way.
+	if err != nil || len(factors) != 0 {
+		eventType = audit.TwoFactorChallenged
+	}
+
+	s.record(account.Id, eventType, client, map[string]string{"method": method})
+}
+
+// record appends an event to the audit log.
+// A failure is only logged, it must not fail the action being recorded.
+func (s Service) record(accountId uid.UID, eventType string, client audit.Client, metadata map[string]string) {
+	if err := s.audit.Record(accountId, eventType, client, metadata); err != nil {
+		log.Println(err)
+	}
+}
+
+// newRecoveryCode returns a random code formatted as "xxxxx-xxxxx" for readability.
+func (Service) newRecoveryCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	code := hex.EncodeToString(b)
+	return code[:5] + "-" + code[5:], nil
+}
+
+func (Service) hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	return token.HashOpaqueToken(normalized)
+}
+
+func (s Service) newPasswordHash(password string) ([]byte, error) {
+	return s.config.PasswordHasher.Hash(password)
 }
 
-func (Service) newPasswordHash(password string) ([]byte, error) {
-	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+func (s Service) comparePasswordHash(password string, passwordHash []byte) error {
+	return s.config.PasswordHasher.Compare(passwordHash, password)
 }
 
-func (Service) comparePasswordHash(password string, passwordHash []byte) error {
-	return bcrypt.CompareHashAndPassword(passwordHash, []byte(password))
+// rehashPassword replaces a hash produced by an outdated algorithm or parameters.
+// It's only possible while the plain text password is known, i.e. right after logging in.
+func (s Service) rehashPassword(account Account, password string) error {
+	if !s.config.PasswordHasher.NeedsRehash(account.PasswordHash) {
+		return nil
+	}
+
+	passwordHash, err := s.newPasswordHash(password)
+	if err != nil {
+		return err
+	}
+
+	return s.storage.UpdatePassword(account.Id, passwordHash)
 }
 
-func (Service) sendPasswordResetMail(account Account) error {
+func (s Service) sendPasswordResetMail(account Account) error {
 	subject := "Password Reset Request"
 	from := mail.Address{
 		Name:    "Atraf Accounts",
 		Address: "accounts@atraf.app",
 	}
 
-	resetToken, err := token.NewResetToken(token.ResetTokensCustomClaims{
-		AccountId: account.Id,
+	tokenId, err := s.storage.InsertSingleUseToken(account.Id, PasswordResetPurpose)
+	if err != nil {
+		return err
+	}
+
+	resetToken, err := token.NewResetToken(tokenId, token.ResetTokensCustomClaims{
+		AccountId:           account.Id,
+		PasswordFingerprint: token.Fingerprint(account.PasswordHash),
 	})
 	if err != nil {
 		return err
@@ -145,6 +1411,117 @@ func (Service) sendPasswordResetMail(account Account) error {
 	return mailer.FromTemplate(filename, data, subject, from, []string{account.Email})
 }
 
+func (s Service) sendEmailChangeMail(account Account, newEmail string) error {
+	subject := "Confirm your new email address"
+	from := mail.Address{
+		Name:    "Atraf Accounts",
+		Address: "accounts@atraf.app",
+	}
+
+	tokenId, err := s.storage.InsertSingleUseToken(account.Id, EmailChangePurpose)
+	if err != nil {
+		return err
+	}
+
+	emailChangeToken, err := token.NewEmailChangeToken(tokenId, token.EmailChangeCustomClaims{
+		AccountId: account.Id,
+		NewEmail:  newEmail,
+	})
+	if err != nil {
+		return err
+	}
+
+	data := struct {
+		ConfirmURL string
+		Duration   float64
+	}{
+		ConfirmURL: fmt.Sprintf("%s/email/confirm/%s", os.Getenv("CLIENT_URL"), emailChangeToken),
+		Duration:   token.EmailChangeTokenValidFor.Minutes(),
+	}
+
+	filename := "templates/email-change-confirm.html"
+	return mailer.FromTemplate(filename, data, subject, from, []string{newEmail})
+}
+
+func (s Service) sendDeletionMail(account Account) error {
+	subject := "Confirm your account deletion"
+	from := mail.Address{
+		Name:    "Atraf Accounts",
+		Address: "accounts@atraf.app",
+	}
+
+	tokenId, err := s.storage.InsertSingleUseToken(account.Id, DeletionPurpose)
+	if err != nil {
+		return err
+	}
+
+	deletionToken, err := token.NewDeletionToken(tokenId, token.DeletionCustomClaims{
+		AccountId: account.Id,
+	})
+	if err != nil {
+		return err
+	}
+
+	data := struct {
+		ConfirmURL string
+		Duration   float64
+	}{
+		ConfirmURL: fmt.Sprintf("%s/account/delete/confirm/%s", os.Getenv("CLIENT_URL"), deletionToken),
+		Duration:   token.DeletionTokenValidFor.Minutes(),
+	}
+
+	filename := "templates/account-deletion-confirm.html"
+	return mailer.FromTemplate(filename, data, subject, from, []string{account.Email})
+}
+
+func (s Service) sendMagicLinkMail(account Account) error {
+	subject := "Your sign-in link"
+	from := mail.Address{
+		Name:    "Atraf Accounts",
+		Address: "accounts@atraf.app",
+	}
+
+	tokenId, err := s.storage.InsertSingleUseToken(account.Id, MagicLinkPurpose)
+	if err != nil {
+		return err
+	}
+
+	magicLinkToken, err := token.NewMagicLinkToken(tokenId, token.MagicLinkCustomClaims{
+		AccountId: account.Id,
+	})
+	if err != nil {
+		return err
+	}
+
+	data := struct {
+		SignInURL string
+		Duration  float64
+	}{
+		SignInURL: fmt.Sprintf("%s/magic-link/%s", os.Getenv("CLIENT_URL"), magicLinkToken),
+		Duration:  token.MagicLinkTokenValidFor.Minutes(),
+	}
+
+	filename := "templates/magic-link.html"
+	return mailer.FromTemplate(filename, data, subject, from, []string{account.Email})
+}
+
+func (Service) sendEmailChangeNoticeMail(account Account, newEmail string) error {
+	subject := "Email change notification"
+	from := mail.Address{
+		Name:    "Atraf Accounts",
+		Address: "accounts@atraf.app",
+	}
+
+	data := struct {
+		NewEmail string
+	}{
+		NewEmail: newEmail,
+	}
+
+	filename := "templates/email-change-notice.html"
+	return mailer.FromTemplate(filename, data, subject, from, []string{account.Email})
+}
+
 func (Service) sendActivationMail(account Account) error {
 	subject := "Account Activation Code"
 	from := mail.Address{
@@ -162,6 +1539,23 @@ func (Service) sendActivationMail(account Account) error {
 	return mailer.FromTemplate(filename, data, subject, from, []string{account.Email})
 }
 
+func (s Service) sendAccountLockedMail(account Account) error {
+	subject := "Account temporarily locked"
+	from := mail.Address{
+		Name:    "Atraf Accounts",
+		Address: "accounts@atraf.app",
+	}
+
+	data := struct {
+		Duration float64
+	}{
+		Duration: s.limiter.Policy().LockFor.Minutes(),
+	}
+
+	filename := "templates/account-locked.html"
+	return mailer.FromTemplate(filename, data, subject, from, []string{account.Email})
+}
+
 func (Service) passwordNotificationMail(account Account) error {
 	subject := "Password reset notification"
 	from := mail.Address{
@@ -173,6 +1567,11 @@ func (Service) passwordNotificationMail(account Account) error {
 	return mailer.FromTemplate(filename, nil, subject, from, []string{account.Email})
 }
 
-func NewService(storage Storage) *Service {
-	return &Service{storage}
+func NewService(storage Storage, users *users.Service, invites *invites.Service, transactor *database.Transactor, events *events.Service, limiter *limiter.Limiter, audit *audit.Service, config Config) *Service {
+	dummyHash, err := config.PasswordHasher.Hash(DummyPassword)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return &Service{storage, users, invites, transactor, events, limiter, audit, config, dummyHash}
 }
@@ -0,0 +1,225 @@
+package account
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"atraf-server/pkg/jwk"
+	"atraf-server/pkg/password"
+	"atraf-server/pkg/token"
+	"atraf-server/pkg/uid"
+	"atraf-server/services/audit"
+	"atraf-server/services/users"
+)
+
+// identityStorage knows no linked identity, any other storage call panics.
+type identityStorage struct {
+	Storage
+}
+
+func (identityStorage) ByIdentity(string, string) (Account, error) {
+	return Account{}, sql.ErrNoRows
+}
+
+func TestExternalLoginRejectsUnverifiedEmail(t *testing.T) {
+	s := Service{storage: identityStorage{}}
+
+	_, err := s.ExternalLogin(Identity{
+		Provider:      "test",
+		Subject:       "subject",
+		Email:         "user@example.com",
+		EmailVerified: false,
+	}, audit.Client{})
+
+	if !errors.Is(err, ErrEmailNotVerified) {
+		t.Fatalf("expected [%v] got [%v]", ErrEmailNotVerified, err)
+	}
+}
+
+// testHasher keeps hashing cheap, the parameters don't matter to the tests.
+var testHasher = password.Hasher{
+	Algorithm: password.Argon2id,
+	Argon2:    password.Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+}
+
+func useTestKeys(t *testing.T) {
+	keys, secrets := token.Keys, token.FingerprintSecrets
+	t.Cleanup(func() {
+		token.Keys, token.FingerprintSecrets = keys, secrets
+	})
+
+	token.Keys = jwk.NewHMACKeyset("test-secret")
+	token.FingerprintSecrets = []string{"test-secret"}
+}
+
+// resetStorage holds a single account and its unused single use tokens, any other storage call panics.
+type resetStorage struct {
+	Storage
+	account Account
+	tokens  map[uid.UID]string
+}
+
+func (r *resetStorage) ByAccountId(uid.UID) (Account, error) {
+	return r.account, nil
+}
+
+func (r *resetStorage) UpdatePassword(_ uid.UID, passwordHash []byte) error {
+	r.account.PasswordHash = passwordHash
+	return nil
+}
+
+func (r *resetStorage) InsertSingleUseToken(_ uid.UID, purpose string) (uid.UID, error) {
+	tokenId := uid.New()
+	r.tokens[tokenId] = purpose
+
+	return tokenId, nil
+}
+
+func (r *resetStorage) ConsumeSingleUseToken(tokenId uid.UID, _ uid.UID, purpose string) error {
+	if r.tokens[tokenId] != purpose {
+		return sql.ErrNoRows
+	}
+
+	delete(r.tokens, tokenId)
+
+	return nil
+}
+
+type nicknameStorage struct {
+	users.Storage
+}
+
+func (nicknameStorage) ByAccountId(uid.UID) (users.User, error) {
+	return users.User{Nickname: "nickname"}, nil
+}
+
+type discardAudit struct {
+	audit.Storage
+}
+
+func (discardAudit) Insert(uid.UID, string, audit.Client, map[string]string) error {
+	return nil
+}
+
+func newResetService(t *testing.T) (*Service, *resetStorage) {
+	useTestKeys(t)
+
+	passwordHash, err := testHasher.Hash("current password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := &resetStorage{
+		account: Account{Id: uid.New(), Email: "user@example.com", PasswordHash: passwordHash},
+		tokens:  make(map[uid.UID]string),
+	}
+
+	s := &Service{
+		storage: storage,
+		users:   users.NewService(nicknameStorage{}, nil),
+		audit:   audit.NewService(discardAudit{}),
+		config:  Config{PasswordHasher: testHasher, PasswordPolicy: password.DefaultPolicy},
+	}
+
+	return s, storage
+}
+
+// newResetToken issues a reset token the way sendPasswordResetMail does.
+func newResetToken(t *testing.T, storage *resetStorage) string {
+	tokenId, err := storage.InsertSingleUseToken(storage.account.Id, PasswordResetPurpose)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resetToken, err := token.NewResetToken(tokenId, token.ResetTokensCustomClaims{
+		AccountId:           storage.account.Id,
+		PasswordFingerprint: token.Fingerprint(storage.account.PasswordHash),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resetToken
+}
+
+func TestResetTokenIsSingleUse(t *testing.T) {
+	s, storage := newResetService(t)
+	resetToken := newResetToken(t, storage)
+
+	// The password is updated before the notification mail, which can't be sent in tests.
+	if err := s.Reset(resetToken, "correct horse battery staple", audit.Client{}); errors.Is(err, ErrResetTokenInvalid) {
+		t.Fatalf("expected the reset token to be accepted, got [%v]", err)
+	}
+
+	if err := testHasher.Compare(storage.account.PasswordHash, "correct horse battery staple"); err != nil {
+		t.Fatal("expected the password to be updated")
+	}
+
+	if err := s.Reset(resetToken, "another correct horse battery staple", audit.Client{}); !errors.Is(err, ErrResetTokenInvalid) {
+		t.Errorf("expected [%v] got [%v]", ErrResetTokenInvalid, err)
+	}
+}
+
+func TestResetTokenIsConsumedEvenWhenThePasswordIsUnchanged(t *testing.T) {
+	s, storage := newResetService(t)
+	resetToken := newResetToken(t, storage)
+
+	// Reusing the token is refused by the single use token alone, the fingerprint still matches.
+	tokenId := uid.New()
+	for id := range storage.tokens {
+		tokenId = id
+	}
+
+	if err := storage.ConsumeSingleUseToken(tokenId, storage.account.Id, PasswordResetPurpose); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Reset(resetToken, "correct horse battery staple", audit.Client{}); !errors.Is(err, ErrResetTokenInvalid) {
+		t.Errorf("expected [%v] got [%v]", ErrResetTokenInvalid, err)
+	}
+}
+
+func TestResetTokenExpiresWithThePassword(t *testing.T) {
+	s, storage := newResetService(t)
+	resetToken := newResetToken(t, storage)
+
+	passwordHash, err := testHasher.Hash("changed password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.account.PasswordHash = passwordHash
+
+	if err = s.Reset(resetToken, "correct horse battery staple", audit.Client{}); !errors.Is(err, ErrResetTokenInvalid) {
+		t.Errorf("expected [%v] got [%v]", ErrResetTokenInvalid, err)
+	}
+
+	if len(storage.tokens) != 1 {
+		t.Error("expected the single use token to be left unused")
+	}
+}
+
+func TestResetRejectsPolicyViolationsWithoutConsumingTheToken(t *testing.T) {
+	s, storage := newResetService(t)
+	resetToken := newResetToken(t, storage)
+
+	var policy *password.PolicyError
+	if err := s.Reset(resetToken, "short", audit.Client{}); !errors.As(err, &policy) {
+		t.Fatalf("expected a policy error got [%v]", err)
+	}
+
+	if len(storage.tokens) != 1 {
+		t.Error("expected the reset token to remain usable with another password")
+	}
+}
+
+func TestResetTokenFingerprintSurvivesSecretRotation(t *testing.T) {
+	s, storage := newResetService(t)
+	resetToken := newResetToken(t, storage)
+
+	token.FingerprintSecrets = []string{"new-secret", "test-secret"}
+
+	if err := s.Reset(resetToken, "correct horse battery staple", audit.Client{}); errors.Is(err, ErrResetTokenInvalid) {
+		t.Errorf("expected a token fingerprinted by a previous secret to be accepted, got [%v]", err)
+	}
+}
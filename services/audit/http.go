@@ -0,0 +1,102 @@
+package audit
+
+import (
+	"errors"
+	"net/http"
+
+	"atraf-server/pkg/authentication"
+	"atraf-server/pkg/middleware"
+	"atraf-server/pkg/rest"
+	"atraf-server/pkg/uid"
+)
+
+const (
+	AccountIdParam = "account_id"
+	IPParam        = "ip"
+	TypeParam      = "type"
+)
+
+type ReadManyResponse struct {
+	Cursor string  `json:"cursor"`
+	Events []Event `json:"events"`
+}
+
+type Handler struct {
+	service *Service
+}
+
+// Activity lists the events of the authenticated account.
+func (h Handler) Activity() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := authentication.Context(r)
+
+		h.respond(w, r, Filter{AccountId: auth.AccountId})
+	}
+}
+
+// Query lists the events of every account, filtered by the account_id, ip and type query params.
+// It is only available to admins.
+func (h Handler) Query() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		var filter Filter
+
+		query := r.URL.Query()
+
+		if accountId := query.Get(AccountIdParam); accountId != "" {
+			if filter.AccountId, err = uid.FromString(accountId); err != nil {
+				rest.Error(w, err, http.StatusUnprocessableEntity)
+				return
+			}
+		}
+
+		filter.IP = query.Get(IPParam)
+		filter.Type = query.Get(TypeParam)
+
+		if filter.AccountId == uid.Nil && filter.IP == "" && filter.Type == "" {
+			rest.Error(w, errors.New("at least one filter is required"), http.StatusUnprocessableEntity)
+			return
+		}
+
+		h.respond(w, r, filter)
+	}
+}
+
+func (h Handler) respond(w http.ResponseWriter, r *http.Request, filter Filter) {
+	var cursor string
+
+	pagination := middleware.GetPaginationContext(r)
+
+	// we add an additional event in order to determine if there is another page
+	pagination.Limit++
+
+	events, err := h.service.Events(filter, pagination)
+	if err != nil {
+		rest.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if len(events) == pagination.Limit {
+		events = events[:len(events)-1]
+		lastEvent := events[len(events)-1]
+
+		cursor, err = middleware.EncodeCursor(&middleware.Cursor{
+			Key:   lastEvent.Id,
+			Value: lastEvent.CreatedAt,
+		})
+
+		if err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	rest.Success(w, http.StatusOK, &ReadManyResponse{
+		cursor,
+		events,
+	})
+}
+
+func NewHandler(s *Service) *Handler {
+	return &Handler{s}
+}
@@ -0,0 +1,150 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"atraf-server/pkg/middleware"
+	"atraf-server/pkg/uid"
+)
+
+type PostgresEvent struct {
+	Uuid        uid.UID   `db:"uuid"`
+	AccountUuid *uid.UID  `db:"account_uuid"`
+	Type        string    `db:"type"`
+	IP          string    `db:"ip"`
+	UserAgent   string    `db:"user_agent"`
+	Metadata    []byte    `db:"metadata"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+type Postgres struct {
+	db *sqlx.DB
+}
+
+func (p Postgres) Insert(accountId uid.UID, eventType string, client Client, metadata map[string]string) error {
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	var account *uid.UID
+	if accountId != uid.Nil {
+		account = &accountId
+	}
+
+	query := `
+	INSERT INTO account_events (account_uuid, type, ip, user_agent, metadata)
+	VALUES ($1, $2, $3, $4, $5)`
+
+	if _, err = p.db.Exec(query, account, eventType, client.IP, client.UserAgent, encoded); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p Postgres) Many(f Filter, pc *middleware.PaginationContext) ([]Event, error) {
+	var events []PostgresEvent
+
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+
+	// where adds a condition, replacing each "?" by the next positional parameter.
+	where := func(condition string, values ...interface{}) {
+		for _, value := range values {
+			args = append(args, value)
+			condition = strings.Replace(condition, "?", fmt.Sprintf("$%d", len(args)), 1)
+		}
+		conditions = append(conditions, condition)
+	}
+
+	if f.AccountId != uid.Nil {
+		where("account_uuid = ?", f.AccountId)
+	}
+
+	if f.IP != "" {
+		where("ip = ?", f.IP)
+	}
+
+	if f.Type != "" {
+		where("type = ?", f.Type)
+	}
+
+	if pc.Cursor.Key != uid.Nil {
+		where("(created_at, uuid) < (? :: timestamp, ?)", pc.Cursor.Value, pc.Cursor.Key)
+	}
+
+	query := `SELECT * FROM account_events`
+	if len(conditions) != 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+
+	args = append(args, pc.Limit)
+	query += fmt.Sprintf(` ORDER BY created_at DESC, uuid DESC LIMIT $%d`, len(args))
+
+	if err := p.db.Select(&events, query, args...); err != nil {
+		return nil, err
+	}
+
+	return prepareMany(events)
+}
+
+func (p Postgres) Anonymize(accountId uid.UID, email string) error {
+	query := `
+	UPDATE account_events
+	SET account_uuid = NULL,
+	    ip           = '',
+	    user_agent   = '',
+	    metadata     = '{}'
+	WHERE account_uuid = $1
+	   OR (account_uuid IS NULL AND lower(metadata ->> 'email') = lower($2))`
+
+	if _, err := p.db.Exec(query, accountId, email); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func prepareOne(pe PostgresEvent) (Event, error) {
+	event := Event{
+		Id:        pe.Uuid,
+		Type:      pe.Type,
+		IP:        pe.IP,
+		UserAgent: pe.UserAgent,
+		CreatedAt: pe.CreatedAt,
+	}
+
+	if pe.AccountUuid != nil {
+		event.AccountId = *pe.AccountUuid
+	}
+
+	if err := json.Unmarshal(pe.Metadata, &event.Metadata); err != nil {
+		return Event{}, err
+	}
+
+	return event, nil
+}
+
+func prepareMany(pe []PostgresEvent) ([]Event, error) {
+	var events = make([]Event, 0)
+
+	for _, pEvent := range pe {
+		event, err := prepareOne(pEvent)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+func NewStorage(db *sqlx.DB) *Postgres {
+	return &Postgres{db}
+}
@@ -0,0 +1,101 @@
+package audit
+
+import (
+	"net/http"
+	"time"
+
+	"atraf-server/pkg/middleware"
+	"atraf-server/pkg/rest"
+	"atraf-server/pkg/uid"
+)
+
+// Event types.
+const (
+	Registered               = "registered"
+	AccountActivated         = "account_activated"
+	ActivationFailed         = "activation_failed"
+	LoginSucceeded           = "login_succeeded"
+	LoginFailed              = "login_failed"
+	AccountLocked            = "account_locked"
+	TwoFactorChallenged      = "two_factor_challenged"
+	TwoFactorFailed          = "two_factor_failed"
+	TwoFactorEnabled         = "two_factor_enabled"
+	PasskeyAdded             = "passkey_added"
+	PasskeyRemoved           = "passkey_removed"
+	PasskeyCloneDetected     = "passkey_clone_detected"
+	MagicLinkSent            = "magic_link_sent"
+	PasswordResetRequested   = "password_reset_requested"
+	PasswordReset            = "password_reset"
+	PasswordChanged          = "password_changed"
+	EmailChangeRequested     = "email_change_requested"
+	EmailChanged             = "email_changed"
+	RoleChanged              = "role_changed"
+	AccountDeletionRequested = "account_deletion_requested"
+	AccountDeleted           = "account_deleted"
+	AccountRestored          = "account_restored"
+)
+
+// Client is the origin of the request an event was recorded for.
+type Client struct {
+	IP        string
+	UserAgent string
+}
+
+func ClientFromRequest(r *http.Request) Client {
+	return Client{
+		IP:        rest.ClientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+}
+
+type Event struct {
+	Id uid.UID `json:"id"`
+	// AccountId is Nil for events which couldn't be attributed to an account, e.g. logins with an unknown email.
+	AccountId uid.UID           `json:"account_id"`
+	Type      string            `json:"type"`
+	IP        string            `json:"ip"`
+	UserAgent string            `json:"user_agent"`
+	Metadata  map[string]string `json:"metadata"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// Filter narrows down events, zero values match any event.
+type Filter struct {
+	AccountId uid.UID
+	IP        string
+	Type      string
+}
+
+type Storage interface {
+	Insert(accountId uid.UID, eventType string, client Client, metadata map[string]string) error
+	Many(filter Filter, pagination *middleware.PaginationContext) ([]Event, error)
+	Anonymize(accountId uid.UID, email string) error
+}
+
+type Service struct {
+	storage Storage
+}
+
+// Record appends an event to the audit log.
+func (s Service) Record(accountId uid.UID, eventType string, client Client, metadata map[string]string) error {
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+
+	return s.storage.Insert(accountId, eventType, client, metadata)
+}
+
+// Events lists the events matching the filter, newest first.
+func (s Service) Events(filter Filter, pagination *middleware.PaginationContext) ([]Event, error) {
+	return s.storage.Many(filter, pagination)
+}
+
+// Anonymize strips the events of a purged account, as well as the events recorded for its email
+// without an account, of anything identifying it. The events themselves are kept.
+func (s Service) Anonymize(accountId uid.UID, email string) error {
+	return s.storage.Anonymize(accountId, email)
+}
+
+func NewService(storage Storage) *Service {
+	return &Service{storage}
+}
@@ -3,7 +3,6 @@ package bucket
 import (
 	"fmt"
 	"io"
-	"mime/multipart"
 	"net/http"
 	"os"
 )
@@ -14,7 +13,7 @@ const (
 
 type FSBucket struct{}
 
-func (FSBucket) SaveFile(name string, path string, f multipart.File) (string, error) {
+func (FSBucket) SaveFile(name string, path string, r io.Reader) (string, error) {
 	dir := fmt.Sprintf("%s/%s", UploadsBaseDir, path)
 	filename := dir + "/" + name
 
@@ -30,7 +29,7 @@ func (FSBucket) SaveFile(name string, path string, f multipart.File) (string, er
 	}
 	defer dst.Close()
 
-	if _, err = io.Copy(dst, f); err != nil {
+	if _, err = io.Copy(dst, r); err != nil {
 		return "", err
 	}
 
@@ -41,6 +40,14 @@ func (FSBucket) SaveFile(name string, path string, f multipart.File) (string, er
 	return filename, nil
 }
 
+func (FSBucket) RemoveFile(filename string) error {
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
 func (FSBucket) PrependBucketURL(filename string) string {
 	return fmt.Sprintf("%s/%s", os.Getenv("BUCKET_URL"), filename)
 }
@@ -1,61 +1,196 @@
 package bucket
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"path"
+	"strings"
 	"time"
 
+	"atraf-server/pkg/imaging"
 	"atraf-server/pkg/uid"
 )
 
+const (
+	// MaxImagePixels limits the area of decoded images,
+	// a small compressed file may otherwise decode into a huge bitmap.
+	MaxImagePixels = 16_000_000
+
+	// MaxConcurrentDecodes limits how many images are decoded at once, bounding the memory held by bitmaps.
+	MaxConcurrentDecodes = 4
+
+	JPEGQuality = 90
+)
+
+var (
+	ErrUnsupportedContentType = errors.New("unsupported content-type")
+	ErrImageTooLarge          = errors.New("image dimensions are too large")
+	ErrInvalidImage           = errors.New("image couldn't be decoded")
+)
+
 var allowedContentTypes = []string{
 	"image/png",
 	"image/jpeg",
 }
 
 type Bucket interface {
-	SaveFile(name string, path string, file multipart.File) (string, error)
+	SaveFile(name string, path string, r io.Reader) (string, error)
+	RemoveFile(filename string) error
 	PrependBucketURL(filename string) string
 }
 
 type Service struct {
-	bucket Bucket
+	bucket  Bucket
+	decodes chan struct{}
 }
 
 func (s Service) Save(f multipart.File) (string, error) {
-	buffer := make([]byte, 512)
-	if _, err := f.Read(buffer); err != nil {
+	contentType, err := s.contentType(f)
+	if err != nil {
 		return "", err
 	}
 
-	if _, err := f.Seek(0, 0); err != nil {
+	filename, filepath, err := s.uploadLocation(contentType)
+	if err != nil {
 		return "", err
 	}
 
-	contentType := http.DetectContentType(buffer)
-	if !s.checkContentType(contentType) {
-		return "", errors.New("unsupported content-type")
+	path, err := s.bucket.SaveFile(filename, filepath, f)
+	if err != nil {
+		return "", err
 	}
 
-	filename, filepath, err := s.uploadLocation(contentType)
+	return path, nil
+}
+
+// SaveImage center-crops the image and saves a square variant of every size, see ImageVariant.
+// The returned filename identifies the variants, it isn't a file itself.
+func (s Service) SaveImage(f multipart.File, sizes []int) (string, error) {
+	contentType, err := s.contentType(f)
 	if err != nil {
 		return "", err
 	}
 
-	path, err := s.bucket.SaveFile(filename, filepath, f)
+	config, _, err := image.DecodeConfig(f)
 	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+
+	if int64(config.Width)*int64(config.Height) > MaxImagePixels {
+		return "", ErrImageTooLarge
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
 		return "", err
 	}
 
-	return path, nil
+	s.decodes <- struct{}{}
+	defer func() { <-s.decodes }()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+
+	filename, filepath, err := s.uploadLocation(contentType)
+	if err != nil {
+		return "", err
+	}
+
+	square := imaging.CenterSquare(img.Bounds())
+	saved := make([]string, 0)
+
+	for _, size := range sizes {
+		var buffer bytes.Buffer
+
+		variant := imaging.Resize(img, square, size)
+		if contentType == "image/png" {
+			err = png.Encode(&buffer, variant)
+		} else {
+			err = jpeg.Encode(&buffer, variant, &jpeg.Options{Quality: JPEGQuality})
+		}
+		if err != nil {
+			s.removeAll(saved)
+			return "", err
+		}
+
+		file, err := s.bucket.SaveFile(ImageVariant(filename, size), filepath, &buffer)
+		if err != nil {
+			s.removeAll(saved)
+			return "", err
+		}
+
+		saved = append(saved, file)
+	}
+
+	if len(saved) == 0 {
+		return "", errors.New("no image sizes were requested")
+	}
+
+	return path.Join(path.Dir(saved[0]), filename), nil
+}
+
+// RemoveImage deletes the variants of an image previously saved by SaveImage.
+func (s Service) RemoveImage(filename string, sizes []int) error {
+	for _, size := range sizes {
+		if err := s.bucket.RemoveFile(ImageVariant(filename, size)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ImageVariant returns the filename of the size x size variant of an image saved by SaveImage.
+func ImageVariant(filename string, size int) string {
+	ext := path.Ext(filename)
+
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(filename, ext), size, ext)
+}
+
+// Remove deletes a file previously returned by Save, removing a missing file is not an error.
+func (s Service) Remove(filename string) error {
+	return s.bucket.RemoveFile(filename)
 }
 
 func (s Service) FileURL(filename string) string {
 	return s.bucket.PrependBucketURL(filename)
 }
 
+// removeAll deletes files saved before a failure, the original error is the one worth reporting.
+func (s Service) removeAll(filenames []string) {
+	for _, filename := range filenames {
+		_ = s.bucket.RemoveFile(filename)
+	}
+}
+
+// contentType sniffs the content type of f and checks it is allowed, f is rewound for reading.
+func (s Service) contentType(f multipart.File) (string, error) {
+	buffer := make([]byte, 512)
+	if _, err := f.Read(buffer); err != nil {
+		return "", err
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return "", err
+	}
+
+	contentType := http.DetectContentType(buffer)
+	if !s.checkContentType(contentType) {
+		return "", ErrUnsupportedContentType
+	}
+
+	return contentType, nil
+}
+
 func (Service) uploadLocation(contentType string) (string, string, error) {
 	extensions, err := mime.ExtensionsByType(contentType)
 	if err != nil || len(extensions) == 0 {
@@ -79,5 +214,5 @@ func (Service) checkContentType(contentType string) bool {
 }
 
 func NewService(b Bucket) *Service {
-	return &Service{b}
+	return &Service{b, make(chan struct{}, MaxConcurrentDecodes)}
 }
@@ -7,6 +7,7 @@ import (
 	"github.com/go-chi/chi/v5"
 
 	"atraf-server/pkg/authentication"
+	"atraf-server/pkg/authorization"
 	"atraf-server/pkg/rest"
 	"atraf-server/pkg/uid"
 	"atraf-server/pkg/validate"
@@ -73,6 +74,7 @@ func (h Handler) Create() http.HandlerFunc {
 func (h Handler) Update() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var request UpdateRequest
+		auth := authentication.Context(r)
 
 		commentId, err := uid.FromString(chi.URLParam(r, "comment_id"))
 		if err != nil {
@@ -90,6 +92,24 @@ func (h Handler) Update() http.HandlerFunc {
 			return
 		}
 
+		comment, err := h.service.CommentById(commentId)
+		if err != nil {
+			rest.Error(w, err, http.StatusNotFound)
+			return
+		}
+
+		// Dependency(Users)
+		__user, err := h.users.UserByAccountId(auth.AccountId)
+		if err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		if err = authorization.CanModify(auth.Role, __user.Id, comment.UserId); err != nil {
+			authorization.Forbidden(w, err)
+			return
+		}
+
 		if err = h.service.UpdateComment(commentId, &request); err != nil {
 			rest.Error(w, err, http.StatusBadRequest)
 			return
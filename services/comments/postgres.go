@@ -26,7 +26,26 @@ type Postgres struct {
 	db *sqlx.DB
 }
 
-func (p Postgres) Insert(userId uid.UID, sourceId uid.UID, parentId uid.UID, f *Fields) (Comment, error) {
+func (p Postgres) One(commentId uid.UID) (Comment, error) {
+	var c PostgresComment
+
+	query := `
+	SELECT comments.*
+	FROM comments
+	JOIN users ON users.uuid = comments.user_uuid
+	WHERE comments.uuid = $1
+	  AND comments.deleted_at IS NULL
+	  AND users.deleted_at IS NULL
+	LIMIT 1`
+
+	if err := p.db.Get(&c, query, commentId); err != nil {
+		return Comment{}, err
+	}
+
+	return prepareOne(c), nil
+}
+
+func (p Postgres) Insert(tx *sqlx.Tx, userId uid.UID, sourceId uid.UID, parentId uid.UID, f *Fields) (Comment, error) {
 	var c PostgresComment
 
 	query := `
@@ -34,36 +53,38 @@ func (p Postgres) Insert(userId uid.UID, sourceId uid.UID, parentId uid.UID, f *
 	VALUES ($1, $2, $3, $4) 
 	RETURNING *`
 
-	if err := p.db.Get(&c, query, userId, sourceId, parentId, f.Body); err != nil {
+	if err := tx.Get(&c, query, userId, sourceId, parentId, f.Body); err != nil {
 		return Comment{}, err
 	}
 
 	return prepareOne(c), nil
 }
 
-func (p Postgres) Update(commentId uid.UID, f *Fields) error {
-	query := `UPDATE comments SET body = $2 WHERE uuid = $1`
-	result, err := p.db.Exec(query, commentId, f.Body)
-	if err != nil {
-		return err
-	}
-
-	rows, err := result.RowsAffected()
-	if err != nil {
-		return err
-	}
+func (p Postgres) Update(tx *sqlx.Tx, commentId uid.UID, f *Fields) (Comment, error) {
+	var c PostgresComment
 
-	if rows == 0 {
-		return errors.New(fmt.Sprintf("no updates were made to comment id [%s]", commentId))
+	query := `UPDATE comments SET body = $2 WHERE uuid = $1 AND deleted_at IS NULL RETURNING *`
+	if err := tx.Get(&c, query, commentId, f.Body); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Comment{}, errors.New(fmt.Sprintf("no updates were made to comment id [%s]", commentId))
+		}
+		return Comment{}, err
 	}
 
-	return nil
+	return prepareOne(c), nil
 }
 
 func (p Postgres) Many(sourceId uid.UID) ([]Comment, error) {
 	var c []PostgresComment
 
-	query := `SELECT * FROM comments WHERE source_uuid = $1 ORDER BY created_at DESC`
+	query := `
+	SELECT comments.*
+	FROM comments
+	JOIN users ON users.uuid = comments.user_uuid
+	WHERE comments.source_uuid = $1
+	  AND comments.deleted_at IS NULL
+	  AND users.deleted_at IS NULL
+	ORDER BY comments.created_at DESC`
 	if err := p.db.Select(&c, query, sourceId); err != nil {
 		return nil, err
 	}
@@ -71,6 +92,15 @@ func (p Postgres) Many(sourceId uid.UID) ([]Comment, error) {
 	return prepareMany(c), nil
 }
 
+func (p Postgres) DeleteByUserId(userId uid.UID) error {
+	query := `DELETE FROM comments WHERE user_uuid = $1`
+	if _, err := p.db.Exec(query, userId); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func prepareOne(pc PostgresComment) Comment {
 	return Comment{
 		Id:        pc.Uuid,
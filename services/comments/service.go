@@ -3,6 +3,11 @@ package comments
 import (
 	"time"
 
+	"github.com/jmoiron/sqlx"
+
+	"atraf-server/services/events"
+
+	"atraf-server/pkg/database"
 	"atraf-server/pkg/uid"
 )
 
@@ -23,27 +28,57 @@ type Fields struct {
 }
 
 type Storage interface {
-	Insert(userId uid.UID, sourceId uid.UID, parentId uid.UID, data *Fields) (Comment, error)
-	Update(commentId uid.UID, data *Fields) error
+	One(commentId uid.UID) (Comment, error)
+	Insert(tx *sqlx.Tx, userId uid.UID, sourceId uid.UID, parentId uid.UID, data *Fields) (Comment, error)
+	Update(tx *sqlx.Tx, commentId uid.UID, data *Fields) (Comment, error)
 	Many(sourceId uid.UID) ([]Comment, error)
+	DeleteByUserId(userId uid.UID) error
 }
 
 type Service struct {
-	storage Storage
+	storage    Storage
+	transactor *database.Transactor
+	events     *events.Service
 }
 
 func (s Service) NewComment(userId uid.UID, sourceId uid.UID, parentId uid.UID, fields *Fields) (Comment, error) {
-	return s.storage.Insert(userId, sourceId, parentId, fields)
+	var comment Comment
+
+	err := s.transactor.Transaction(func(tx *sqlx.Tx) (err error) {
+		if comment, err = s.storage.Insert(tx, userId, sourceId, parentId, fields); err != nil {
+			return err
+		}
+
+		return s.events.Publish(tx, events.CommentCreated, payload(comment))
+	})
+
+	return comment, err
+}
+
+func (s Service) CommentById(commentId uid.UID) (Comment, error) {
+	return s.storage.One(commentId)
 }
 
 func (s Service) UpdateComment(commentId uid.UID, fields *Fields) error {
-	return s.storage.Update(commentId, fields)
+	return s.transactor.Transaction(func(tx *sqlx.Tx) error {
+		comment, err := s.storage.Update(tx, commentId, fields)
+		if err != nil {
+			return err
+		}
+
+		return s.events.Publish(tx, events.CommentUpdated, payload(comment))
+	})
 }
 
 func (s Service) CommentsBySourceId(sourceId uid.UID) ([]Comment, error) {
 	return s.storage.Many(sourceId)
 }
 
+// PurgeUserComments permanently deletes all comments of the user.
+func (s Service) PurgeUserComments(userId uid.UID) error {
+	return s.storage.DeleteByUserId(userId)
+}
+
 func UniqueUserIds(comments []Comment) []uid.UID {
 	userIds := make([]uid.UID, 0)
 	m := make(map[uid.UID]bool, 0)
@@ -59,6 +94,15 @@ func UniqueUserIds(comments []Comment) []uid.UID {
 	return userIds
 }
 
-func NewService(storage Storage) *Service {
-	return &Service{storage}
+func payload(comment Comment) events.CommentPayload {
+	return events.CommentPayload{
+		CommentId: comment.Id,
+		UserId:    comment.UserId,
+		SourceId:  comment.SourceId,
+		ParentId:  comment.ParentId,
+	}
+}
+
+func NewService(storage Storage, transactor *database.Transactor, events *events.Service) *Service {
+	return &Service{storage, transactor, events}
 }
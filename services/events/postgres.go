@@ -0,0 +1,134 @@
+package events
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"atraf-server/pkg/uid"
+)
+
+type PostgresEvent struct {
+	Uuid      uid.UID   `db:"uuid"`
+	Type      string    `db:"type"`
+	Payload   []byte    `db:"payload"`
+	Attempts  int       `db:"attempts"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type Postgres struct {
+	db *sqlx.DB
+}
+
+func (p Postgres) Insert(tx *sqlx.Tx, eventType string, payload []byte) error {
+	query := `INSERT INTO outbox (type, payload) VALUES ($1, $2)`
+	if _, err := tx.Exec(query, eventType, payload); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Claim leases the oldest pending events. SKIP LOCKED lets several server instances
+// claim concurrently without ever claiming the same event.
+func (p Postgres) Claim(limit int, lease time.Duration) ([]Event, error) {
+	var events []PostgresEvent
+
+	query := `
+	UPDATE outbox
+	SET locked_until = $2
+	WHERE uuid IN (
+	    SELECT uuid
+	    FROM outbox
+	    WHERE processed_at IS NULL
+	      AND failed_at IS NULL
+	      AND available_at <= current_timestamp
+	      AND (locked_until IS NULL OR locked_until < current_timestamp)
+	    ORDER BY created_at
+	    LIMIT $1
+	    FOR UPDATE SKIP LOCKED
+	)
+	RETURNING uuid, type, payload, attempts, created_at`
+
+	if err := p.db.Select(&events, query, limit, time.Now().UTC().Add(lease)); err != nil {
+		return nil, err
+	}
+
+	return prepareMany(events), nil
+}
+
+func (p Postgres) Delivered(eventId uid.UID) (map[string]bool, error) {
+	var subscribers []string
+
+	query := `SELECT subscriber FROM outbox_deliveries WHERE event_uuid = $1`
+	if err := p.db.Select(&subscribers, query, eventId); err != nil {
+		return nil, err
+	}
+
+	delivered := make(map[string]bool)
+	for _, subscriber := range subscribers {
+		delivered[subscriber] = true
+	}
+
+	return delivered, nil
+}
+
+func (p Postgres) InsertDelivery(eventId uid.UID, subscriber string) error {
+	query := `INSERT INTO outbox_deliveries (event_uuid, subscriber) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	if _, err := p.db.Exec(query, eventId, subscriber); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p Postgres) MarkProcessed(eventId uid.UID) error {
+	query := `UPDATE outbox SET processed_at = current_timestamp, locked_until = NULL WHERE uuid = $1`
+	if _, err := p.db.Exec(query, eventId); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MarkFailed schedules the event for another attempt, or gives up on it when final.
+func (p Postgres) MarkFailed(eventId uid.UID, reason string, retryAt time.Time, final bool) error {
+	query := `
+	UPDATE outbox
+	SET attempts = attempts + 1,
+	    last_error = $2,
+	    available_at = $3,
+	    locked_until = NULL,
+	    failed_at = CASE WHEN $4::boolean THEN current_timestamp END
+	WHERE uuid = $1`
+
+	if _, err := p.db.Exec(query, eventId, reason, retryAt, final); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func prepareOne(pe PostgresEvent) Event {
+	return Event{
+		Id:        pe.Uuid,
+		Type:      pe.Type,
+		Payload:   pe.Payload,
+		Attempts:  pe.Attempts,
+		CreatedAt: pe.CreatedAt,
+	}
+}
+
+func prepareMany(pe []PostgresEvent) []Event {
+	var events = make([]Event, 0)
+
+	for _, event := range pe {
+		events = append(events, prepareOne(event))
+	}
+
+	return events
+}
+
+func NewStorage(db *sqlx.DB) *Postgres {
+	return &Postgres{db}
+}
@@ -0,0 +1,176 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"atraf-server/pkg/uid"
+)
+
+// Event types.
+const (
+	AccountRegistered = "account.registered"
+	PostCreated       = "post.created"
+	PostUpdated       = "post.updated"
+	CommentCreated    = "comment.created"
+	CommentUpdated    = "comment.updated"
+)
+
+const (
+	BatchSize = 20
+	// Lease is how long a claimed event is hidden from other dispatchers while it's delivered.
+	Lease       = time.Minute
+	MaxAttempts = 10
+	MaxBackoff  = time.Hour
+)
+
+type AccountRegisteredPayload struct {
+	AccountId uid.UID `json:"account_id"`
+}
+
+type PostPayload struct {
+	PostId uid.UID `json:"post_id"`
+	UserId uid.UID `json:"user_id"`
+}
+
+type CommentPayload struct {
+	CommentId uid.UID `json:"comment_id"`
+	UserId    uid.UID `json:"user_id"`
+	SourceId  uid.UID `json:"source_id"`
+	ParentId  uid.UID `json:"parent_id"`
+}
+
+type Event struct {
+	Id        uid.UID         `json:"id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"-"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// Decode unmarshals the event payload into dest.
+func (e Event) Decode(dest interface{}) error {
+	return json.Unmarshal(e.Payload, dest)
+}
+
+// Handler handles a single event. Events are delivered at least once,
+// so a handler may see the same event again and must be idempotent.
+type Handler func(event Event) error
+
+type subscription struct {
+	name    string
+	handler Handler
+}
+
+type Storage interface {
+	Insert(tx *sqlx.Tx, eventType string, payload []byte) error
+	Claim(limit int, lease time.Duration) ([]Event, error)
+	Delivered(eventId uid.UID) (map[string]bool, error)
+	InsertDelivery(eventId uid.UID, subscriber string) error
+	MarkProcessed(eventId uid.UID) error
+	MarkFailed(eventId uid.UID, reason string, retryAt time.Time, final bool) error
+}
+
+// Service is the domain event bus. Events are published to the outbox as part of
+// the transaction making the change, and dispatched to the subscribers once committed.
+type Service struct {
+	storage       Storage
+	subscriptions map[string][]subscription
+}
+
+// Publish writes the event to the outbox within tx.
+func (s Service) Publish(tx *sqlx.Tx, eventType string, payload interface{}) error {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	return s.storage.Insert(tx, eventType, encoded)
+}
+
+// Subscribe registers handler for events of eventType. The name identifies the subscriber
+// across restarts, so it must be unique and stable. Subscribing isn't safe once dispatching started.
+func (s *Service) Subscribe(eventType string, name string, handler Handler) {
+	s.subscriptions[eventType] = append(s.subscriptions[eventType], subscription{name, handler})
+}
+
+// Dispatch delivers the pending events to their subscribers until none are left.
+func (s Service) Dispatch() error {
+	for {
+		pending, err := s.storage.Claim(BatchSize, Lease)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range pending {
+			if err = s.deliver(event); err != nil {
+				return err
+			}
+		}
+
+		if len(pending) < BatchSize {
+			return nil
+		}
+	}
+}
+
+// Start dispatches on every interval tick, it blocks and is meant to run in its own goroutine.
+func (s Service) Start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.Dispatch(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// deliver hands the event to every subscriber which hasn't handled it yet.
+// A failing subscriber doesn't stop the others, the event is retried with an exponential backoff.
+func (s Service) deliver(event Event) error {
+	delivered, err := s.storage.Delivered(event.Id)
+	if err != nil {
+		return err
+	}
+
+	var failure error
+	for _, sub := range s.subscriptions[event.Type] {
+		if delivered[sub.name] {
+			continue
+		}
+
+		if err = sub.handler(event); err != nil {
+			failure = fmt.Errorf("subscriber [%s] failed on event [%s]: %w", sub.name, event.Id, err)
+			log.Println(failure)
+			continue
+		}
+
+		if err = s.storage.InsertDelivery(event.Id, sub.name); err != nil {
+			return err
+		}
+	}
+
+	if failure == nil {
+		return s.storage.MarkProcessed(event.Id)
+	}
+
+	attempts := event.Attempts + 1
+	backoff := time.Second << attempts
+	if backoff > MaxBackoff {
+		backoff = MaxBackoff
+	}
+
+	return s.storage.MarkFailed(event.Id, failure.Error(), time.Now().UTC().Add(backoff), attempts >= MaxAttempts)
+}
+
+func NewService(storage Storage) *Service {
+	return &Service{
+		storage:       storage,
+		subscriptions: make(map[string][]subscription),
+	}
+}
@@ -0,0 +1,127 @@
+package invites
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"atraf-server/pkg/authentication"
+	"atraf-server/pkg/authorization"
+	"atraf-server/pkg/rest"
+	"atraf-server/pkg/uid"
+	"atraf-server/pkg/validate"
+)
+
+type CreateRequest = Fields
+
+type CreateResponse struct {
+	Invite Invite `json:"invite"`
+}
+
+type ReadManyResponse struct {
+	Invites []Invite `json:"invites"`
+}
+
+type InviteesResponse struct {
+	Invitees []Invitee `json:"invitees"`
+}
+
+type Handler struct {
+	service  *Service
+	validate *validate.Validate
+}
+
+func (h Handler) Create() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request CreateRequest
+		auth := authentication.Context(r)
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err := h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		invite, err := h.service.NewInvite(auth.AccountId, auth.Role, &request)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrInviteNotAllowed):
+				rest.Forbidden(w, err, authorization.ReasonInsufficientRole)
+			case errors.Is(err, ErrInviteLimit):
+				rest.Error(w, err, http.StatusConflict)
+			default:
+				rest.Error(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		rest.Success(w, http.StatusCreated, &CreateResponse{
+			invite,
+		})
+	}
+}
+
+func (h Handler) ReadMany() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := authentication.Context(r)
+
+		invites, err := h.service.Invites(auth.AccountId)
+		if err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		rest.Success(w, http.StatusOK, &ReadManyResponse{
+			invites,
+		})
+	}
+}
+
+func (h Handler) Invitees() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := authentication.Context(r)
+
+		invitees, err := h.service.Invitees(auth.AccountId)
+		if err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		rest.Success(w, http.StatusOK, &InviteesResponse{
+			invitees,
+		})
+	}
+}
+
+func (h Handler) Revoke() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := authentication.Context(r)
+
+		inviteId, err := uid.FromString(chi.URLParam(r, "invite_id"))
+		if err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		err = h.service.Revoke(auth.AccountId, auth.Role, inviteId)
+		switch {
+		case err == nil:
+			rest.Success(w, http.StatusNoContent, nil)
+		case errors.Is(err, sql.ErrNoRows), errors.Is(err, ErrInviteNotRevocable):
+			rest.Error(w, err, http.StatusNotFound)
+		default:
+			authorization.Forbidden(w, err)
+		}
+	}
+}
+
+func NewHandler(s *Service, v *validate.Validate) *Handler {
+	return &Handler{s, v}
+}
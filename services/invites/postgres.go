@@ -0,0 +1,188 @@
+package invites
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"atraf-server/pkg/uid"
+)
+
+type PostgresInvite struct {
+	Uuid        uid.UID      `db:"uuid"`
+	AccountUuid uid.UID      `db:"account_uuid"`
+	Code        string       `db:"code"`
+	MaxUses     int          `db:"max_uses"`
+	Uses        int          `db:"uses"`
+	ExpiresAt   sql.NullTime `db:"expires_at"`
+	RevokedAt   sql.NullTime `db:"revoked_at"`
+	CreatedAt   time.Time    `db:"created_at"`
+}
+
+type PostgresInvitee struct {
+	InviteUuid  uid.UID   `db:"invite_uuid"`
+	AccountUuid uid.UID   `db:"account_uuid"`
+	InvitedBy   uid.UID   `db:"invited_by"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+type Postgres struct {
+	db *sqlx.DB
+}
+
+func (p Postgres) Insert(accountId uid.UID, code string, maxUses int, expiresAt time.Time) (Invite, error) {
+	var i PostgresInvite
+
+	query := `
+	INSERT INTO invites (account_uuid, code, max_uses, expires_at)
+	VALUES ($1, $2, $3, $4)
+	RETURNING *`
+
+	expires := sql.NullTime{Time: expiresAt, Valid: !expiresAt.IsZero()}
+	if err := p.db.Get(&i, query, accountId, code, maxUses, expires); err != nil {
+		return Invite{}, err
+	}
+
+	return prepareOne(i), nil
+}
+
+func (p Postgres) One(inviteId uid.UID) (Invite, error) {
+	var i PostgresInvite
+
+	query := `SELECT * FROM invites WHERE uuid = $1 LIMIT 1`
+	if err := p.db.Get(&i, query, inviteId); err != nil {
+		return Invite{}, err
+	}
+
+	return prepareOne(i), nil
+}
+
+func (p Postgres) ByAccountId(accountId uid.UID) ([]Invite, error) {
+	var i []PostgresInvite
+
+	query := `
+	SELECT *
+	FROM invites
+	WHERE account_uuid = $1
+	  AND revoked_at IS NULL
+	ORDER BY created_at DESC`
+
+	if err := p.db.Select(&i, query, accountId); err != nil {
+		return nil, err
+	}
+
+	return prepareMany(i), nil
+}
+
+func (p Postgres) CountPending(accountId uid.UID) (int, error) {
+	var count int
+
+	query := `
+	SELECT count(*)
+	FROM invites
+	WHERE account_uuid = $1
+	  AND revoked_at IS NULL
+	  AND uses < max_uses
+	  AND (expires_at IS NULL OR expires_at > current_timestamp)`
+
+	if err := p.db.Get(&count, query, accountId); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// Redeem increments the invite uses, the conditional update makes sure concurrent
+// registrations can't use an invite more than max_uses times.
+func (p Postgres) Redeem(tx *sqlx.Tx, code string, accountId uid.UID) (Invite, error) {
+	var i PostgresInvite
+
+	query := `
+	UPDATE invites
+	SET uses = uses + 1
+	WHERE code = $1
+	  AND revoked_at IS NULL
+	  AND uses < max_uses
+	  AND (expires_at IS NULL OR expires_at > current_timestamp)
+	RETURNING *`
+
+	if err := tx.Get(&i, query, code); err != nil {
+		return Invite{}, err
+	}
+
+	query = `INSERT INTO invite_redemptions (invite_uuid, account_uuid, invited_by) VALUES ($1, $2, $3)`
+	if _, err := tx.Exec(query, i.Uuid, accountId, i.AccountUuid); err != nil {
+		return Invite{}, err
+	}
+
+	return prepareOne(i), nil
+}
+
+func (p Postgres) Revoke(inviteId uid.UID) error {
+	query := `UPDATE invites SET revoked_at = current_timestamp WHERE uuid = $1 AND revoked_at IS NULL`
+
+	result, err := p.db.Exec(query, inviteId)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrInviteNotRevocable
+	}
+
+	return nil
+}
+
+func (p Postgres) Invitees(invitedBy uid.UID) ([]Invitee, error) {
+	var i []PostgresInvitee
+
+	query := `SELECT * FROM invite_redemptions WHERE invited_by = $1 ORDER BY created_at DESC`
+	if err := p.db.Select(&i, query, invitedBy); err != nil {
+		return nil, err
+	}
+
+	invitees := make([]Invitee, 0)
+	for _, invitee := range i {
+		invitees = append(invitees, Invitee{
+			AccountId: invitee.AccountUuid,
+			InviteId:  invitee.InviteUuid,
+			InvitedBy: invitee.InvitedBy,
+			CreatedAt: invitee.CreatedAt,
+		})
+	}
+
+	return invitees, nil
+}
+
+func prepareOne(pi PostgresInvite) Invite {
+	return Invite{
+		Id:        pi.Uuid,
+		AccountId: pi.AccountUuid,
+		Code:      pi.Code,
+		MaxUses:   pi.MaxUses,
+		Uses:      pi.Uses,
+		ExpiresAt: pi.ExpiresAt.Time,
+		RevokedAt: pi.RevokedAt.Time,
+		CreatedAt: pi.CreatedAt,
+	}
+}
+
+func prepareMany(pi []PostgresInvite) []Invite {
+	var i = make([]Invite, 0)
+
+	for _, invite := range pi {
+		i = append(i, prepareOne(invite))
+	}
+
+	return i
+}
+
+func NewStorage(db *sqlx.DB) *Postgres {
+	return &Postgres{db}
+}
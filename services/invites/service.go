@@ -0,0 +1,150 @@
+package invites
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"atraf-server/pkg/authorization"
+	"atraf-server/pkg/token"
+	"atraf-server/pkg/uid"
+)
+
+const (
+	CodeSize = 9
+
+	// Invites of regular users are single use, expire within UserMaxExpiry
+	// and at most UserOpenInvites of them may be pending at a time.
+	UserMaxUses     = 1
+	UserMaxExpiry   = time.Hour * 24 * 7
+	UserOpenInvites = 5
+
+	DefaultExpiry = time.Hour * 24 * 7
+)
+
+var (
+	ErrInviteInvalid      = errors.New("invite code is invalid, expired or used up")
+	ErrInviteLimit        = errors.New("too many pending invites")
+	ErrInviteNotAllowed   = errors.New("invite exceeds the limits of the account role")
+	ErrInviteNotRevocable = errors.New("invite couldn't be revoked")
+)
+
+type Invite struct {
+	Id        uid.UID   `json:"id"`
+	AccountId uid.UID   `json:"account_id"`
+	Code      string    `json:"code"`
+	MaxUses   int       `json:"max_uses"`
+	Uses      int       `json:"uses"`
+	ExpiresAt time.Time `json:"expires_at"`
+	RevokedAt time.Time `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Fields are Invite fields which are set by the client.
+type Fields struct {
+	// MaxUses defaults to a single use.
+	MaxUses int `json:"max_uses" validate:"min=0,max=1000"`
+	// ExpiresInDays defaults to DefaultExpiry.
+	ExpiresInDays int `json:"expires_in_days" validate:"min=0,max=365"`
+}
+
+// Invitee is an account registered using an invite.
+type Invitee struct {
+	AccountId uid.UID   `json:"account_id"`
+	InviteId  uid.UID   `json:"invite_id"`
+	InvitedBy uid.UID   `json:"invited_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Storage interface {
+	Insert(accountId uid.UID, code string, maxUses int, expiresAt time.Time) (Invite, error)
+	One(inviteId uid.UID) (Invite, error)
+	ByAccountId(accountId uid.UID) ([]Invite, error)
+	CountPending(accountId uid.UID) (int, error)
+	Redeem(tx *sqlx.Tx, code string, accountId uid.UID) (Invite, error)
+	Revoke(inviteId uid.UID) error
+	Invitees(invitedBy uid.UID) ([]Invitee, error)
+}
+
+type Service struct {
+	storage Storage
+}
+
+// NewInvite creates an invite on behalf of the account. Admins may create invites with
+// any number of uses and expiry, whereas everyone else is held to the User* limits.
+func (s Service) NewInvite(accountId uid.UID, role string, f *Fields) (Invite, error) {
+	maxUses := f.MaxUses
+	if maxUses == 0 {
+		maxUses = 1
+	}
+
+	expiry := DefaultExpiry
+	if f.ExpiresInDays > 0 {
+		expiry = time.Hour * 24 * time.Duration(f.ExpiresInDays)
+	}
+
+	if !authorization.HasRole(role, authorization.RoleAdmin) {
+		if maxUses > UserMaxUses || expiry > UserMaxExpiry {
+			return Invite{}, ErrInviteNotAllowed
+		}
+
+		pending, err := s.storage.CountPending(accountId)
+		if err != nil {
+			return Invite{}, err
+		}
+
+		if pending >= UserOpenInvites {
+			return Invite{}, ErrInviteLimit
+		}
+	}
+
+	code, err := token.NewOpaqueToken(CodeSize)
+	if err != nil {
+		return Invite{}, err
+	}
+
+	return s.storage.Insert(accountId, code, maxUses, time.Now().UTC().Add(expiry))
+}
+
+func (s Service) Invites(accountId uid.UID) ([]Invite, error) {
+	return s.storage.ByAccountId(accountId)
+}
+
+// Invitees lists the accounts which registered using one of the account's invites.
+func (s Service) Invitees(accountId uid.UID) ([]Invitee, error) {
+	return s.storage.Invitees(accountId)
+}
+
+// Revoke revokes the invite, provided it belongs to the account or the account is a moderator.
+func (s Service) Revoke(accountId uid.UID, role string, inviteId uid.UID) error {
+	invite, err := s.storage.One(inviteId)
+	if err != nil {
+		return err
+	}
+
+	if err = authorization.CanModify(role, accountId, invite.AccountId); err != nil {
+		return err
+	}
+
+	return s.storage.Revoke(inviteId)
+}
+
+// Redeem uses up the invite for the newly registered account within tx,
+// and returns the id of the inviting account.
+func (s Service) Redeem(tx *sqlx.Tx, code string, accountId uid.UID) (uid.UID, error) {
+	invite, err := s.storage.Redeem(tx, code, accountId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return uid.Nil, ErrInviteInvalid
+	}
+	if err != nil {
+		return uid.Nil, err
+	}
+
+	return invite.AccountId, nil
+}
+
+func NewService(storage Storage) *Service {
+	return &Service{storage}
+}
@@ -0,0 +1,80 @@
+package notifications
+
+import (
+	"database/sql"
+	"errors"
+	"net/mail"
+
+	"atraf-server/pkg/mailer"
+	"atraf-server/services/events"
+	"atraf-server/services/posts"
+	"atraf-server/services/users"
+)
+
+// Service notifies users by mail about activity on their content.
+// It only reacts to events, the other services never call it directly.
+type Service struct {
+	users *users.Service
+	posts *posts.Service
+}
+
+// Subscribe registers the notification subscribers on the event bus.
+func (s Service) Subscribe(bus *events.Service) {
+	bus.Subscribe(events.CommentCreated, "notifications.comment_mail", s.onCommentCreated)
+}
+
+// onCommentCreated lets the post author know about a new comment on their post.
+func (s Service) onCommentCreated(event events.Event) error {
+	var payload events.CommentPayload
+	if err := event.Decode(&payload); err != nil {
+		return err
+	}
+
+	post, err := s.posts.PostById(payload.SourceId)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The post was purged before the event got delivered.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if post.UserId == payload.UserId {
+		return nil
+	}
+
+	author, err := s.users.UserById(post.UserId)
+	if err != nil {
+		return err
+	}
+
+	commenter, err := s.users.UserById(payload.UserId)
+	if err != nil {
+		return err
+	}
+
+	return sendCommentMail(author, commenter, post)
+}
+
+func sendCommentMail(author users.User, commenter users.User, post posts.Post) error {
+	subject := "New Comment On Your Post"
+	from := mail.Address{
+		Name:    "Atraf Notifications",
+		Address: "notifications@atraf.app",
+	}
+
+	data := struct {
+		Nickname  string
+		PostTitle string
+	}{
+		Nickname:  commenter.Nickname,
+		PostTitle: post.Title,
+	}
+
+	filename := "templates/comment-notification.html"
+	return mailer.FromTemplate(filename, data, subject, from, []string{author.Email})
+}
+
+func NewService(users *users.Service, posts *posts.Service) *Service {
+	return &Service{users, posts}
+}
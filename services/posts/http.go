@@ -9,6 +9,7 @@ import (
 	"atraf-server/services/users"
 
 	"atraf-server/pkg/authentication"
+	"atraf-server/pkg/authorization"
 	"atraf-server/pkg/middleware"
 	"atraf-server/pkg/rest"
 	"atraf-server/pkg/uid"
@@ -50,7 +51,7 @@ func (h Handler) Create() http.HandlerFunc {
 		auth := authentication.Context(r)
 
 		// set max request size
-		r.Body = http.MaxBytesReader(w, r.Body, AttachmentMaxSize)
+		middleware.SetMaxBodySize(w, r, AttachmentMaxSize)
 
 		// set max size allowed before writing to the filesystem.
 		if err := r.ParseMultipartForm(AttachmentMaxSize); err != nil {
@@ -99,6 +100,7 @@ func (h Handler) Create() http.HandlerFunc {
 func (h Handler) Update() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var request UpdateRequest
+		auth := authentication.Context(r)
 
 		postId, err := uid.FromString(chi.URLParam(r, "post_id"))
 		if err != nil {
@@ -116,6 +118,24 @@ func (h Handler) Update() http.HandlerFunc {
 			return
 		}
 
+		post, err := h.service.PostById(postId)
+		if err != nil {
+			rest.Error(w, err, http.StatusNotFound)
+			return
+		}
+
+		// Dependency(Users)
+		__user, err := h.users.UserByAccountId(auth.AccountId)
+		if err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		if err = authorization.CanModify(auth.Role, __user.Id, post.UserId); err != nil {
+			authorization.Forbidden(w, err)
+			return
+		}
+
 		if err = h.service.UpdatePost(postId, &request); err != nil {
 			rest.Error(w, err, http.StatusBadRequest)
 			return
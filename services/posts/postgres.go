@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"log"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -32,7 +33,14 @@ type Postgres struct {
 func (p Postgres) One(postId uid.UID) (Post, error) {
 	var post PostgresPost
 
-	query := `SELECT * FROM posts WHERE posts.uuid = $1 LIMIT 1`
+	query := `
+	SELECT posts.*
+	FROM posts
+	JOIN users ON users.uuid = posts.user_uuid
+	WHERE posts.uuid = $1
+	  AND posts.deleted_at IS NULL
+	  AND users.deleted_at IS NULL
+	LIMIT 1`
 
 	// Returns an error when no results are found.
 	if err := p.db.Get(&post, query, postId); err != nil {
@@ -47,9 +55,12 @@ func (p Postgres) Many(pc *middleware.PaginationContext) ([]Post, error) {
 
 	if pc.Cursor.Key != uid.Nil {
 		query := `
-		SELECT *
+		SELECT posts.*
 		FROM posts 
+		JOIN users ON users.uuid = posts.user_uuid
 		WHERE (posts.created_at, posts.uuid) < ($1 :: timestamp, $2) 
+		  AND posts.deleted_at IS NULL
+		  AND users.deleted_at IS NULL
 		ORDER BY posts.created_at DESC 
 		LIMIT $3`
 
@@ -58,8 +69,11 @@ func (p Postgres) Many(pc *middleware.PaginationContext) ([]Post, error) {
 		}
 	} else {
 		query := `
-		SELECT *
+		SELECT posts.*
 		FROM posts
+		JOIN users ON users.uuid = posts.user_uuid
+		WHERE posts.deleted_at IS NULL
+		  AND users.deleted_at IS NULL
 		ORDER BY posts.created_at DESC 
 		LIMIT $1`
 
@@ -71,7 +85,7 @@ func (p Postgres) Many(pc *middleware.PaginationContext) ([]Post, error) {
 	return p.prepareMany(posts), nil
 }
 
-func (p Postgres) Insert(userId uid.UID, f *Fields) (uid.UID, error) {
+func (p Postgres) Insert(tx *sqlx.Tx, userId uid.UID, f *Fields) (uid.UID, error) {
 	var uuid uid.UID
 
 	attachmentPath, err := p.bucket.Save(f.File)
@@ -80,27 +94,41 @@ func (p Postgres) Insert(userId uid.UID, f *Fields) (uid.UID, error) {
 	}
 
 	query := "INSERT INTO posts (user_uuid, title, body, attachment) VALUES ($1, $2, $3, $4) RETURNING uuid"
-	if err = p.db.Get(&uuid, query, userId, f.Title, f.Body, attachmentPath); err != nil {
+	if err = tx.Get(&uuid, query, userId, f.Title, f.Body, attachmentPath); err != nil {
 		return uuid, err
 	}
 
 	return uuid, nil
 }
 
-func (p Postgres) Update(postId uid.UID, f *Fields) error {
-	query := `UPDATE posts SET title = $2, body = $3 WHERE uuid = $1`
-	result, err := p.db.Exec(query, postId, f.Title, f.Body)
-	if err != nil {
-		return err
+func (p Postgres) Update(tx *sqlx.Tx, postId uid.UID, f *Fields) (Post, error) {
+	var post PostgresPost
+
+	query := `UPDATE posts SET title = $2, body = $3 WHERE uuid = $1 AND deleted_at IS NULL RETURNING *`
+	if err := tx.Get(&post, query, postId, f.Title, f.Body); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Post{}, errors.New(fmt.Sprintf("no updates were made to post id [%s]", postId))
+		}
+		return Post{}, err
 	}
 
-	rows, err := result.RowsAffected()
-	if err != nil {
+	return p.prepareOne(post), nil
+}
+
+// DeleteByUserId permanently deletes all posts of the user along with their attachments.
+// Attachments are removed once the posts are deleted, failing to remove one is only logged.
+func (p Postgres) DeleteByUserId(userId uid.UID) error {
+	var attachments []string
+
+	query := `DELETE FROM posts WHERE user_uuid = $1 RETURNING attachment`
+	if err := p.db.Select(&attachments, query, userId); err != nil {
 		return err
 	}
 
-	if rows == 0 {
-		return errors.New(fmt.Sprintf("no updates were made to post id [%s]", postId))
+	for _, attachment := range attachments {
+		if err := p.bucket.Remove(attachment); err != nil {
+			log.Println(err)
+		}
 	}
 
 	return nil
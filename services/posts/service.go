@@ -4,6 +4,11 @@ import (
 	"mime/multipart"
 	"time"
 
+	"github.com/jmoiron/sqlx"
+
+	"atraf-server/services/events"
+
+	"atraf-server/pkg/database"
 	"atraf-server/pkg/middleware"
 	"atraf-server/pkg/uid"
 )
@@ -29,16 +34,32 @@ type Fields struct {
 type Storage interface {
 	One(postId uid.UID) (Post, error)
 	Many(pagination *middleware.PaginationContext) ([]Post, error)
-	Insert(userId uid.UID, fields *Fields) (uid.UID, error)
-	Update(postId uid.UID, fields *Fields) error
+	Insert(tx *sqlx.Tx, userId uid.UID, fields *Fields) (uid.UID, error)
+	Update(tx *sqlx.Tx, postId uid.UID, fields *Fields) (Post, error)
+	DeleteByUserId(userId uid.UID) error
 }
 
 type Service struct {
-	storage Storage
+	storage    Storage
+	transactor *database.Transactor
+	events     *events.Service
 }
 
 func (s Service) NewPost(userId uid.UID, f *Fields) (uid.UID, error) {
-	return s.storage.Insert(userId, f)
+	var postId uid.UID
+
+	err := s.transactor.Transaction(func(tx *sqlx.Tx) (err error) {
+		if postId, err = s.storage.Insert(tx, userId, f); err != nil {
+			return err
+		}
+
+		return s.events.Publish(tx, events.PostCreated, events.PostPayload{
+			PostId: postId,
+			UserId: userId,
+		})
+	})
+
+	return postId, err
 }
 
 func (s Service) PostById(postId uid.UID) (Post, error) {
@@ -50,7 +71,22 @@ func (s Service) Posts(p *middleware.PaginationContext) ([]Post, error) {
 }
 
 func (s Service) UpdatePost(postId uid.UID, f *Fields) error {
-	return s.storage.Update(postId, f)
+	return s.transactor.Transaction(func(tx *sqlx.Tx) error {
+		post, err := s.storage.Update(tx, postId, f)
+		if err != nil {
+			return err
+		}
+
+		return s.events.Publish(tx, events.PostUpdated, events.PostPayload{
+			PostId: post.Id,
+			UserId: post.UserId,
+		})
+	})
+}
+
+// PurgeUserPosts permanently deletes all posts of the user.
+func (s Service) PurgeUserPosts(userId uid.UID) error {
+	return s.storage.DeleteByUserId(userId)
 }
 
 func UniqueUserIds(p []Post) []uid.UID {
@@ -68,6 +104,6 @@ func UniqueUserIds(p []Post) []uid.UID {
 	return userIds
 }
 
-func NewService(s Storage) *Service {
-	return &Service{s}
+func NewService(s Storage, t *database.Transactor, e *events.Service) *Service {
+	return &Service{s, t, e}
 }
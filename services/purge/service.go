@@ -0,0 +1,91 @@
+package purge
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"atraf-server/services/account"
+	"atraf-server/services/audit"
+	"atraf-server/services/comments"
+	"atraf-server/services/posts"
+	"atraf-server/services/sessions"
+	"atraf-server/services/users"
+)
+
+// Service permanently removes accounts whose deletion grace period has passed,
+// along with everything they own in the other services.
+type Service struct {
+	accounts *account.Service
+	sessions *sessions.Service
+	users    *users.Service
+	posts    *posts.Service
+	comments *comments.Service
+	audit    *audit.Service
+}
+
+// Run purges every expired account.
+// The account row is deleted last, so an interrupted purge is picked up again on the next run.
+// An account failing to be purged doesn't hold back the others, it is retried on the next run.
+func (s Service) Run() error {
+	expired, err := s.accounts.ExpiredDeletions()
+	if err != nil {
+		return err
+	}
+
+	for _, a := range expired {
+		if err = s.purgeAccount(a); err != nil {
+			log.Printf("purging account [%s]: %v", a.Id, err)
+		}
+	}
+
+	return nil
+}
+
+// Start runs the purge on every interval tick, it blocks and is meant to run in its own goroutine.
+func (s Service) Start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.Run(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (s Service) purgeAccount(a account.Account) error {
+	user, err := s.users.DeletedUserByAccountId(a.Id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if err == nil {
+		if err = s.comments.PurgeUserComments(user.Id); err != nil {
+			return err
+		}
+
+		if err = s.posts.PurgeUserPosts(user.Id); err != nil {
+			return err
+		}
+
+		if err = s.users.PurgeUser(a.Id); err != nil {
+			return err
+		}
+	}
+
+	if err = s.sessions.Purge(a.Id); err != nil {
+		return err
+	}
+
+	if err = s.audit.Anonymize(a.Id, a.Email); err != nil {
+		return err
+	}
+
+	return s.accounts.Purge(a.Id)
+}
+
+func NewService(a *account.Service, ss *sessions.Service, u *users.Service, p *posts.Service, c *comments.Service, au *audit.Service) *Service {
+	return &Service{a, ss, u, p, c, au}
+}
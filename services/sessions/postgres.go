@@ -0,0 +1,243 @@
+package sessions
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"atraf-server/pkg/uid"
+)
+
+type PostgresSession struct {
+	Uuid        uid.UID      `db:"uuid"`
+	AccountUuid uid.UID      `db:"account_uuid"`
+	UserAgent   string       `db:"user_agent"`
+	IP          string       `db:"ip"`
+	CreatedAt   time.Time    `db:"created_at"`
+	LastSeenAt  time.Time    `db:"last_seen_at"`
+	ExpiresAt   time.Time    `db:"expires_at"`
+	RevokedAt   sql.NullTime `db:"revoked_at"`
+}
+
+type PostgresRefreshToken struct {
+	Uuid        uid.UID      `db:"uuid"`
+	SessionUuid uid.UID      `db:"session_uuid"`
+	TokenHash   string       `db:"token_hash"`
+	CreatedAt   time.Time    `db:"created_at"`
+	UsedAt      sql.NullTime `db:"used_at"`
+}
+
+type Postgres struct {
+	db *sqlx.DB
+}
+
+func (p Postgres) Insert(accountId uid.UID, userAgent string, ip string, expiresAt time.Time) (Session, error) {
+	var session PostgresSession
+
+	query := `
+	INSERT INTO sessions (account_uuid, user_agent, ip, expires_at)
+	VALUES ($1, $2, $3, $4)
+	RETURNING *`
+
+	if err := p.db.Get(&session, query, accountId, userAgent, ip, expiresAt); err != nil {
+		return Session{}, err
+	}
+
+	return prepareOne(session), nil
+}
+
+func (p Postgres) ById(sessionId uid.UID) (Session, error) {
+	var session PostgresSession
+
+	query := `SELECT * FROM sessions WHERE uuid = $1 LIMIT 1`
+	if err := p.db.Get(&session, query, sessionId); err != nil {
+		return Session{}, err
+	}
+
+	return prepareOne(session), nil
+}
+
+func (p Postgres) ByAccountId(accountId uid.UID) ([]Session, error) {
+	var sessions []PostgresSession
+
+	query := `
+	SELECT *
+	FROM sessions
+	WHERE account_uuid = $1
+	  AND revoked_at IS NULL
+	  AND expires_at > current_timestamp
+	ORDER BY last_seen_at DESC`
+
+	if err := p.db.Select(&sessions, query, accountId); err != nil {
+		return nil, err
+	}
+
+	return prepareMany(sessions), nil
+}
+
+func (p Postgres) Touch(sessionId uid.UID, ip string) error {
+	query := `UPDATE sessions SET last_seen_at = current_timestamp, ip = $2 WHERE uuid = $1`
+	if _, err := p.db.Exec(query, sessionId, ip); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p Postgres) Revoke(sessionId uid.UID) error {
+	query := `UPDATE sessions SET revoked_at = current_timestamp WHERE uuid = $1 AND revoked_at IS NULL`
+	if _, err := p.db.Exec(query, sessionId); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p Postgres) RevokeOwned(accountId uid.UID, sessionId uid.UID) error {
+	query := `
+	UPDATE sessions
+	SET revoked_at = current_timestamp
+	WHERE uuid = $1
+	  AND account_uuid = $2
+	  AND revoked_at IS NULL`
+
+	result, err := p.db.Exec(query, sessionId, accountId)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return errors.New(fmt.Sprintf("session id [%s] couldn't be revoked", sessionId))
+	}
+
+	return nil
+}
+
+func (p Postgres) RevokeAll(accountId uid.UID) error {
+	query := `UPDATE sessions SET revoked_at = current_timestamp WHERE account_uuid = $1 AND revoked_at IS NULL`
+	if _, err := p.db.Exec(query, accountId); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p Postgres) RevokeAllExcept(accountId uid.UID, sessionId uid.UID) error {
+	query := `
+	UPDATE sessions
+	SET revoked_at = current_timestamp
+	WHERE account_uuid = $1
+	  AND uuid != $2
+	  AND revoked_at IS NULL`
+
+	if _, err := p.db.Exec(query, accountId, sessionId); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Delete permanently deletes all sessions of the account along with their refresh tokens.
+func (p Postgres) Delete(accountId uid.UID) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM refresh_tokens WHERE session_uuid IN (SELECT uuid FROM sessions WHERE account_uuid = $1)`
+	if _, err = tx.Exec(query, accountId); err != nil {
+		return err
+	}
+
+	query = `DELETE FROM sessions WHERE account_uuid = $1`
+	if _, err = tx.Exec(query, accountId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p Postgres) InsertRefreshToken(sessionId uid.UID, tokenHash string) error {
+	query := `INSERT INTO refresh_tokens (session_uuid, token_hash) VALUES ($1, $2)`
+	if _, err := p.db.Exec(query, sessionId, tokenHash); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p Postgres) RefreshTokenByHash(tokenHash string) (RefreshToken, error) {
+	var rt PostgresRefreshToken
+
+	query := `SELECT * FROM refresh_tokens WHERE token_hash = $1 LIMIT 1`
+	if err := p.db.Get(&rt, query, tokenHash); err != nil {
+		return RefreshToken{}, err
+	}
+
+	return RefreshToken{
+		Id:        rt.Uuid,
+		SessionId: rt.SessionUuid,
+		CreatedAt: rt.CreatedAt,
+		UsedAt:    rt.UsedAt.Time,
+	}, nil
+}
+
+func (p Postgres) ConsumeRefreshToken(tokenHash string) error {
+	query := `
+	UPDATE refresh_tokens
+	SET used_at = current_timestamp
+	WHERE token_hash = $1
+	  AND used_at IS NULL`
+
+	result, err := p.db.Exec(query, tokenHash)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return errors.New("refresh token couldn't be consumed")
+	}
+
+	return nil
+}
+
+func prepareOne(ps PostgresSession) Session {
+	return Session{
+		Id:         ps.Uuid,
+		AccountId:  ps.AccountUuid,
+		UserAgent:  ps.UserAgent,
+		IP:         ps.IP,
+		CreatedAt:  ps.CreatedAt,
+		LastSeenAt: ps.LastSeenAt,
+		ExpiresAt:  ps.ExpiresAt,
+		RevokedAt:  ps.RevokedAt.Time,
+	}
+}
+
+func prepareMany(ps []PostgresSession) []Session {
+	var sessions = make([]Session, 0)
+
+	for _, session := range ps {
+		sessions = append(sessions, prepareOne(session))
+	}
+
+	return sessions
+}
+
+func NewStorage(db *sqlx.DB) *Postgres {
+	return &Postgres{db}
+}
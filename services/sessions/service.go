@@ -0,0 +1,186 @@
+package sessions
+
+import (
+	"errors"
+	"time"
+
+	"atraf-server/pkg/token"
+	"atraf-server/pkg/uid"
+)
+
+const (
+	SessionExpiry    = time.Hour * 24 * 30
+	RefreshTokenSize = 32
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+	ErrSessionInactive     = errors.New("session is revoked or expired")
+)
+
+type Session struct {
+	Id         uid.UID   `json:"id"`
+	AccountId  uid.UID   `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"-"`
+	RevokedAt  time.Time `json:"-"`
+}
+
+// Active reports whether the session was neither revoked nor has it expired.
+func (s Session) Active() bool {
+	return s.RevokedAt.IsZero() && time.Now().Before(s.ExpiresAt)
+}
+
+type RefreshToken struct {
+	Id        uid.UID
+	SessionId uid.UID
+	CreatedAt time.Time
+	UsedAt    time.Time
+}
+
+type Storage interface {
+	Insert(accountId uid.UID, userAgent string, ip string, expiresAt time.Time) (Session, error)
+	ById(sessionId uid.UID) (Session, error)
+	ByAccountId(accountId uid.UID) ([]Session, error)
+	Touch(sessionId uid.UID, ip string) error
+	Revoke(sessionId uid.UID) error
+	RevokeOwned(accountId uid.UID, sessionId uid.UID) error
+	RevokeAll(accountId uid.UID) error
+	RevokeAllExcept(accountId uid.UID, sessionId uid.UID) error
+	Delete(accountId uid.UID) error
+	InsertRefreshToken(sessionId uid.UID, tokenHash string) error
+	RefreshTokenByHash(tokenHash string) (RefreshToken, error)
+	ConsumeRefreshToken(tokenHash string) error
+}
+
+type Service struct {
+	storage Storage
+}
+
+// NewSession starts a new session for the account and returns it along with its first refresh token.
+func (s Service) NewSession(accountId uid.UID, userAgent string, ip string) (Session, string, error) {
+	session, err := s.storage.Insert(accountId, userAgent, ip, time.Now().UTC().Add(SessionExpiry))
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	refreshToken, err := s.newRefreshToken(session.Id)
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	return session, refreshToken, nil
+}
+
+// Refresh exchanges a refresh token for a new one belonging to the same session.
+// Every refresh token can be exchanged exactly once, presenting an already exchanged
+// token means it was leaked, in which case the whole session (token family) is revoked.
+func (s Service) Refresh(refreshToken string, ip string) (Session, string, error) {
+	tokenHash := token.HashOpaqueToken(refreshToken)
+
+	rt, err := s.storage.RefreshTokenByHash(tokenHash)
+	if err != nil {
+		return Session{}, "", ErrInvalidRefreshToken
+	}
+
+	if !rt.UsedAt.IsZero() {
+		if err = s.storage.Revoke(rt.SessionId); err != nil {
+			return Session{}, "", err
+		}
+		return Session{}, "", ErrRefreshTokenReused
+	}
+
+	session, err := s.storage.ById(rt.SessionId)
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	if !session.Active() {
+		return Session{}, "", ErrSessionInactive
+	}
+
+	// Losing this race means the same token was presented concurrently.
+	if err = s.storage.ConsumeRefreshToken(tokenHash); err != nil {
+		if err = s.storage.Revoke(rt.SessionId); err != nil {
+			return Session{}, "", err
+		}
+		return Session{}, "", ErrRefreshTokenReused
+	}
+
+	if err = s.storage.Touch(session.Id, ip); err != nil {
+		return Session{}, "", err
+	}
+
+	newRefreshToken, err := s.newRefreshToken(session.Id)
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	return session, newRefreshToken, nil
+}
+
+// IsActive reports whether the session can still be used to authenticate requests.
+func (s Service) IsActive(sessionId uid.UID) (bool, error) {
+	session, err := s.storage.ById(sessionId)
+	if err != nil {
+		return false, err
+	}
+
+	return session.Active(), nil
+}
+
+// ActiveSessions lists the sessions (devices) the account is currently logged in with.
+func (s Service) ActiveSessions(accountId uid.UID) ([]Session, error) {
+	return s.storage.ByAccountId(accountId)
+}
+
+// Revoke revokes a single session, provided it belongs to the account.
+func (s Service) Revoke(accountId uid.UID, sessionId uid.UID) error {
+	return s.storage.RevokeOwned(accountId, sessionId)
+}
+
+// RevokeAll revokes every session of the account ("log out everywhere").
+func (s Service) RevokeAll(accountId uid.UID) error {
+	return s.storage.RevokeAll(accountId)
+}
+
+// RevokeOthers revokes every session of the account except for the current one.
+func (s Service) RevokeOthers(accountId uid.UID, currentSessionId uid.UID) error {
+	return s.storage.RevokeAllExcept(accountId, currentSessionId)
+}
+
+// Purge permanently deletes every session of the account.
+func (s Service) Purge(accountId uid.UID) error {
+	return s.storage.Delete(accountId)
+}
+
+// RevokeByRefreshToken revokes the session the refresh token was issued for.
+func (s Service) RevokeByRefreshToken(refreshToken string) error {
+	rt, err := s.storage.RefreshTokenByHash(token.HashOpaqueToken(refreshToken))
+	if err != nil {
+		return ErrInvalidRefreshToken
+	}
+
+	return s.storage.Revoke(rt.SessionId)
+}
+
+func (s Service) newRefreshToken(sessionId uid.UID) (string, error) {
+	refreshToken, err := token.NewOpaqueToken(RefreshTokenSize)
+	if err != nil {
+		return "", err
+	}
+
+	if err = s.storage.InsertRefreshToken(sessionId, token.HashOpaqueToken(refreshToken)); err != nil {
+		return "", err
+	}
+
+	return refreshToken, nil
+}
+
+func NewService(storage Storage) *Service {
+	return &Service{storage}
+}
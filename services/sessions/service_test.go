@@ -0,0 +1,217 @@
+package sessions
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"atraf-server/pkg/uid"
+)
+
+// memoryStorage keeps the sessions and refresh tokens the tests need in memory,
+// any other storage call panics.
+type memoryStorage struct {
+	Storage
+
+	mu       sync.Mutex
+	sessions map[uid.UID]Session
+	tokens   map[string]RefreshToken
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		sessions: make(map[uid.UID]Session),
+		tokens:   make(map[string]RefreshToken),
+	}
+}
+
+func (m *memoryStorage) Insert(accountId uid.UID, userAgent string, ip string, expiresAt time.Time) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session := Session{Id: uid.New(), AccountId: accountId, UserAgent: userAgent, IP: ip, ExpiresAt: expiresAt}
+	m.sessions[session.Id] = session
+
+	return session, nil
+}
+
+func (m *memoryStorage) ById(sessionId uid.UID) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionId]
+	if !ok {
+		return Session{}, sql.ErrNoRows
+	}
+
+	return session, nil
+}
+
+func (m *memoryStorage) Touch(sessionId uid.UID, ip string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session := m.sessions[sessionId]
+	session.IP = ip
+	session.LastSeenAt = time.Now()
+	m.sessions[sessionId] = session
+
+	return nil
+}
+
+func (m *memoryStorage) Revoke(sessionId uid.UID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session := m.sessions[sessionId]
+	session.RevokedAt = time.Now()
+	m.sessions[sessionId] = session
+
+	return nil
+}
+
+func (m *memoryStorage) InsertRefreshToken(sessionId uid.UID, tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tokens[tokenHash] = RefreshToken{Id: uid.New(), SessionId: sessionId}
+
+	return nil
+}
+
+func (m *memoryStorage) RefreshTokenByHash(tokenHash string) (RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rt, ok := m.tokens[tokenHash]
+	if !ok {
+		return RefreshToken{}, sql.ErrNoRows
+	}
+
+	return rt, nil
+}
+
+func (m *memoryStorage) ConsumeRefreshToken(tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rt := m.tokens[tokenHash]
+	if !rt.UsedAt.IsZero() {
+		return errors.New("refresh token was already used")
+	}
+
+	rt.UsedAt = time.Now()
+	m.tokens[tokenHash] = rt
+
+	return nil
+}
+
+func TestRefreshRotatesToken(t *testing.T) {
+	s := NewService(newMemoryStorage())
+
+	session, first, err := s.NewSession(uid.New(), "agent", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed, second, err := s.Refresh(first, "127.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if refreshed.Id != session.Id {
+		t.Errorf("expected the refreshed session to stay [%s] got [%s]", session.Id, refreshed.Id)
+	}
+
+	if second == first {
+		t.Error("expected a new refresh token")
+	}
+
+	if _, _, err = s.Refresh(second, "127.0.0.2"); err != nil {
+		t.Errorf("expected the new refresh token to be accepted, got [%v]", err)
+	}
+}
+
+func TestRefreshReuseRevokesSession(t *testing.T) {
+	storage := newMemoryStorage()
+	s := NewService(storage)
+
+	session, first, err := s.NewSession(uid.New(), "agent", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, second, err := s.Refresh(first, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = s.Refresh(first, "127.0.0.1"); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("expected [%v] got [%v]", ErrRefreshTokenReused, err)
+	}
+
+	if storage.sessions[session.Id].Active() {
+		t.Error("expected the session to be revoked once a refresh token is reused")
+	}
+
+	// The token family is revoked, the legitimate latest token included.
+	if _, _, err = s.Refresh(second, "127.0.0.1"); !errors.Is(err, ErrSessionInactive) {
+		t.Errorf("expected [%v] got [%v]", ErrSessionInactive, err)
+	}
+}
+
+func TestRefreshConcurrentReuse(t *testing.T) {
+	s := NewService(newMemoryStorage())
+
+	_, refreshToken, err := s.NewSession(uid.New(), "agent", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	refreshed := 0
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, _, err := s.Refresh(refreshToken, "127.0.0.1"); err == nil {
+				mu.Lock()
+				refreshed++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if refreshed > 1 {
+		t.Errorf("expected the refresh token to be exchanged at most once, got %d", refreshed)
+	}
+}
+
+func TestRefreshRejectsInvalidTokens(t *testing.T) {
+	storage := newMemoryStorage()
+	s := NewService(storage)
+
+	if _, _, err := s.Refresh("unknown", "127.0.0.1"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("expected [%v] got [%v]", ErrInvalidRefreshToken, err)
+	}
+
+	session, refreshToken, err := s.NewSession(uid.New(), "agent", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := storage.sessions[session.Id]
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	storage.sessions[session.Id] = expired
+
+	if _, _, err = s.Refresh(refreshToken, "127.0.0.1"); !errors.Is(err, ErrSessionInactive) {
+		t.Errorf("expected [%v] got [%v]", ErrSessionInactive, err)
+	}
+}
@@ -0,0 +1,97 @@
+package tokens
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"atraf-server/pkg/authentication"
+	"atraf-server/pkg/rest"
+	"atraf-server/pkg/uid"
+	"atraf-server/pkg/validate"
+)
+
+type CreateRequest = Fields
+
+type CreateResponse struct {
+	AccessToken AccessToken `json:"access_token"`
+	// Token is the plain text value, it is only ever returned here.
+	Token string `json:"token"`
+}
+
+type ReadManyResponse struct {
+	AccessTokens []AccessToken `json:"access_tokens"`
+}
+
+type Handler struct {
+	service  *Service
+	validate *validate.Validate
+}
+
+func (h Handler) Create() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request CreateRequest
+		auth := authentication.Context(r)
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err := h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		accessToken, value, err := h.service.NewToken(auth.AccountId, &request)
+		if err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		rest.Success(w, http.StatusCreated, &CreateResponse{
+			accessToken,
+			value,
+		})
+	}
+}
+
+func (h Handler) ReadMany() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := authentication.Context(r)
+
+		accessTokens, err := h.service.TokensByAccountId(auth.AccountId)
+		if err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		rest.Success(w, http.StatusOK, &ReadManyResponse{
+			accessTokens,
+		})
+	}
+}
+
+func (h Handler) Revoke() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := authentication.Context(r)
+
+		tokenId, err := uid.FromString(chi.URLParam(r, "token_id"))
+		if err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		if err = h.service.Revoke(auth.AccountId, tokenId); err != nil {
+			rest.Error(w, err, http.StatusNotFound)
+			return
+		}
+
+		rest.Success(w, http.StatusNoContent, nil)
+	}
+}
+
+func NewHandler(s *Service, v *validate.Validate) *Handler {
+	return &Handler{s, v}
+}
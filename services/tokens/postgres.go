@@ -0,0 +1,153 @@
+package tokens
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"atraf-server/pkg/uid"
+)
+
+type PostgresAccessToken struct {
+	Uuid          uid.UID        `db:"uuid"`
+	AccountUuid   uid.UID        `db:"account_uuid"`
+	Name          string         `db:"name"`
+	Scopes        pq.StringArray `db:"scopes"`
+	TokenHash     string         `db:"token_hash"`
+	LastUsedAt    sql.NullTime   `db:"last_used_at"`
+	ExpiresAt     sql.NullTime   `db:"expires_at"`
+	RevokedAt     sql.NullTime   `db:"revoked_at"`
+	CreatedAt     time.Time      `db:"created_at"`
+	AccountActive bool           `db:"account_active"`
+	AccountRole   sql.NullString `db:"account_role"`
+}
+
+type Postgres struct {
+	db *sqlx.DB
+}
+
+func (p Postgres) Insert(accountId uid.UID, tokenHash string, f *Fields, expiresAt time.Time) (AccessToken, error) {
+	var t PostgresAccessToken
+
+	query := `
+	INSERT INTO access_tokens (account_uuid, name, scopes, token_hash, expires_at)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING *, true AS account_active`
+
+	expires := sql.NullTime{Time: expiresAt, Valid: !expiresAt.IsZero()}
+	if err := p.db.Get(&t, query, accountId, f.Name, pq.StringArray(f.Scopes), tokenHash, expires); err != nil {
+		return AccessToken{}, err
+	}
+
+	return prepareOne(t), nil
+}
+
+func (p Postgres) ByAccountId(accountId uid.UID) ([]AccessToken, error) {
+	var t []PostgresAccessToken
+
+	query := `
+	SELECT *, true AS account_active
+	FROM access_tokens
+	WHERE account_uuid = $1
+	  AND revoked_at IS NULL
+	ORDER BY created_at DESC`
+
+	if err := p.db.Select(&t, query, accountId); err != nil {
+		return nil, err
+	}
+
+	return prepareMany(t), nil
+}
+
+// ByHash returns the token along with the state of its account,
+// tokens of deleted accounts are never returned.
+func (p Postgres) ByHash(tokenHash string) (AccessToken, error) {
+	var t PostgresAccessToken
+
+	query := `
+	SELECT access_tokens.*, accounts.active AS account_active, accounts.role AS account_role
+	FROM access_tokens
+	JOIN accounts ON accounts.uuid = access_tokens.account_uuid
+	WHERE access_tokens.token_hash = $1
+	  AND accounts.deleted_at IS NULL
+	LIMIT 1`
+
+	if err := p.db.Get(&t, query, tokenHash); err != nil {
+		return AccessToken{}, err
+	}
+
+	return prepareOne(t), nil
+}
+
+// Touch records the token usage, at most once a minute to spare writes on every request.
+func (p Postgres) Touch(tokenId uid.UID) error {
+	query := `
+	UPDATE access_tokens
+	SET last_used_at = current_timestamp
+	WHERE uuid = $1
+	  AND (last_used_at IS NULL OR last_used_at < current_timestamp - interval '1 minute')`
+
+	if _, err := p.db.Exec(query, tokenId); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p Postgres) Revoke(accountId uid.UID, tokenId uid.UID) error {
+	query := `
+	UPDATE access_tokens
+	SET revoked_at = current_timestamp
+	WHERE uuid = $1
+	  AND account_uuid = $2
+	  AND revoked_at IS NULL`
+
+	result, err := p.db.Exec(query, tokenId, accountId)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return errors.New(fmt.Sprintf("access token id [%s] couldn't be revoked", tokenId))
+	}
+
+	return nil
+}
+
+func prepareOne(pt PostgresAccessToken) AccessToken {
+	return AccessToken{
+		Id:            pt.Uuid,
+		AccountId:     pt.AccountUuid,
+		Name:          pt.Name,
+		Scopes:        pt.Scopes,
+		LastUsedAt:    pt.LastUsedAt.Time,
+		ExpiresAt:     pt.ExpiresAt.Time,
+		RevokedAt:     pt.RevokedAt.Time,
+		CreatedAt:     pt.CreatedAt,
+		AccountActive: pt.AccountActive,
+		AccountRole:   pt.AccountRole.String,
+	}
+}
+
+func prepareMany(pt []PostgresAccessToken) []AccessToken {
+	var t = make([]AccessToken, 0)
+
+	for _, accessToken := range pt {
+		t = append(t, prepareOne(accessToken))
+	}
+
+	return t
+}
+
+func NewStorage(db *sqlx.DB) *Postgres {
+	return &Postgres{db}
+}
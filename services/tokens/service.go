@@ -0,0 +1,114 @@
+package tokens
+
+import (
+	"errors"
+	"time"
+
+	"atraf-server/pkg/authentication"
+	"atraf-server/pkg/token"
+	"atraf-server/pkg/uid"
+)
+
+const (
+	// Prefix makes leaked tokens easy to recognize, e.g. by secret scanners.
+	Prefix    = "atp_"
+	TokenSize = 32
+)
+
+var ErrTokenInvalid = errors.New("access token is invalid, expired or revoked")
+
+// AccessToken is a personal access token used for scripted API access.
+type AccessToken struct {
+	Id         uid.UID   `json:"id"`
+	AccountId  uid.UID   `json:"-"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	RevokedAt  time.Time `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	// AccountActive and AccountRole are the state of the owning account,
+	// which may change after the token was created.
+	AccountActive bool   `json:"-"`
+	AccountRole   string `json:"-"`
+}
+
+// Valid reports whether the token was neither revoked nor has it expired.
+func (t AccessToken) Valid() bool {
+	return t.RevokedAt.IsZero() && (t.ExpiresAt.IsZero() || time.Now().Before(t.ExpiresAt))
+}
+
+// Fields are AccessToken fields which are set by the client.
+type Fields struct {
+	Name   string   `json:"name" validate:"required,max=100"`
+	Scopes []string `json:"scopes" validate:"required,min=1,dive,oneof=users:read users:write posts:read posts:write comments:read comments:write"`
+	// ExpiresInDays is optional, tokens without an expiry remain valid until revoked.
+	ExpiresInDays int `json:"expires_in_days" validate:"min=0,max=365"`
+}
+
+type Storage interface {
+	Insert(accountId uid.UID, tokenHash string, fields *Fields, expiresAt time.Time) (AccessToken, error)
+	ByAccountId(accountId uid.UID) ([]AccessToken, error)
+	ByHash(tokenHash string) (AccessToken, error)
+	Touch(tokenId uid.UID) error
+	Revoke(accountId uid.UID, tokenId uid.UID) error
+}
+
+type Service struct {
+	storage Storage
+}
+
+// NewToken mints a personal access token and returns it along with its plain text value,
+// which is only stored hashed and can't be retrieved again.
+func (s Service) NewToken(accountId uid.UID, f *Fields) (AccessToken, string, error) {
+	value, err := token.NewOpaqueToken(TokenSize)
+	if err != nil {
+		return AccessToken{}, "", err
+	}
+	value = Prefix + value
+
+	var expiresAt time.Time
+	if f.ExpiresInDays > 0 {
+		expiresAt = time.Now().UTC().AddDate(0, 0, f.ExpiresInDays)
+	}
+
+	accessToken, err := s.storage.Insert(accountId, token.HashOpaqueToken(value), f, expiresAt)
+	if err != nil {
+		return AccessToken{}, "", err
+	}
+
+	return accessToken, value, nil
+}
+
+func (s Service) TokensByAccountId(accountId uid.UID) ([]AccessToken, error) {
+	return s.storage.ByAccountId(accountId)
+}
+
+// Revoke revokes the token, provided it belongs to the account.
+func (s Service) Revoke(accountId uid.UID, tokenId uid.UID) error {
+	return s.storage.Revoke(accountId, tokenId)
+}
+
+// VerifyToken implements authentication.TokenStore.
+func (s Service) VerifyToken(value string) (authentication.CustomClaims, error) {
+	accessToken, err := s.storage.ByHash(token.HashOpaqueToken(value))
+	if err != nil || !accessToken.Valid() {
+		return authentication.CustomClaims{}, ErrTokenInvalid
+	}
+
+	if err = s.storage.Touch(accessToken.Id); err != nil {
+		return authentication.CustomClaims{}, err
+	}
+
+	return authentication.CustomClaims{
+		AccountId:     accessToken.AccountId,
+		AccountActive: accessToken.AccountActive,
+		Role:          accessToken.AccountRole,
+		TokenId:       accessToken.Id,
+		Scopes:        accessToken.Scopes,
+	}, nil
+}
+
+func NewService(storage Storage) *Service {
+	return &Service{storage}
+}
@@ -1,10 +1,18 @@
 package users
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
 
+	"atraf-server/services/bucket"
+
+	"atraf-server/pkg/authentication"
+	"atraf-server/pkg/middleware"
 	"atraf-server/pkg/rest"
 	"atraf-server/pkg/uid"
 	"atraf-server/pkg/validate"
@@ -14,6 +22,21 @@ type ReadOneResponse struct {
 	User User `json:"user"`
 }
 
+const (
+	PictureMaxSize = 5 * 1024 * 1024 // 5MB
+	PictureFormKey = "picture"
+)
+
+type UpdateRequest = ProfileFields
+
+type UpdatePictureRequest struct {
+	File multipart.File `validate:"required"`
+}
+
+type UpdateResponse struct {
+	User User `json:"user"`
+}
+
 type Handler struct {
 	service  *Service
 	validate *validate.Validate
@@ -37,6 +60,97 @@ func (h Handler) ReadOne() http.HandlerFunc {
 	}
 }
 
+func (h Handler) Update() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request UpdateRequest
+		auth := authentication.Context(r)
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err := h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		user, err := h.service.UpdateProfile(auth.AccountId, &request)
+		if err != nil {
+			var throttled *NicknameThrottledError
+			switch {
+			case errors.As(err, &throttled):
+				rest.TooManyRequests(w, err, throttled.RetryAfter)
+			case errors.Is(err, ErrNicknameInvalid):
+				rest.InvalidFields(w, err, map[string][]string{"nickname": {"invalid"}})
+			case errors.Is(err, ErrNicknameLength):
+				rest.InvalidFields(w, err, map[string][]string{"nickname": {"length"}})
+			case errors.Is(err, ErrNicknameTaken):
+				rest.InvalidFields(w, err, map[string][]string{"nickname": {"taken"}})
+			case errors.Is(err, ErrNicknameReserved):
+				rest.InvalidFields(w, err, map[string][]string{"nickname": {"reserved"}})
+			case errors.Is(err, ErrWebsiteInvalid):
+				rest.InvalidFields(w, err, map[string][]string{"website": {"url"}})
+			case errors.Is(err, sql.ErrNoRows):
+				rest.Error(w, err, http.StatusNotFound)
+			default:
+				rest.Error(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		rest.Success(w, http.StatusOK, &UpdateResponse{user})
+	}
+}
+
+func (h Handler) UpdatePicture() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := authentication.Context(r)
+
+		// set max request size
+		middleware.SetMaxBodySize(w, r, PictureMaxSize)
+
+		// set max size allowed before writing to the filesystem.
+		if err := r.ParseMultipartForm(PictureMaxSize); err != nil {
+			rest.Error(w, err, http.StatusRequestEntityTooLarge)
+			return
+		}
+		defer r.Body.Close()
+
+		file, _, err := r.FormFile(PictureFormKey)
+		if err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+		defer file.Close()
+
+		request := &UpdatePictureRequest{file}
+		if err = h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		user, err := h.service.UpdatePicture(auth.AccountId, request.File)
+		if err != nil {
+			switch {
+			case errors.Is(err, bucket.ErrUnsupportedContentType):
+				rest.InvalidFields(w, err, map[string][]string{PictureFormKey: {"content_type"}})
+			case errors.Is(err, bucket.ErrImageTooLarge):
+				rest.InvalidFields(w, err, map[string][]string{PictureFormKey: {"dimensions"}})
+			case errors.Is(err, bucket.ErrInvalidImage):
+				rest.InvalidFields(w, err, map[string][]string{PictureFormKey: {"invalid"}})
+			case errors.Is(err, sql.ErrNoRows):
+				rest.Error(w, err, http.StatusNotFound)
+			default:
+				rest.Error(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		rest.Success(w, http.StatusOK, &UpdateResponse{user})
+	}
+}
+
 func NewHandler(s *Service, v *validate.Validate) *Handler {
 	return &Handler{s, v}
 }
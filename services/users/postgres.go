@@ -2,10 +2,14 @@ package users
 
 import (
 	"database/sql"
+	"log"
+	"mime/multipart"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 
+	"atraf-server/services/bucket"
+
 	"atraf-server/pkg/uid"
 )
 
@@ -15,28 +19,166 @@ type PostgresUser struct {
 	Email          sql.NullString `db:"email"`
 	Nickname       string         `db:"nickname"`
 	ProfilePicture sql.NullString `db:"profile_picture"`
+	Bio            sql.NullString `db:"bio"`
+	Location       sql.NullString `db:"location"`
+	Website        sql.NullString `db:"website"`
 	CreatedAt      time.Time      `db:"created_at"`
 	UpdatedAt      sql.NullTime   `db:"updated_at"`
 	DeletedAt      sql.NullTime   `db:"deleted_at"`
 }
 
+type PostgresNicknameChange struct {
+	Uuid      uid.UID   `db:"uuid"`
+	UserUuid  uid.UID   `db:"user_uuid"`
+	Nickname  string    `db:"nickname"`
+	ChangedAt time.Time `db:"changed_at"`
+}
+
 type Postgres struct {
-	db *sqlx.DB
+	db     *sqlx.DB
+	bucket *bucket.Service
 }
 
-func (p Postgres) Insert(accountId uid.UID, f *Fields) error {
+func (p Postgres) Insert(tx *sqlx.Tx, accountId uid.UID, f *Fields) error {
 	query := `INSERT INTO users (account_uuid, email, nickname, profile_picture) VALUES ($1, $2, $3, $4)`
-	if _, err := p.db.Exec(query, accountId, f.Email, f.Nickname, f.ProfilePicture); err != nil {
+	if _, err := tx.Exec(query, accountId, f.Email, f.Nickname, f.ProfilePicture); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Update sets the non-nil fields, empty optional fields are stored as NULL.
+func (p Postgres) Update(tx *sqlx.Tx, userId uid.UID, f *ProfileFields) (User, error) {
+	var user PostgresUser
+
+	query := `
+	UPDATE users
+	SET nickname   = COALESCE($2, nickname),
+	    bio        = CASE WHEN $3::text IS NULL THEN bio ELSE NULLIF($3, '') END,
+	    location   = CASE WHEN $4::text IS NULL THEN location ELSE NULLIF($4, '') END,
+	    website    = CASE WHEN $5::text IS NULL THEN website ELSE NULLIF($5, '') END,
+	    updated_at = current_timestamp
+	WHERE uuid = $1
+	  AND deleted_at IS NULL
+	RETURNING *`
+
+	if err := tx.Get(&user, query, userId, f.Nickname, f.Bio, f.Location, f.Website); err != nil {
+		return User{}, err
+	}
+
+	return p.prepareOne(user), nil
+}
+
+// LockNickname holds a lock on the nickname, regardless of case, until tx ends.
+func (p Postgres) LockNickname(tx *sqlx.Tx, nickname string) error {
+	query := `SELECT pg_advisory_xact_lock(hashtext('nickname:' || lower($1)))`
+	if _, err := tx.Exec(query, nickname); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// NicknameTaken reports whether another user currently goes by the nickname, regardless of case.
+func (p Postgres) NicknameTaken(tx *sqlx.Tx, userId uid.UID, nickname string) (bool, error) {
+	var taken bool
+
+	query := `SELECT EXISTS(SELECT 1 FROM users WHERE lower(nickname) = lower($2) AND uuid <> $1)`
+	if err := tx.Get(&taken, query, userId, nickname); err != nil {
+		return false, err
+	}
+
+	return taken, nil
+}
+
+// NicknameReserved reports whether another user gave up the nickname after since.
+func (p Postgres) NicknameReserved(tx *sqlx.Tx, userId uid.UID, nickname string, since time.Time) (bool, error) {
+	var reserved bool
+
+	query := `
+	SELECT EXISTS(
+		SELECT 1
+		FROM nickname_history
+		WHERE lower(nickname) = lower($2)
+		  AND user_uuid <> $1
+		  AND changed_at > $3
+	)`
+
+	if err := tx.Get(&reserved, query, userId, nickname, since); err != nil {
+		return false, err
+	}
+
+	return reserved, nil
+}
+
+func (p Postgres) LastNicknameChange(userId uid.UID) (NicknameChange, error) {
+	var change PostgresNicknameChange
+
+	query := `SELECT * FROM nickname_history WHERE user_uuid = $1 ORDER BY changed_at DESC LIMIT 1`
+	if err := p.db.Get(&change, query, userId); err != nil {
+		return NicknameChange{}, err
+	}
+
+	return NicknameChange{
+		UserId:    change.UserUuid,
+		Nickname:  change.Nickname,
+		ChangedAt: change.ChangedAt,
+	}, nil
+}
+
+func (p Postgres) InsertNicknameChange(tx *sqlx.Tx, userId uid.UID, nickname string) error {
+	query := `INSERT INTO nickname_history (user_uuid, nickname) VALUES ($1, $2)`
+	if _, err := tx.Exec(query, userId, nickname); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdatePicture saves the picture variants and removes those of the previous picture,
+// which are only removed once the new picture is stored.
+func (p Postgres) UpdatePicture(userId uid.UID, file multipart.File) (User, error) {
+	var user struct {
+		PostgresUser
+		PreviousPicture sql.NullString `db:"previous_picture"`
+	}
+
+	picture, err := p.bucket.SaveImage(file, PictureSizes)
+	if err != nil {
+		return User{}, err
+	}
+
+	query := `
+	UPDATE users u
+	SET profile_picture = $2,
+	    updated_at      = current_timestamp
+	FROM (SELECT uuid, profile_picture FROM users WHERE uuid = $1 FOR UPDATE) previous
+	WHERE u.uuid = previous.uuid
+	  AND u.deleted_at IS NULL
+	RETURNING u.*, previous.profile_picture AS previous_picture`
+
+	if err = p.db.Get(&user, query, userId, picture); err != nil {
+		if removeErr := p.bucket.RemoveImage(picture, PictureSizes); removeErr != nil {
+			log.Println(removeErr)
+		}
+		return User{}, err
+	}
+
+	if user.PreviousPicture.Valid {
+		// The picture was replaced either way, leftover files are not worth failing the request.
+		if err = p.bucket.RemoveImage(user.PreviousPicture.String, PictureSizes); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return p.prepareOne(user.PostgresUser), nil
+}
+
 func (p Postgres) ById(userId uid.UID) (User, error) {
 	var user PostgresUser
 
-	query := `SELECT * FROM users WHERE uuid = $1 LIMIT 1`
+	query := `SELECT * FROM users WHERE uuid = $1 AND deleted_at IS NULL LIMIT 1`
 	if err := p.db.Get(&user, query, userId); err != nil {
 		return User{}, err
 	}
@@ -47,7 +189,7 @@ func (p Postgres) ById(userId uid.UID) (User, error) {
 func (p Postgres) ByIds(userIds []uid.UID) ([]User, error) {
 	var users []PostgresUser
 
-	query := `SELECT * FROM users WHERE uuid IN (?)`
+	query := `SELECT * FROM users WHERE uuid IN (?) AND deleted_at IS NULL`
 	query, args, err := sqlx.In(query, userIds)
 	if err != nil {
 		return []User{}, err
@@ -64,7 +206,7 @@ func (p Postgres) ByIds(userIds []uid.UID) ([]User, error) {
 func (p Postgres) ByAccountId(accountId uid.UID) (User, error) {
 	var user PostgresUser
 
-	query := `SELECT * FROM users WHERE account_uuid = $1 LIMIT 1`
+	query := `SELECT * FROM users WHERE account_uuid = $1 AND deleted_at IS NULL LIMIT 1`
 	if err := p.db.Get(&user, query, accountId); err != nil {
 		return User{}, err
 	}
@@ -72,6 +214,56 @@ func (p Postgres) ByAccountId(accountId uid.UID) (User, error) {
 	return p.prepareOne(user), nil
 }
 
+// DeletedByAccountId returns the user of a soft-deleted account.
+func (p Postgres) DeletedByAccountId(accountId uid.UID) (User, error) {
+	var user PostgresUser
+
+	query := `SELECT * FROM users WHERE account_uuid = $1 AND deleted_at IS NOT NULL LIMIT 1`
+	if err := p.db.Get(&user, query, accountId); err != nil {
+		return User{}, err
+	}
+
+	return p.prepareOne(user), nil
+}
+
+// Delete permanently deletes the user of the account along with its nickname history and profile picture.
+// The picture files are removed once the deletion is committed, failing to remove them is only logged.
+func (p Postgres) Delete(accountId uid.UID) error {
+	var pictures []sql.NullString
+
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM nickname_history WHERE user_uuid IN (SELECT uuid FROM users WHERE account_uuid = $1)`
+	if _, err = tx.Exec(query, accountId); err != nil {
+		return err
+	}
+
+	query = `DELETE FROM users WHERE account_uuid = $1 RETURNING profile_picture`
+	if err = tx.Select(&pictures, query, accountId); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, picture := range pictures {
+		if !picture.Valid {
+			continue
+		}
+
+		if err := p.bucket.RemoveImage(picture.String, PictureSizes); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
+
 func (p Postgres) prepareMany(pu []PostgresUser) []User {
 	var users = make([]User, 0)
 
@@ -82,17 +274,29 @@ func (p Postgres) prepareMany(pu []PostgresUser) []User {
 	return users
 }
 
-func (Postgres) prepareOne(pu PostgresUser) User {
-	return User{
-		Id:             pu.Uuid,
-		Email:          pu.Email.String,
-		Nickname:       pu.Nickname,
-		ProfilePicture: pu.ProfilePicture.String,
-		CreatedAt:      pu.CreatedAt,
-		UpdatedAt:      pu.UpdatedAt.Time,
+func (p Postgres) prepareOne(pu PostgresUser) User {
+	user := User{
+		Id:        pu.Uuid,
+		Email:     pu.Email.String,
+		Nickname:  pu.Nickname,
+		Bio:       pu.Bio.String,
+		Location:  pu.Location.String,
+		Website:   pu.Website.String,
+		CreatedAt: pu.CreatedAt,
+		UpdatedAt: pu.UpdatedAt.Time,
 	}
+
+	if pu.ProfilePicture.Valid {
+		user.ProfilePictures = make(map[int]string)
+		for _, size := range PictureSizes {
+			user.ProfilePictures[size] = p.bucket.FileURL(bucket.ImageVariant(pu.ProfilePicture.String, size))
+		}
+		user.ProfilePicture = user.ProfilePictures[PictureSizes[len(PictureSizes)-1]]
+	}
+
+	return user
 }
 
-func NewStorage(db *sqlx.DB) *Postgres {
-	return &Postgres{db}
+func NewStorage(db *sqlx.DB, b *bucket.Service) *Postgres {
+	return &Postgres{db, b}
 }
@@ -1,18 +1,70 @@
 package users
 
 import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"mime/multipart"
+	"net/url"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/jmoiron/sqlx"
+
+	"atraf-server/pkg/database"
 	"atraf-server/pkg/uid"
 )
 
+const (
+	NicknameMinLength = 2
+	NicknameMaxLength = 32
+
+	// NicknameChangeInterval is how often a user may change their nickname.
+	NicknameChangeInterval = time.Hour * 24 * 7
+	// NicknameReservation is how long a nickname which was given up can't be taken
+	// by anyone but its previous owner, so it can't be used to impersonate them.
+	NicknameReservation = time.Hour * 24 * 90
+	// NicknameAttempts is how many variations AvailableNickname tries.
+	NicknameAttempts = 10
+)
+
+// PictureSizes are the square sizes, in pixels, a profile picture is saved in.
+// ProfilePicture is the largest one.
+var PictureSizes = []int{48, 128, 512}
+
+var (
+	ErrNicknameInvalid  = errors.New("nickname contains invalid characters")
+	ErrNicknameLength   = fmt.Errorf("nickname must be %d to %d characters long", NicknameMinLength, NicknameMaxLength)
+	ErrNicknameTaken    = errors.New("nickname is taken")
+	ErrNicknameReserved = errors.New("nickname was recently used by another user")
+	ErrWebsiteInvalid   = errors.New("website must be an http(s) url")
+)
+
+// NicknameThrottledError is returned when the nickname was changed within NicknameChangeInterval.
+type NicknameThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *NicknameThrottledError) Error() string {
+	return fmt.Sprintf("nickname was changed recently, retry after %s", e.RetryAfter.Round(time.Second))
+}
+
 type User struct {
-	Id             uid.UID   `json:"id"`
-	Email          string    `json:"-"`
-	Nickname       string    `json:"nickname"`
-	ProfilePicture string    `json:"profile_picture"`
-	CreatedAt      time.Time `json:"-"`
-	UpdatedAt      time.Time `json:"-"`
+	Id             uid.UID `json:"id"`
+	Email          string  `json:"-"`
+	Nickname       string  `json:"nickname"`
+	ProfilePicture string  `json:"profile_picture"`
+	// ProfilePictures maps each of PictureSizes to its URL.
+	ProfilePictures map[int]string `json:"profile_pictures,omitempty"`
+	Bio             string         `json:"bio"`
+	Location        string         `json:"location"`
+	Website         string         `json:"website"`
+	CreatedAt       time.Time      `json:"-"`
+	UpdatedAt       time.Time      `json:"-"`
 }
 
 // Fields are User fields which can be modified.
@@ -22,19 +74,118 @@ type Fields struct {
 	ProfilePicture string `json:"profile_picture"`
 }
 
+// ProfileFields are the User fields a user may edit on their own.
+// Omitted (nil) fields are left as is, empty ones are cleared.
+type ProfileFields struct {
+	Nickname *string `json:"nickname" validate:"omitempty,min=2,max=32"`
+	Bio      *string `json:"bio" validate:"omitempty,max=280"`
+	Location *string `json:"location" validate:"omitempty,max=64"`
+	Website  *string `json:"website" validate:"omitempty,max=200"`
+}
+
+// NicknameChange is a nickname a user has given up.
+type NicknameChange struct {
+	UserId    uid.UID
+	Nickname  string
+	ChangedAt time.Time
+}
+
 type Storage interface {
 	ById(userId uid.UID) (User, error)
 	ByIds(userIds []uid.UID) ([]User, error)
 	ByAccountId(accountID uid.UID) (User, error)
-	Insert(accountId uid.UID, fields *Fields) error
+	DeletedByAccountId(accountId uid.UID) (User, error)
+	Insert(tx *sqlx.Tx, accountId uid.UID, fields *Fields) error
+	Update(tx *sqlx.Tx, userId uid.UID, fields *ProfileFields) (User, error)
+	UpdatePicture(userId uid.UID, file multipart.File) (User, error)
+	LockNickname(tx *sqlx.Tx, nickname string) error
+	NicknameTaken(tx *sqlx.Tx, userId uid.UID, nickname string) (bool, error)
+	NicknameReserved(tx *sqlx.Tx, userId uid.UID, nickname string, since time.Time) (bool, error)
+	LastNicknameChange(userId uid.UID) (NicknameChange, error)
+	InsertNicknameChange(tx *sqlx.Tx, userId uid.UID, nickname string) error
+	Delete(accountId uid.UID) error
 }
 
 type Service struct {
-	storage Storage
+	storage    Storage
+	transactor *database.Transactor
+}
+
+// NewUser creates the user profile of a newly inserted account, within the same transaction.
+// The nickname may not belong, or recently have belonged, to another user, see ClaimNickname.
+func (s Service) NewUser(tx *sqlx.Tx, accountId uid.UID, f *Fields) error {
+	nickname, err := ValidateNickname(f.Nickname)
+	if err != nil {
+		return err
+	}
+	f.Nickname = nickname
+
+	if err = s.ClaimNickname(tx, uid.Nil, nickname); err != nil {
+		return err
+	}
+
+	return s.storage.Insert(tx, accountId, f)
+}
+
+// AvailableNickname returns the nickname, or a variation of it with a number appended when it is
+// unavailable, for accounts whose nickname wasn't chosen by a person (e.g. an external login).
+// It is only guaranteed to remain available within tx, see ClaimNickname.
+func (s Service) AvailableNickname(tx *sqlx.Tx, nickname string) (string, error) {
+	base, err := ValidateNickname(nickname)
+	if err != nil {
+		base = "user"
+	}
+
+	if len([]rune(base)) > NicknameMaxLength-5 {
+		base = string([]rune(base)[:NicknameMaxLength-5])
+	}
+
+	candidate := base
+	for attempt := 0; attempt < NicknameAttempts; attempt++ {
+		err = s.ClaimNickname(tx, uid.Nil, candidate)
+		if err == nil {
+			return candidate, nil
+		}
+
+		if !errors.Is(err, ErrNicknameTaken) && !errors.Is(err, ErrNicknameReserved) {
+			return "", err
+		}
+
+		suffix, err := rand.Int(rand.Reader, big.NewInt(10000))
+		if err != nil {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s%04d", base, suffix.Int64())
+	}
+
+	return "", ErrNicknameTaken
 }
 
-func (s Service) NewUser(accountId uid.UID, f *Fields) error {
-	return s.storage.Insert(accountId, f)
+// ClaimNickname fails when the nickname belongs, or recently belonged, to a user other than userId.
+// Concurrent claims of the same nickname are serialized, the nickname is claimed until tx ends,
+// so the caller must store it within tx.
+func (s Service) ClaimNickname(tx *sqlx.Tx, userId uid.UID, nickname string) error {
+	if err := s.storage.LockNickname(tx, nickname); err != nil {
+		return err
+	}
+
+	taken, err := s.storage.NicknameTaken(tx, userId, nickname)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrNicknameTaken
+	}
+
+	reserved, err := s.storage.NicknameReserved(tx, userId, nickname, time.Now().UTC().Add(-NicknameReservation))
+	if err != nil {
+		return err
+	}
+	if reserved {
+		return ErrNicknameReserved
+	}
+
+	return nil
 }
 
 func (s Service) UserById(userId uid.UID) (User, error) {
@@ -49,6 +200,126 @@ func (s Service) UserByAccountId(accountId uid.UID) (User, error) {
 	return s.storage.ByAccountId(accountId)
 }
 
-func NewService(storage Storage) *Service {
-	return &Service{storage}
+func (s Service) DeletedUserByAccountId(accountId uid.UID) (User, error) {
+	return s.storage.DeletedByAccountId(accountId)
+}
+
+// UpdateProfile updates the profile of the account's user. A nickname change is recorded,
+// and is refused when the nickname belongs, or recently belonged, to another user.
+func (s Service) UpdateProfile(accountId uid.UID, f *ProfileFields) (User, error) {
+	user, err := s.storage.ByAccountId(accountId)
+	if err != nil {
+		return User{}, err
+	}
+
+	if f.Website != nil {
+		website := strings.TrimSpace(*f.Website)
+		if website != "" {
+			u, err := url.Parse(website)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return User{}, ErrWebsiteInvalid
+			}
+		}
+		f.Website = &website
+	}
+
+	for _, field := range []*string{f.Bio, f.Location} {
+		if field != nil {
+			*field = strings.TrimSpace(*field)
+		}
+	}
+
+	changed := false
+	if f.Nickname != nil {
+		nickname, err := ValidateNickname(*f.Nickname)
+		if err != nil {
+			return User{}, err
+		}
+		f.Nickname = &nickname
+
+		if changed, err = s.checkNickname(user, nickname); err != nil {
+			return User{}, err
+		}
+	}
+
+	err = s.transactor.Transaction(func(tx *sqlx.Tx) error {
+		if changed {
+			// Changing the case of the nickname doesn't affect others.
+			if !strings.EqualFold(*f.Nickname, user.Nickname) {
+				if err := s.ClaimNickname(tx, user.Id, *f.Nickname); err != nil {
+					return err
+				}
+			}
+
+			if err := s.storage.InsertNicknameChange(tx, user.Id, user.Nickname); err != nil {
+				return err
+			}
+		}
+
+		user, err = s.storage.Update(tx, user.Id, f)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// UpdatePicture replaces the profile picture of the account's user.
+func (s Service) UpdatePicture(accountId uid.UID, f multipart.File) (User, error) {
+	user, err := s.storage.ByAccountId(accountId)
+	if err != nil {
+		return User{}, err
+	}
+
+	return s.storage.UpdatePicture(user.Id, f)
+}
+
+// ValidateNickname returns the nickname without surrounding whitespace,
+// provided it is of the allowed length and only holds printable characters.
+func ValidateNickname(nickname string) (string, error) {
+	nickname = strings.TrimSpace(nickname)
+
+	if length := utf8.RuneCountInString(nickname); length < NicknameMinLength || length > NicknameMaxLength {
+		return "", ErrNicknameLength
+	}
+
+	for _, r := range nickname {
+		if !unicode.IsPrint(r) {
+			return "", ErrNicknameInvalid
+		}
+	}
+
+	return nickname, nil
+}
+
+// checkNickname reports whether nickname differs from the user's current nickname,
+// and whether the user may change it already. Whether the user may take it is up to ClaimNickname.
+func (s Service) checkNickname(user User, nickname string) (bool, error) {
+	if nickname == user.Nickname {
+		return false, nil
+	}
+
+	last, err := s.storage.LastNicknameChange(user.Id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	if err == nil {
+		if wait := time.Until(last.ChangedAt.Add(NicknameChangeInterval)); wait > 0 {
+			return false, &NicknameThrottledError{wait}
+		}
+	}
+
+	return true, nil
+}
+
+// PurgeUser permanently deletes the user of an account.
+func (s Service) PurgeUser(accountId uid.UID) error {
+	return s.storage.Delete(accountId)
+}
+
+func NewService(storage Storage, transactor *database.Transactor) *Service {
+	return &Service{storage, transactor}
 }
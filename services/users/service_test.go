@@ -0,0 +1,208 @@
+package users
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"atraf-server/pkg/uid"
+)
+
+// nicknameStorage keeps users and their nickname history in memory, any other storage call panics.
+type nicknameStorage struct {
+	Storage
+	users   map[uid.UID]User
+	history []NicknameChange
+}
+
+func newNicknameStorage(users ...User) *nicknameStorage {
+	storage := &nicknameStorage{users: make(map[uid.UID]User)}
+	for _, user := range users {
+		storage.users[user.Id] = user
+	}
+
+	return storage
+}
+
+func (n *nicknameStorage) LockNickname(*sqlx.Tx, string) error {
+	return nil
+}
+
+func (n *nicknameStorage) NicknameTaken(_ *sqlx.Tx, userId uid.UID, nickname string) (bool, error) {
+	for _, user := range n.users {
+		if user.Id != userId && strings.EqualFold(user.Nickname, nickname) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (n *nicknameStorage) NicknameReserved(_ *sqlx.Tx, userId uid.UID, nickname string, since time.Time) (bool, error) {
+	for _, change := range n.history {
+		if change.UserId != userId && strings.EqualFold(change.Nickname, nickname) && change.ChangedAt.After(since) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (n *nicknameStorage) LastNicknameChange(userId uid.UID) (NicknameChange, error) {
+	var last NicknameChange
+	for _, change := range n.history {
+		if change.UserId == userId && change.ChangedAt.After(last.ChangedAt) {
+			last = change
+		}
+	}
+
+	if last.UserId == uid.Nil {
+		return NicknameChange{}, sql.ErrNoRows
+	}
+
+	return last, nil
+}
+
+func (n *nicknameStorage) Insert(_ *sqlx.Tx, accountId uid.UID, f *Fields) error {
+	user := User{Id: uid.New(), Nickname: f.Nickname}
+	n.users[user.Id] = user
+
+	return nil
+}
+
+func TestClaimNickname(t *testing.T) {
+	alice := User{Id: uid.New(), Nickname: "Alice"}
+	bob := User{Id: uid.New(), Nickname: "bob"}
+
+	storage := newNicknameStorage(alice, bob)
+	storage.history = []NicknameChange{
+		// Bob gave up "robert" recently, and "bobby" long ago.
+		{UserId: bob.Id, Nickname: "robert", ChangedAt: time.Now().Add(-time.Hour)},
+		{UserId: bob.Id, Nickname: "bobby", ChangedAt: time.Now().Add(-NicknameReservation - time.Hour)},
+	}
+
+	s := NewService(storage, nil)
+
+	cases := []struct {
+		name     string
+		userId   uid.UID
+		nickname string
+		err      error
+	}{
+		{"available", alice.Id, "carol", nil},
+		{"taken", alice.Id, "bob", ErrNicknameTaken},
+		{"taken regardless of case", alice.Id, "BOB", ErrNicknameTaken},
+		{"own nickname", alice.Id, "alice", nil},
+		{"taken by a new user", uid.Nil, "alice", ErrNicknameTaken},
+		{"reserved", alice.Id, "Robert", ErrNicknameReserved},
+		{"reserved for a new user", uid.Nil, "robert", ErrNicknameReserved},
+		{"reclaimed by its previous owner", bob.Id, "robert", nil},
+		{"reservation expired", alice.Id, "bobby", nil},
+	}
+
+	for _, c := range cases {
+		if err := s.ClaimNickname(nil, c.userId, c.nickname); !errors.Is(err, c.err) {
+			t.Errorf("%s: expected [%v] got [%v]", c.name, c.err, err)
+		}
+	}
+}
+
+func TestNewUserClaimsNickname(t *testing.T) {
+	storage := newNicknameStorage(User{Id: uid.New(), Nickname: "alice"})
+	s := NewService(storage, nil)
+
+	if err := s.NewUser(nil, uid.New(), &Fields{Nickname: " Alice "}); !errors.Is(err, ErrNicknameTaken) {
+		t.Errorf("expected [%v] got [%v]", ErrNicknameTaken, err)
+	}
+
+	if err := s.NewUser(nil, uid.New(), &Fields{Nickname: "x"}); !errors.Is(err, ErrNicknameLength) {
+		t.Errorf("expected [%v] got [%v]", ErrNicknameLength, err)
+	}
+
+	if err := s.NewUser(nil, uid.New(), &Fields{Nickname: " carol "}); err != nil {
+		t.Fatal(err)
+	}
+
+	if taken, _ := storage.NicknameTaken(nil, uid.Nil, "carol"); !taken {
+		t.Error("expected the trimmed nickname to be stored")
+	}
+}
+
+func TestAvailableNickname(t *testing.T) {
+	storage := newNicknameStorage(User{Id: uid.New(), Nickname: "alice"})
+	s := NewService(storage, nil)
+
+	nickname, err := s.AvailableNickname(nil, "carol")
+	if err != nil || nickname != "carol" {
+		t.Errorf("expected [carol] got [%s] [%v]", nickname, err)
+	}
+
+	nickname, err = s.AvailableNickname(nil, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nickname == "alice" || !strings.HasPrefix(nickname, "alice") || len(nickname) != len("alice")+4 {
+		t.Errorf("expected a numbered variation of [alice] got [%s]", nickname)
+	}
+
+	// Nicknames which can't be used as is fall back to "user".
+	if nickname, err = s.AvailableNickname(nil, "x"); err != nil || !strings.HasPrefix(nickname, "user") {
+		t.Errorf("expected a nickname based on [user] got [%s] [%v]", nickname, err)
+	}
+
+	long := User{Id: uid.New(), Nickname: strings.Repeat("a", NicknameMaxLength)}
+	storage.users[long.Id] = long
+
+	if nickname, err = s.AvailableNickname(nil, long.Nickname); err != nil || nickname == long.Nickname || len([]rune(nickname)) > NicknameMaxLength {
+		t.Errorf("expected a variation of at most %d characters got [%s] [%v]", NicknameMaxLength, nickname, err)
+	}
+}
+
+func TestCheckNickname(t *testing.T) {
+	user := User{Id: uid.New(), Nickname: "alice"}
+	storage := newNicknameStorage(user)
+	s := NewService(storage, nil)
+
+	if changed, err := s.checkNickname(user, "alice"); changed || err != nil {
+		t.Errorf("expected the same nickname to be left unchanged, got %t [%v]", changed, err)
+	}
+
+	if changed, err := s.checkNickname(user, "carol"); !changed || err != nil {
+		t.Errorf("expected a first change to be allowed, got %t [%v]", changed, err)
+	}
+
+	storage.history = append(storage.history, NicknameChange{UserId: user.Id, Nickname: "alicia", ChangedAt: time.Now().Add(-time.Hour)})
+
+	var throttled *NicknameThrottledError
+	if _, err := s.checkNickname(user, "carol"); !errors.As(err, &throttled) {
+		t.Fatalf("expected the change to be throttled, got [%v]", err)
+	}
+
+	if throttled.RetryAfter <= 0 || throttled.RetryAfter > NicknameChangeInterval {
+		t.Errorf("unexpected retry after [%s]", throttled.RetryAfter)
+	}
+}
+
+func TestValidateNickname(t *testing.T) {
+	cases := map[string]error{
+		"alice":                                  nil,
+		"  alice  ":                              nil,
+		"a":                                      ErrNicknameLength,
+		"   a   ":                                ErrNicknameLength,
+		strings.Repeat("a", NicknameMaxLength+1): ErrNicknameLength,
+		"ali\u0000ce":                            ErrNicknameInvalid,
+		"ali\nce":                                ErrNicknameInvalid,
+		"émilie":                                 nil,
+	}
+
+	for nickname, expected := range cases {
+		if _, err := ValidateNickname(nickname); !errors.Is(err, expected) {
+			t.Errorf("%q: expected [%v] got [%v]", nickname, expected, err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package webhooks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"atraf-server/pkg/authentication"
+	"atraf-server/pkg/middleware"
+	"atraf-server/pkg/rest"
+	"atraf-server/pkg/uid"
+	"atraf-server/pkg/validate"
+)
+
+type CreateRequest = Fields
+
+type CreateResponse struct {
+	Webhook Webhook `json:"webhook"`
+	// Secret signs the payloads, it is only ever returned here.
+	Secret string `json:"secret"`
+}
+
+type UpdateRequest = Fields
+
+type ReadOneResponse struct {
+	Webhook Webhook `json:"webhook"`
+}
+
+type ReadManyResponse struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+type DeliveriesResponse struct {
+	Cursor     string     `json:"cursor"`
+	Deliveries []Delivery `json:"deliveries"`
+}
+
+type Handler struct {
+	service  *Service
+	validate *validate.Validate
+}
+
+func (h Handler) Create() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request CreateRequest
+		auth := authentication.Context(r)
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err := h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		webhook, err := h.service.NewWebhook(auth.AccountId, &request)
+		if err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		rest.Success(w, http.StatusCreated, &CreateResponse{
+			webhook,
+			webhook.Secret,
+		})
+	}
+}
+
+func (h Handler) ReadMany() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhooks, err := h.service.Webhooks()
+		if err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		rest.Success(w, http.StatusOK, &ReadManyResponse{
+			webhooks,
+		})
+	}
+}
+
+func (h Handler) Update() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request UpdateRequest
+
+		webhookId, err := uid.FromString(chi.URLParam(r, "webhook_id"))
+		if err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		if err = json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.Error(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err = h.validate.Struct(request); err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		webhook, err := h.service.UpdateWebhook(webhookId, &request)
+		if errors.Is(err, sql.ErrNoRows) {
+			rest.Error(w, err, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		rest.Success(w, http.StatusOK, &ReadOneResponse{
+			webhook,
+		})
+	}
+}
+
+func (h Handler) Delete() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhookId, err := uid.FromString(chi.URLParam(r, "webhook_id"))
+		if err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		if err = h.service.DeleteWebhook(webhookId); err != nil {
+			rest.Error(w, err, http.StatusNotFound)
+			return
+		}
+
+		rest.Success(w, http.StatusNoContent, nil)
+	}
+}
+
+// Deliveries lists the delivery log of a webhook, most recent first.
+func (h Handler) Deliveries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var cursor string
+
+		webhookId, err := uid.FromString(chi.URLParam(r, "webhook_id"))
+		if err != nil {
+			rest.Error(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		pagination := middleware.GetPaginationContext(r)
+
+		// we add an additional delivery in order to determine if there is another page
+		pagination.Limit++
+
+		deliveries, err := h.service.Deliveries(webhookId, pagination)
+		if err != nil {
+			rest.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		if len(deliveries) == pagination.Limit {
+			deliveries = deliveries[:len(deliveries)-1]
+			lastDelivery := deliveries[len(deliveries)-1]
+
+			cursor, err = middleware.EncodeCursor(&middleware.Cursor{
+				Key:   lastDelivery.Id,
+				Value: lastDelivery.CreatedAt,
+			})
+
+			if err != nil {
+				rest.Error(w, err, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		rest.Success(w, http.StatusOK, &DeliveriesResponse{
+			cursor,
+			deliveries,
+		})
+	}
+}
+
+func NewHandler(s *Service, v *validate.Validate) *Handler {
+	return &Handler{s, v}
+}
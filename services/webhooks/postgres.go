@@ -0,0 +1,329 @@
+package webhooks
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"atraf-server/pkg/middleware"
+	"atraf-server/pkg/uid"
+)
+
+type PostgresWebhook struct {
+	Uuid        uid.UID        `db:"uuid"`
+	AccountUuid uid.UID        `db:"account_uuid"`
+	URL         string         `db:"url"`
+	Events      pq.StringArray `db:"events"`
+	Secret      string         `db:"secret"`
+	Active      bool           `db:"active"`
+	Failures    int            `db:"failures"`
+	DisabledAt  sql.NullTime   `db:"disabled_at"`
+	CreatedAt   time.Time      `db:"created_at"`
+	UpdatedAt   time.Time      `db:"updated_at"`
+}
+
+type PostgresDelivery struct {
+	Uuid          uid.UID        `db:"uuid"`
+	WebhookUuid   uid.UID        `db:"webhook_uuid"`
+	EventUuid     uid.UID        `db:"event_uuid"`
+	EventType     string         `db:"event_type"`
+	Payload       []byte         `db:"payload"`
+	Attempts      int            `db:"attempts"`
+	StatusCode    sql.NullInt32  `db:"status_code"`
+	LastError     sql.NullString `db:"last_error"`
+	NextAttemptAt time.Time      `db:"next_attempt_at"`
+	LockedUntil   sql.NullTime   `db:"locked_until"`
+	DeliveredAt   sql.NullTime   `db:"delivered_at"`
+	FailedAt      sql.NullTime   `db:"failed_at"`
+	CreatedAt     time.Time      `db:"created_at"`
+}
+
+type Postgres struct {
+	db *sqlx.DB
+}
+
+func (p Postgres) Insert(accountId uid.UID, secret string, f *Fields) (Webhook, error) {
+	var w PostgresWebhook
+
+	query := `
+	INSERT INTO webhooks (account_uuid, url, events, secret)
+	VALUES ($1, $2, $3, $4)
+	RETURNING *`
+
+	if err := p.db.Get(&w, query, accountId, f.URL, pq.StringArray(f.Events), secret); err != nil {
+		return Webhook{}, err
+	}
+
+	return prepareWebhook(w), nil
+}
+
+func (p Postgres) One(webhookId uid.UID) (Webhook, error) {
+	var w PostgresWebhook
+
+	query := `SELECT * FROM webhooks WHERE uuid = $1 LIMIT 1`
+	if err := p.db.Get(&w, query, webhookId); err != nil {
+		return Webhook{}, err
+	}
+
+	return prepareWebhook(w), nil
+}
+
+func (p Postgres) Many() ([]Webhook, error) {
+	var w []PostgresWebhook
+
+	query := `SELECT * FROM webhooks ORDER BY created_at DESC`
+	if err := p.db.Select(&w, query); err != nil {
+		return nil, err
+	}
+
+	return prepareWebhooks(w), nil
+}
+
+// Update replaces the webhook fields, re-enabling a webhook resets its failures.
+func (p Postgres) Update(webhookId uid.UID, f *Fields) (Webhook, error) {
+	var w PostgresWebhook
+
+	query := `
+	UPDATE webhooks
+	SET url = $2,
+	    events = $3,
+	    failures = CASE WHEN $4::boolean AND NOT active THEN 0 ELSE failures END,
+	    disabled_at = CASE WHEN $4::boolean THEN NULL ELSE coalesce(disabled_at, current_timestamp) END,
+	    active = $4,
+	    updated_at = current_timestamp
+	WHERE uuid = $1
+	RETURNING *`
+
+	if err := p.db.Get(&w, query, webhookId, f.URL, pq.StringArray(f.Events), f.Active); err != nil {
+		return Webhook{}, err
+	}
+
+	return prepareWebhook(w), nil
+}
+
+func (p Postgres) Delete(webhookId uid.UID) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM webhooks WHERE uuid = $1`
+
+	result, err := tx.Exec(query, webhookId)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return errors.New(fmt.Sprintf("webhook id [%s] couldn't be deleted", webhookId))
+	}
+
+	// Pending deliveries of a deleted webhook are never claimed again, the log goes along with it.
+	query = `DELETE FROM webhook_deliveries WHERE webhook_uuid = $1`
+	if _, err = tx.Exec(query, webhookId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RecordFailure counts a failed attempt and disables the webhook once it reaches disableAfter.
+func (p Postgres) RecordFailure(webhookId uid.UID, disableAfter int) error {
+	query := `
+	UPDATE webhooks
+	SET failures = failures + 1,
+	    active = failures + 1 < $2,
+	    disabled_at = CASE WHEN failures + 1 >= $2 THEN current_timestamp END
+	WHERE uuid = $1
+	  AND active = true`
+
+	if _, err := p.db.Exec(query, webhookId, disableAfter); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p Postgres) ResetFailures(webhookId uid.UID) error {
+	query := `UPDATE webhooks SET failures = 0 WHERE uuid = $1`
+	if _, err := p.db.Exec(query, webhookId); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InsertDelivery queues a delivery, an event is only ever queued once per webhook.
+func (p Postgres) InsertDelivery(webhookId uid.UID, eventId uid.UID, eventType string, payload []byte) error {
+	query := `
+	INSERT INTO webhook_deliveries (webhook_uuid, event_uuid, event_type, payload)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (webhook_uuid, event_uuid) DO NOTHING`
+
+	if _, err := p.db.Exec(query, webhookId, eventId, eventType, payload); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ClaimDeliveries leases the oldest pending deliveries, see events.Postgres.Claim.
+func (p Postgres) ClaimDeliveries(limit int, lease time.Duration) ([]Delivery, error) {
+	var d []PostgresDelivery
+
+	query := `
+	UPDATE webhook_deliveries
+	SET locked_until = $2
+	WHERE uuid IN (
+	    SELECT uuid
+	    FROM webhook_deliveries
+	    WHERE delivered_at IS NULL
+	      AND failed_at IS NULL
+	      AND next_attempt_at <= current_timestamp
+	      AND (locked_until IS NULL OR locked_until < current_timestamp)
+	    ORDER BY created_at
+	    LIMIT $1
+	    FOR UPDATE SKIP LOCKED
+	)
+	RETURNING *`
+
+	if err := p.db.Select(&d, query, limit, time.Now().UTC().Add(lease)); err != nil {
+		return nil, err
+	}
+
+	return prepareDeliveries(d), nil
+}
+
+func (p Postgres) MarkDelivered(deliveryId uid.UID, statusCode int) error {
+	query := `
+	UPDATE webhook_deliveries
+	SET attempts = attempts + 1,
+	    status_code = $2,
+	    last_error = NULL,
+	    locked_until = NULL,
+	    delivered_at = current_timestamp
+	WHERE uuid = $1`
+
+	if _, err := p.db.Exec(query, deliveryId, statusCode); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MarkFailed schedules the delivery for another attempt, or gives up on it when final.
+func (p Postgres) MarkFailed(deliveryId uid.UID, statusCode int, reason string, retryAt time.Time, final bool) error {
+	query := `
+	UPDATE webhook_deliveries
+	SET attempts = attempts + 1,
+	    status_code = $2,
+	    last_error = $3,
+	    next_attempt_at = $4,
+	    locked_until = NULL,
+	    failed_at = CASE WHEN $5::boolean THEN current_timestamp END
+	WHERE uuid = $1`
+
+	code := sql.NullInt32{Int32: int32(statusCode), Valid: statusCode != 0}
+	if _, err := p.db.Exec(query, deliveryId, code, reason, retryAt, final); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p Postgres) Deliveries(webhookId uid.UID, pc *middleware.PaginationContext) ([]Delivery, error) {
+	var d []PostgresDelivery
+
+	if pc.Cursor.Key != uid.Nil {
+		query := `
+		SELECT *
+		FROM webhook_deliveries
+		WHERE webhook_uuid = $1
+		  AND (created_at, uuid) < ($2 :: timestamp, $3)
+		ORDER BY created_at DESC, uuid DESC
+		LIMIT $4`
+
+		if err := p.db.Select(&d, query, webhookId, pc.Cursor.Value, pc.Cursor.Key, pc.Limit); err != nil {
+			return nil, err
+		}
+	} else {
+		query := `
+		SELECT *
+		FROM webhook_deliveries
+		WHERE webhook_uuid = $1
+		ORDER BY created_at DESC, uuid DESC
+		LIMIT $2`
+
+		if err := p.db.Select(&d, query, webhookId, pc.Limit); err != nil {
+			return nil, err
+		}
+	}
+
+	return prepareDeliveries(d), nil
+}
+
+func prepareWebhook(pw PostgresWebhook) Webhook {
+	return Webhook{
+		Id:         pw.Uuid,
+		AccountId:  pw.AccountUuid,
+		URL:        pw.URL,
+		Events:     pw.Events,
+		Secret:     pw.Secret,
+		Active:     pw.Active,
+		Failures:   pw.Failures,
+		DisabledAt: pw.DisabledAt.Time,
+		CreatedAt:  pw.CreatedAt,
+		UpdatedAt:  pw.UpdatedAt,
+	}
+}
+
+func prepareWebhooks(pw []PostgresWebhook) []Webhook {
+	var w = make([]Webhook, 0)
+
+	for _, webhook := range pw {
+		w = append(w, prepareWebhook(webhook))
+	}
+
+	return w
+}
+
+func prepareDelivery(pd PostgresDelivery) Delivery {
+	return Delivery{
+		Id:            pd.Uuid,
+		WebhookId:     pd.WebhookUuid,
+		EventId:       pd.EventUuid,
+		EventType:     pd.EventType,
+		Payload:       pd.Payload,
+		Attempts:      pd.Attempts,
+		StatusCode:    int(pd.StatusCode.Int32),
+		LastError:     pd.LastError.String,
+		NextAttemptAt: pd.NextAttemptAt,
+		DeliveredAt:   pd.DeliveredAt.Time,
+		FailedAt:      pd.FailedAt.Time,
+		CreatedAt:     pd.CreatedAt,
+	}
+}
+
+func prepareDeliveries(pd []PostgresDelivery) []Delivery {
+	var d = make([]Delivery, 0)
+
+	for _, delivery := range pd {
+		d = append(d, prepareDelivery(delivery))
+	}
+
+	return d
+}
+
+func NewStorage(db *sqlx.DB) *Postgres {
+	return &Postgres{db}
+}
@@ -0,0 +1,453 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"atraf-server/pkg/middleware"
+	"atraf-server/pkg/token"
+	"atraf-server/pkg/uid"
+	"atraf-server/services/comments"
+	"atraf-server/services/events"
+	"atraf-server/services/posts"
+)
+
+const (
+	// SecretPrefix makes leaked secrets easy to recognize, e.g. by secret scanners.
+	SecretPrefix = "whsec_"
+	SecretSize   = 32
+
+	SignatureHeader = "X-Atraf-Signature"
+	EventHeader     = "X-Atraf-Event"
+	DeliveryHeader  = "X-Atraf-Delivery"
+)
+
+const (
+	BatchSize = 20
+	// Lease is how long a claimed delivery is hidden from other dispatchers while it's sent.
+	Lease       = time.Minute
+	Timeout     = time.Second * 10
+	MaxAttempts = 8
+	MaxBackoff  = time.Hour * 6
+	// DisableAfter is the number of consecutive failed attempts after which a webhook is disabled.
+	DisableAfter = 20
+)
+
+// Events are the event types webhooks can subscribe to.
+var Events = []string{
+	events.PostCreated,
+	events.PostUpdated,
+	events.CommentCreated,
+	events.CommentUpdated,
+}
+
+var (
+	ErrWebhookDisabled  = errors.New("webhook is disabled")
+	ErrForbiddenAddress = errors.New("webhook host resolves to a forbidden address")
+)
+
+// forbiddenNetworks are ranges webhooks may not reach besides the private, loopback, link-local,
+// multicast and unspecified addresses, so webhooks can't be used to probe internal services.
+var forbiddenNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("192.0.0.0/24"),
+	mustParseCIDR("198.18.0.0/15"),
+	mustParseCIDR("240.0.0.0/4"),
+	mustParseCIDR("64:ff9b::/96"),
+}
+
+type Webhook struct {
+	Id        uid.UID  `json:"id"`
+	AccountId uid.UID  `json:"account_id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"-"`
+	Active    bool     `json:"active"`
+	// Failures is the number of consecutive failed delivery attempts.
+	Failures   int       `json:"failures"`
+	DisabledAt time.Time `json:"disabled_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Subscribed reports whether the webhook receives events of eventType.
+func (w Webhook) Subscribed(eventType string) bool {
+	for _, e := range w.Events {
+		if e == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Fields are Webhook fields which are set by the client.
+type Fields struct {
+	URL    string   `json:"url" validate:"required,url,startswith=https://,max=2048"`
+	Events []string `json:"events" validate:"required,min=1,dive,oneof=post.created post.updated comment.created comment.updated"`
+	// Active re-enables a disabled webhook, resetting its failures.
+	Active bool `json:"active"`
+}
+
+// Delivery is a single event sent to a webhook, along with the outcome of its latest attempt.
+type Delivery struct {
+	Id            uid.UID         `json:"id"`
+	WebhookId     uid.UID         `json:"webhook_id"`
+	EventId       uid.UID         `json:"event_id"`
+	EventType     string          `json:"event_type"`
+	Payload       json.RawMessage `json:"payload"`
+	Attempts      int             `json:"attempts"`
+	StatusCode    int             `json:"status_code"`
+	LastError     string          `json:"last_error"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	DeliveredAt   time.Time       `json:"delivered_at"`
+	FailedAt      time.Time       `json:"failed_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+// Payload is the signed JSON body sent to webhooks.
+type Payload struct {
+	Id        uid.UID     `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+type Storage interface {
+	Insert(accountId uid.UID, secret string, f *Fields) (Webhook, error)
+	One(webhookId uid.UID) (Webhook, error)
+	Many() ([]Webhook, error)
+	Update(webhookId uid.UID, f *Fields) (Webhook, error)
+	Delete(webhookId uid.UID) error
+	RecordFailure(webhookId uid.UID, disableAfter int) error
+	ResetFailures(webhookId uid.UID) error
+	InsertDelivery(webhookId uid.UID, eventId uid.UID, eventType string, payload []byte) error
+	ClaimDeliveries(limit int, lease time.Duration) ([]Delivery, error)
+	MarkDelivered(deliveryId uid.UID, statusCode int) error
+	MarkFailed(deliveryId uid.UID, statusCode int, reason string, retryAt time.Time, final bool) error
+	Deliveries(webhookId uid.UID, pc *middleware.PaginationContext) ([]Delivery, error)
+}
+
+type Service struct {
+	storage  Storage
+	posts    *posts.Service
+	comments *comments.Service
+	client   *http.Client
+}
+
+// NewWebhook creates a webhook along with the secret its payloads are signed with.
+func (s Service) NewWebhook(accountId uid.UID, f *Fields) (Webhook, error) {
+	secret, err := token.NewOpaqueToken(SecretSize)
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	return s.storage.Insert(accountId, SecretPrefix+secret, f)
+}
+
+func (s Service) WebhookById(webhookId uid.UID) (Webhook, error) {
+	return s.storage.One(webhookId)
+}
+
+func (s Service) Webhooks() ([]Webhook, error) {
+	return s.storage.Many()
+}
+
+func (s Service) UpdateWebhook(webhookId uid.UID, f *Fields) (Webhook, error) {
+	return s.storage.Update(webhookId, f)
+}
+
+func (s Service) DeleteWebhook(webhookId uid.UID) error {
+	return s.storage.Delete(webhookId)
+}
+
+func (s Service) Deliveries(webhookId uid.UID, pc *middleware.PaginationContext) ([]Delivery, error) {
+	return s.storage.Deliveries(webhookId, pc)
+}
+
+// Subscribe registers the webhooks subscriber on the event bus.
+func (s Service) Subscribe(bus *events.Service) {
+	for _, eventType := range Events {
+		bus.Subscribe(eventType, "webhooks.enqueue", s.onEvent)
+	}
+}
+
+// onEvent queues a delivery for every active webhook subscribed to the event.
+// The payload is built once, so every attempt sends the same body.
+func (s Service) onEvent(event events.Event) error {
+	data, err := s.eventData(event)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The post or comment was purged before the event got delivered.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(&Payload{
+		Id:        event.Id,
+		Type:      event.Type,
+		CreatedAt: event.CreatedAt,
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+
+	webhooks, err := s.storage.Many()
+	if err != nil {
+		return err
+	}
+
+	for _, webhook := range webhooks {
+		if !webhook.Active || !webhook.Subscribed(event.Type) {
+			continue
+		}
+
+		if err = s.storage.InsertDelivery(webhook.Id, event.Id, event.Type, payload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// eventData loads the current state of the post or comment the event is about.
+func (s Service) eventData(event events.Event) (interface{}, error) {
+	switch event.Type {
+	case events.PostCreated, events.PostUpdated:
+		var payload events.PostPayload
+		if err := event.Decode(&payload); err != nil {
+			return nil, err
+		}
+
+		return s.posts.PostById(payload.PostId)
+	case events.CommentCreated, events.CommentUpdated:
+		var payload events.CommentPayload
+		if err := event.Decode(&payload); err != nil {
+			return nil, err
+		}
+
+		return s.comments.CommentById(payload.CommentId)
+	default:
+		return nil, fmt.Errorf("unsupported event type [%s]", event.Type)
+	}
+}
+
+// Run sends the pending deliveries until none are left.
+// A delivery which fails to be processed is logged and retried later, without holding back the others.
+func (s Service) Run() error {
+	for {
+		pending, err := s.storage.ClaimDeliveries(BatchSize, Lease)
+		if err != nil {
+			return err
+		}
+
+		for _, delivery := range pending {
+			if err = s.deliver(delivery); err == nil {
+				continue
+			}
+
+			log.Printf("webhook delivery [%s]: %v", delivery.Id, err)
+
+			// When even this fails, the delivery is claimed again once its lease expires.
+			attempts := delivery.Attempts + 1
+			if err = s.storage.MarkFailed(delivery.Id, 0, err.Error(), retryAt(attempts), attempts >= MaxAttempts); err != nil {
+				log.Printf("webhook delivery [%s]: %v", delivery.Id, err)
+			}
+		}
+
+		if len(pending) < BatchSize {
+			return nil
+		}
+	}
+}
+
+// Start runs the deliveries on every interval tick, it blocks and is meant to run in its own goroutine.
+func (s Service) Start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.Run(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// deliver makes a single attempt, a failed attempt is retried with an exponential backoff
+// and counts towards disabling the webhook.
+func (s Service) deliver(delivery Delivery) error {
+	webhook, err := s.storage.One(delivery.WebhookId)
+	if err != nil {
+		return err
+	}
+
+	if !webhook.Active {
+		return s.storage.MarkFailed(delivery.Id, 0, ErrWebhookDisabled.Error(), time.Now().UTC(), true)
+	}
+
+	statusCode, err := s.send(webhook, delivery)
+	if err == nil {
+		if err = s.storage.MarkDelivered(delivery.Id, statusCode); err != nil {
+			return err
+		}
+
+		if webhook.Failures == 0 {
+			return nil
+		}
+
+		return s.storage.ResetFailures(webhook.Id)
+	}
+
+	attempts := delivery.Attempts + 1
+	if err = s.storage.MarkFailed(delivery.Id, statusCode, err.Error(), retryAt(attempts), attempts >= MaxAttempts); err != nil {
+		return err
+	}
+
+	return s.storage.RecordFailure(webhook.Id, DisableAfter)
+}
+
+// retryAt returns when a delivery is attempted again after its failed attempts, backing off exponentially.
+func retryAt(attempts int) time.Time {
+	backoff := time.Minute << (attempts - 1)
+	if backoff > MaxBackoff || backoff <= 0 {
+		backoff = MaxBackoff
+	}
+
+	return time.Now().UTC().Add(backoff)
+}
+
+// send posts the payload to the webhook, any status other than 2xx is a failure.
+func (s Service) send(webhook Webhook, delivery Delivery) (int, error) {
+	timestamp := time.Now().Unix()
+
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "Atraf-Webhooks/1.0")
+	request.Header.Set(EventHeader, delivery.EventType)
+	request.Header.Set(DeliveryHeader, delivery.Id.String())
+	request.Header.Set(SignatureHeader, Signature(webhook.Secret, timestamp, delivery.Payload))
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	// Drain the body so the connection can be reused.
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("unexpected response status [%d]", response.StatusCode)
+	}
+
+	return response.StatusCode, nil
+}
+
+// Signature returns the signature header value, t=<unix timestamp>,v1=<hex HMAC-SHA256>.
+// The HMAC is computed over "<timestamp>.<body>", so receivers can reject replayed payloads.
+func Signature(secret string, timestamp int64, body []byte) string {
+	ts := strconv.FormatInt(timestamp, 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+
+	return fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Forbidden reports whether ip is an address webhooks may not be delivered to.
+func Forbidden(ip net.IP) bool {
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+
+	for _, network := range forbiddenNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dialPublic resolves the host and dials the first address it resolves to which isn't Forbidden.
+// The resolved address is dialed rather than the host, so the host can't resolve to another address in between.
+func dialPublic(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		err = ErrForbiddenAddress
+		for _, ip := range addresses {
+			if Forbidden(ip.IP) {
+				continue
+			}
+
+			var conn net.Conn
+			if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port)); err == nil {
+				return conn, nil
+			}
+		}
+
+		return nil, err
+	}
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+
+	return network
+}
+
+func NewService(storage Storage, posts *posts.Service, comments *comments.Service) *Service {
+	return &Service{
+		storage:  storage,
+		posts:    posts,
+		comments: comments,
+		client: &http.Client{
+			Timeout: Timeout,
+			// Webhooks are dialed directly, a proxy would connect to forbidden addresses on their behalf.
+			Transport: &http.Transport{
+				DialContext:         dialPublic(&net.Dialer{Timeout: Timeout}),
+				ForceAttemptHTTP2:   true,
+				MaxIdleConns:        100,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: Timeout,
+			},
+			// Redirects are not followed, the webhook URL must be the final endpoint.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
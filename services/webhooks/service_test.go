@@ -0,0 +1,221 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"atraf-server/pkg/uid"
+)
+
+// verify checks a signature header the way a receiver would.
+func verify(secret string, header string, body []byte) bool {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		switch {
+		case strings.HasPrefix(part, "t="):
+			timestamp = strings.TrimPrefix(part, "t=")
+		case strings.HasPrefix(part, "v1="):
+			signature = strings.TrimPrefix(part, "v1=")
+		}
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(signature))
+}
+
+func TestSignature(t *testing.T) {
+	body := []byte(`{"type":"post.created"}`)
+	header := Signature("whsec_secret", 1700000000, body)
+
+	if !strings.HasPrefix(header, "t=1700000000,v1=") {
+		t.Fatalf("unexpected signature header [%s]", header)
+	}
+
+	if !verify("whsec_secret", header, body) {
+		t.Error("expected the signature to verify")
+	}
+
+	if verify("whsec_another", header, body) {
+		t.Error("expected the signature of another secret not to verify")
+	}
+
+	if verify("whsec_secret", header, []byte(`{"type":"post.updated"}`)) {
+		t.Error("expected the signature of another body not to verify")
+	}
+
+	// The timestamp is signed, so it can't be replaced to replay an old payload.
+	replayed := strings.Replace(header, "t=1700000000", "t=1800000000", 1)
+	if verify("whsec_secret", replayed, body) {
+		t.Error("expected the signature with another timestamp not to verify")
+	}
+}
+
+func TestForbidden(t *testing.T) {
+	cases := map[string]bool{
+		"127.0.0.1":        true,
+		"10.1.2.3":         true,
+		"172.16.0.1":       true,
+		"192.168.1.1":      true,
+		"169.254.169.254":  true,
+		"100.64.0.1":       true,
+		"0.0.0.0":          true,
+		"198.18.0.1":       true,
+		"224.0.0.1":        true,
+		"255.255.255.255":  true,
+		"::1":              true,
+		"fe80::1":          true,
+		"fd00::1":          true,
+		"::":               true,
+		"::ffff:127.0.0.1": true,
+		"64:ff9b::a00:1":   true,
+		"93.184.216.34":    false,
+		"2606:4700::1111":  false,
+	}
+
+	for address, expected := range cases {
+		if got := Forbidden(net.ParseIP(address)); got != expected {
+			t.Errorf("%s: expected %t got %t", address, expected, got)
+		}
+	}
+}
+
+func TestDialPublicRefusesForbiddenAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(server.Close)
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dial := dialPublic(&net.Dialer{Timeout: time.Second})
+
+	for _, host := range []string{"127.0.0.1", "localhost", "::1"} {
+		if _, err = dial(context.Background(), "tcp", net.JoinHostPort(host, port)); !errors.Is(err, ErrForbiddenAddress) {
+			t.Errorf("%s: expected [%v] got [%v]", host, ErrForbiddenAddress, err)
+		}
+	}
+
+	// The service client dials through dialPublic, a webhook pointing at the server is refused.
+	s := NewService(nil, nil, nil)
+	if _, err = s.send(Webhook{URL: server.URL}, Delivery{Payload: []byte(`{}`)}); !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("expected [%v] got [%v]", ErrForbiddenAddress, err)
+	}
+}
+
+func TestSendSignsTheDelivery(t *testing.T) {
+	delivery := Delivery{Id: uid.New(), EventType: "post.created", Payload: []byte(`{"id":"1"}`)}
+
+	received := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		if !verify("whsec_secret", r.Header.Get(SignatureHeader), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		received <- r
+	}))
+	t.Cleanup(server.Close)
+
+	// The test server listens on a loopback address, which the service client refuses to dial.
+	s := Service{client: server.Client()}
+
+	statusCode, err := s.send(Webhook{URL: server.URL, Secret: "whsec_secret"}, delivery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if statusCode != http.StatusOK {
+		t.Fatalf("expected [%d] got [%d]", http.StatusOK, statusCode)
+	}
+
+	r := <-received
+	if r.Header.Get(EventHeader) != delivery.EventType || r.Header.Get(DeliveryHeader) != delivery.Id.String() {
+		t.Errorf("unexpected headers %v", r.Header)
+	}
+
+	timestamp, _ := strconv.ParseInt(strings.TrimPrefix(strings.Split(r.Header.Get(SignatureHeader), ",")[0], "t="), 10, 64)
+	if time.Since(time.Unix(timestamp, 0)) > time.Minute {
+		t.Errorf("expected a current timestamp, got [%d]", timestamp)
+	}
+}
+
+// runStorage serves a single batch of deliveries and records their outcome, any other storage call panics.
+type runStorage struct {
+	Storage
+	webhooks  map[uid.UID]Webhook
+	pending   []Delivery
+	delivered []uid.UID
+	failed    map[uid.UID]string
+}
+
+func (r *runStorage) ClaimDeliveries(int, time.Duration) ([]Delivery, error) {
+	pending := r.pending
+	r.pending = nil
+
+	return pending, nil
+}
+
+func (r *runStorage) One(webhookId uid.UID) (Webhook, error) {
+	webhook, ok := r.webhooks[webhookId]
+	if !ok {
+		return Webhook{}, sql.ErrNoRows
+	}
+
+	return webhook, nil
+}
+
+func (r *runStorage) MarkDelivered(deliveryId uid.UID, _ int) error {
+	r.delivered = append(r.delivered, deliveryId)
+	return nil
+}
+
+func (r *runStorage) MarkFailed(deliveryId uid.UID, _ int, reason string, _ time.Time, _ bool) error {
+	r.failed[deliveryId] = reason
+	return nil
+}
+
+func TestRunContinuesPastFailingDeliveries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(server.Close)
+
+	webhook := Webhook{Id: uid.New(), URL: server.URL, Active: true}
+	broken := Delivery{Id: uid.New(), WebhookId: uid.New(), Payload: []byte(`{}`)}
+	working := Delivery{Id: uid.New(), WebhookId: webhook.Id, Payload: []byte(`{}`)}
+
+	storage := &runStorage{
+		webhooks: map[uid.UID]Webhook{webhook.Id: webhook},
+		pending:  []Delivery{broken, working},
+		failed:   make(map[uid.UID]string),
+	}
+
+	s := Service{storage: storage, client: server.Client()}
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := storage.failed[broken.Id]; !ok {
+		t.Error("expected the failing delivery to be recorded as failed")
+	}
+
+	if len(storage.delivered) != 1 || storage.delivered[0] != working.Id {
+		t.Errorf("expected the next delivery to be delivered, got %v", storage.delivered)
+	}
+}